@@ -5,15 +5,20 @@ import (
 	"flag"
 	"fmt"
 	"log"
-	"runtime"
+	"net/url"
+	"os"
 	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/aaronland/go-sqlite/v2"
 	"github.com/sfomuseum/go-flags/flagset"
 	"github.com/whosonfirst/go-reader"
 	sql_tables "github.com/whosonfirst/go-whosonfirst-sql/tables"
 	"github.com/whosonfirst/go-whosonfirst-sqlite-features-index/v2"
-	"github.com/whosonfirst/go-whosonfirst-sqlite-features/v2/tables"
 	sql_index "github.com/whosonfirst/go-whosonfirst-sqlite-index/v4"
 )
 
@@ -24,22 +29,59 @@ func Run(ctx context.Context, logger *log.Logger) error {
 	return RunWithFlagSet(ctx, fs, logger)
 }
 
-// To do: Add RunWithOptions...
-
 func RunWithFlagSet(ctx context.Context, fs *flag.FlagSet, logger *log.Logger) error {
 
 	flagset.Parse(fs)
 
-	runtime.GOMAXPROCS(procs)
+	opts, err := RunOptionsFromFlagSet(fs)
+
+	if err != nil {
+		return fmt.Errorf("Failed to derive run options, %w", err)
+	}
+
+	_, err = RunWithOptions(ctx, opts, logger)
+	return err
+}
+
+// RunWithOptions indexes Who's On First records in a SQLite database using the settings defined in 'opts' and returns
+// a `RunResults` instance describing the run.
+// It does not read or modify any package-level state so it is safe to invoke concurrently (with different
+// databases) from the same process.
+func RunWithOptions(ctx context.Context, opts *RunOptions, logger *log.Logger) (*RunResults, error) {
+
+	if opts.ShardBy != "" && opts.records == nil {
+		return runSharded(ctx, opts, logger)
+	}
 
-	if spatial_tables {
+	if opts.Atomic {
+		return runAtomic(ctx, opts, logger)
+	}
+
+	started := time.Now()
+
+	all := opts.All
+	ancestors := opts.Ancestors
+	concordances := opts.Concordances
+	geojson := opts.GeoJSON
+	geometries := opts.Geometries
+	names := opts.Names
+	rtree := opts.RTree
+	properties := opts.Properties
+	search := opts.Search
+	spr := opts.SPR
+	supersedes := opts.Supersedes
+
+	alt_files := opts.IndexAltFiles
+	index_alt := opts.IndexAlt
+
+	if opts.SpatialTables {
 		rtree = true
 		geojson = true
 		properties = true
 		spr = true
 	}
 
-	if spelunker_tables {
+	if opts.SpelunkerTables {
 		rtree = true
 		spr = true
 		geojson = true
@@ -47,16 +89,88 @@ func RunWithFlagSet(ctx context.Context, fs *flag.FlagSet, logger *log.Logger) e
 		ancestors = true
 		search = true
 	}
-	
+
+	results := &RunResults{
+		UnresolvedRelations:  make([]*index.UnresolvedRelation, 0),
+		ValidationViolations: make(map[string]int64),
+	}
+
+	if opts.GitDiffFrom != "" && opts.Sync {
+		return nil, fmt.Errorf("Git diff mode and sync mode can not be used together")
+	}
+
+	// A pragma profile, if specified, takes precedence over the -live-hard-die-fast flag
+	// which is equivalent to the "bulk-build" profile.
+
+	pragma_profile := opts.PragmaProfile
+
+	if pragma_profile == "" && opts.LiveHardDieFast {
+		pragma_profile = PRAGMA_PROFILE_BULK_BUILD
+	}
+
+	pragmas, err := derivePragmas(pragma_profile, opts.Pragmas)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to derive pragmas, %w", err)
+	}
+
+	// Most pragmas only apply to the connection they are executed in so, where the database
+	// driver supports it, they are added to the database URI and executed for every connection.
+	// Otherwise they are applied to a single connection which is then used for everything.
+
+	db_uri := opts.DatabaseURI
+	pragmas_in_uri := supportsDatabaseURIPragmas(db_uri)
+
+	if pragmas_in_uri && len(pragmas) > 0 {
+
+		db_uri, err = databaseURIWithPragmas(db_uri, pragmas)
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to add pragmas to database URI, %w", err)
+		}
+	}
+
 	db, err := sqlite.NewDatabase(ctx, db_uri)
 
 	if err != nil {
-		return fmt.Errorf("Unable to create database (%s) because %v", db_uri, err)
+		return nil, fmt.Errorf("Unable to create database (%s) because %v", opts.DatabaseURI, err)
+	}
+
+	if !pragmas_in_uri && len(pragmas) > 0 {
+
+		err = applyPragmas(ctx, db, pragmas)
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to apply pragmas, %w", err)
+		}
+	}
+
+	if opts.BatchSize < 0 {
+		return nil, fmt.Errorf("Invalid batch size, %d", opts.BatchSize)
+	}
+
+	if opts.RelationsBatchSize < 0 {
+		return nil, fmt.Errorf("Invalid relations batch size, %d", opts.RelationsBatchSize)
+	}
+
+	// If a batch size has been specified, for the main pass or for relations (which are indexed
+	// after the main pass), wrap the database (before anything else touches it) in order to write
+	// each batch in a single transaction.
+
+	if opts.BatchSize > 0 || (opts.IndexRelations && opts.RelationsBatchSize > 0) {
+
+		bdb, err := index.NewBatchDatabase(ctx, db)
+
+		if err != nil {
+			return nil, fmt.Errorf("Unable to create batch database because %v", err)
+		}
+
+		db = bdb
 	}
 
 	// optimize query performance
 	// https://www.sqlite.org/pragma.html#pragma_optimize
-	if optimize {
+	if opts.Optimize {
 
 		defer func() {
 
@@ -81,240 +195,614 @@ func RunWithFlagSet(ctx context.Context, fs *flag.FlagSet, logger *log.Logger) e
 		defer db.Close(ctx)
 	}
 
-	if live_hard {
+	table_names := make([]string, 0)
 
-		err = sqlite.LiveHardDieFast(ctx, db)
+	add_table := func(name string, enabled bool) {
 
-		if err != nil {
-			return fmt.Errorf("Unable to live hard and die fast so just dying fast instead, because %v", err)
+		if enabled && !slices.Contains(table_names, name) {
+			table_names = append(table_names, name)
 		}
 	}
 
-	to_index := make([]sqlite.Table, 0)
+	add_table(sql_tables.GEOJSON_TABLE_NAME, geojson || all)
+	add_table(sql_tables.SUPERSEDES_TABLE_NAME, supersedes || all)
+	add_table(sql_tables.RTREE_TABLE_NAME, rtree || all)
+	add_table(sql_tables.PROPERTIES_TABLE_NAME, properties || all)
+	add_table(sql_tables.SPR_TABLE_NAME, spr || all)
+	add_table(sql_tables.NAMES_TABLE_NAME, names || all)
+	add_table(sql_tables.ANCESTORS_TABLE_NAME, ancestors || all)
+	add_table(sql_tables.CONCORDANCES_TABLE_NAME, concordances || all)
 
-	if geojson || all {
+	// see the way we don't check all here - that's so people who don't have
+	// spatialite installed can still use all (20180122/thisisaaronland)
 
-		geojson_opts, err := tables.DefaultGeoJSONTableOptions()
+	add_table(sql_tables.GEOMETRIES_TABLE_NAME, geometries)
 
-		if err != nil {
-			return fmt.Errorf("failed to create '%s' table options because %s", sql_tables.GEOJSON_TABLE_NAME, err)
-		}
+	// see the way we don't check all here either - that's because this table can be
+	// brutally slow to index and should probably really just be a separate database
+	// anyway... (20180214/thisisaaronland)
+
+	add_table(sql_tables.SEARCH_TABLE_NAME, search)
+
+	for _, name := range opts.Tables {
+		add_table(strings.ToLower(name), true)
+	}
+
+	to_index := make([]sqlite.Table, 0)
+	alt_tables := make([]string, 0)
+
+	for _, name := range table_names {
 
 		// alt_files is deprecated (20240229/straup)
 
-		if alt_files || slices.Contains(index_alt, sql_tables.GEOJSON_TABLE_NAME) || slices.Contains(index_alt, index_alt_all) {
-			geojson_opts.IndexAltFiles = true
+		table_opts := &index.TableOptions{
+			IndexAltFiles: alt_files || slices.Contains(index_alt, name) || slices.Contains(index_alt, index_alt_all),
 		}
 
-		gt, err := tables.NewGeoJSONTableWithDatabaseAndOptions(ctx, db, geojson_opts)
+		t, err := index.NewTable(ctx, name, db, table_opts)
 
 		if err != nil {
-			return fmt.Errorf("failed to create '%s' table because %s", sql_tables.GEOJSON_TABLE_NAME, err)
+			return nil, fmt.Errorf("failed to create '%s' table because %v", name, err)
 		}
 
-		to_index = append(to_index, gt)
+		to_index = append(to_index, t)
+
+		if table_opts.IndexAltFiles {
+			alt_tables = append(alt_tables, name)
+		}
 	}
 
-	if supersedes || all {
+	if len(to_index) == 0 {
+		return nil, fmt.Errorf("You forgot to specify which (any) tables to index")
+	}
 
-		t, err := tables.NewSupersedesTableWithDatabase(ctx, db)
+	var skipped int64
+	var filtered int64
 
-		if err != nil {
-			return fmt.Errorf("failed to create '%s' table because %s", sql_tables.SUPERSEDES_TABLE_NAME, err)
+	record_opts := &index.SQLiteFeaturesLoadRecordFuncOptions{
+		StrictAltFiles:    opts.StrictAltFiles,
+		IncludePlacetypes: opts.IncludePlacetypes,
+		ExcludePlacetypes: opts.ExcludePlacetypes,
+		IsCurrent:         opts.IsCurrent,
+		IsDeprecated:      opts.IsDeprecated,
+		IsCeased:          opts.IsCeased,
+		IsSuperseded:      opts.IsSuperseded,
+		IncludeRepos:      opts.IncludeRepos,
+		Filtered:          &filtered,
+	}
+
+	if opts.Incremental {
+		record_opts.Incremental = true
+		record_opts.Database = db
+		record_opts.Skipped = &skipped
+	}
+
+	if len(opts.Filters) > 0 {
+
+		filters := make([]*index.PropertyFilter, len(opts.Filters))
+
+		for i, str := range opts.Filters {
+
+			f, err := index.NewPropertyFilter(str)
+
+			if err != nil {
+				return nil, fmt.Errorf("Failed to parse filter, %w", err)
+			}
+
+			filters[i] = f
 		}
 
-		to_index = append(to_index, t)
+		filter_mode := index.FilterModeAnd
+
+		if opts.FilterMode != "" {
+			filter_mode = index.FilterMode(strings.ToUpper(opts.FilterMode))
+		}
+
+		switch filter_mode {
+		case index.FilterModeAnd, index.FilterModeOr:
+			// pass
+		default:
+			return nil, fmt.Errorf("Invalid filter mode '%s'", opts.FilterMode)
+		}
+
+		record_opts.Filters = filters
+		record_opts.FilterMode = filter_mode
 	}
 
-	if rtree || all {
+	switch {
+	case opts.IntersectsBbox != "" && opts.IntersectsGeoJSON != "":
+		return nil, fmt.Errorf("The -intersects-bbox and -intersects-geojson flags are mutually exclusive")
+	case opts.IntersectsBbox != "":
 
-		rtree_opts, err := tables.DefaultRTreeTableOptions()
+		f, err := index.NewSpatialFilterFromBbox(opts.IntersectsBbox)
 
 		if err != nil {
-			return fmt.Errorf("failed to create 'rtree' table options because %s", err)
+			return nil, fmt.Errorf("Failed to create spatial filter, %w", err)
 		}
 
-		// alt_files is deprecated (20240229/straup)
+		record_opts.SpatialFilter = f
+
+	case opts.IntersectsGeoJSON != "":
+
+		body, err := os.ReadFile(opts.IntersectsGeoJSON)
 
-		if alt_files || slices.Contains(index_alt, sql_tables.RTREE_TABLE_NAME) || slices.Contains(index_alt, index_alt_all) {
-			rtree_opts.IndexAltFiles = true
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read %s, %w", opts.IntersectsGeoJSON, err)
 		}
 
-		gt, err := tables.NewRTreeTableWithDatabaseAndOptions(ctx, db, rtree_opts)
+		f, err := index.NewSpatialFilterFromGeoJSON(body)
 
 		if err != nil {
-			return fmt.Errorf("failed to create 'rtree' table because %s", err)
+			return nil, fmt.Errorf("Failed to create spatial filter from %s, %w", opts.IntersectsGeoJSON, err)
 		}
 
-		to_index = append(to_index, gt)
+		record_opts.SpatialFilter = f
+
+	default:
+		// pass
+	}
+
+	seen := new(sync.Map)
+
+	if opts.Sync {
+		record_opts.SeenIds = seen
 	}
 
-	if properties || all {
+	// Alternate geometry files encountered before their principal record has been filtered
+
+	pending_alts := index.NewPendingAlts()
+	defer pending_alts.Close()
+
+	record_opts.PendingAlts = pending_alts
+
+	var validation_summary *index.ValidationSummary
+
+	if opts.Validate {
 
-		properties_opts, err := tables.DefaultPropertiesTableOptions()
+		rules, err := index.DefaultValidationRulesByName(opts.ValidationRules...)
 
 		if err != nil {
-			return fmt.Errorf("failed to create 'properties' table options because %s", err)
+			return nil, fmt.Errorf("Failed to derive validation rules, %w", err)
 		}
 
-		// alt_files is deprecated (20240229/straup)
+		validation_mode := index.ValidationModeWarn
 
-		if alt_files || slices.Contains(index_alt, sql_tables.PROPERTIES_TABLE_NAME) || slices.Contains(index_alt, index_alt_all) {
-			properties_opts.IndexAltFiles = true
+		if opts.ValidationMode != "" {
+			validation_mode = index.ValidationMode(opts.ValidationMode)
 		}
 
-		gt, err := tables.NewPropertiesTableWithDatabaseAndOptions(ctx, db, properties_opts)
-
-		if err != nil {
-			return fmt.Errorf("failed to create 'properties' table because %s", err)
+		switch validation_mode {
+		case index.ValidationModeReject, index.ValidationModeWarn, index.ValidationModeQuarantine:
+			// pass
+		default:
+			return nil, fmt.Errorf("Invalid validation mode '%s'", validation_mode)
 		}
 
-		to_index = append(to_index, gt)
+		validation_summary = index.NewValidationSummary()
+
+		record_opts.ValidationRules = rules
+		record_opts.ValidationMode = validation_mode
+		record_opts.ValidationSummary = validation_summary
+		record_opts.Database = db
 	}
 
-	if spr || all {
+	transformers := make([]index.RecordTransformer, 0)
 
-		spr_opts, err := tables.DefaultSPRTableOptions()
+	if len(opts.IncludeProperties) > 0 || len(opts.ExcludeProperties) > 0 {
+
+		properties_opts := &index.PropertiesTransformOptions{
+			Include: opts.IncludeProperties,
+			Exclude: opts.ExcludeProperties,
+		}
+
+		fn, err := index.NewPropertiesTransformFunc(properties_opts)
 
 		if err != nil {
-			return fmt.Errorf("Failed to create '%s' table options because %v", sql_tables.SPR_TABLE_NAME, err)
+			return nil, fmt.Errorf("Failed to create properties transform, %w", err)
 		}
 
-		// alt_files is deprecated (20240229/straup)
+		transformers = append(transformers, fn)
+	}
+
+	if opts.SimplifyTolerance > 0 || opts.CoordinatePrecision > 0 {
 
-		if alt_files || slices.Contains(index_alt, sql_tables.SPR_TABLE_NAME) || slices.Contains(index_alt, index_alt_all) {
-			spr_opts.IndexAltFiles = true
+		geometry_opts := &index.GeometryTransformOptions{
+			Algorithm: index.SimplifyAlgorithm(opts.SimplifyAlgorithm),
+			Tolerance: opts.SimplifyTolerance,
+			Precision: opts.CoordinatePrecision,
 		}
 
-		st, err := tables.NewSPRTableWithDatabaseAndOptions(ctx, db, spr_opts)
+		fn, err := index.NewGeometryTransformFunc(geometry_opts)
 
 		if err != nil {
-			return fmt.Errorf("failed to create '%s' table because %s", sql_tables.SPR_TABLE_NAME, err)
+			return nil, fmt.Errorf("Failed to create geometry transform, %w", err)
 		}
 
-		to_index = append(to_index, st)
+		transformers = append(transformers, fn)
 	}
 
-	if names || all {
+	for _, transformer_uri := range opts.TransformerURIs {
 
-		nm, err := tables.NewNamesTableWithDatabase(ctx, db)
+		tr, err := index.NewRecordTransformer(ctx, transformer_uri)
 
 		if err != nil {
-			return fmt.Errorf("failed to create '%s' table because %s", sql_tables.NAMES_TABLE_NAME, err)
+			return nil, fmt.Errorf("Failed to create transformer (%s), %w", transformer_uri, err)
 		}
 
-		to_index = append(to_index, nm)
+		transformers = append(transformers, tr)
 	}
 
-	if ancestors || all {
+	var transformer index.RecordTransformer
+	var originals *index.OriginalRecords
+
+	if len(transformers) > 0 {
+
+		transformer = index.NewChainedRecordTransformer(transformers...)
 
-		an, err := tables.NewAncestorsTableWithDatabase(ctx, db)
+		// The rtree table indexes the bounding boxes of the original, rather than transformed, geometries
+
+		originals = index.NewOriginalRecords()
+
+		record_opts.Transformer = transformer
+		record_opts.OriginalRecords = originals
+
+		for i, t := range to_index {
+
+			if t.Name() == sql_tables.RTREE_TABLE_NAME {
+				to_index[i] = originals.Table(t)
+			}
+		}
+	}
+
+	// Count the records indexed by each table during this run, as distinct from the number of rows in each table
+
+	record_counts := index.NewRecordCounts()
+
+	for i, t := range to_index {
+		to_index[i] = record_counts.Table(t)
+	}
+
+	record_func := index.SQLiteFeaturesLoadRecordFunc(record_opts)
+
+	idx_opts := &sql_index.SQLiteIndexerOptions{
+		DB:             db,
+		Tables:         to_index,
+		LoadRecordFunc: record_func,
+	}
+
+	var relations_indexer *index.RelationsIndexer
+	var unresolved *index.UnresolvedRelations
+
+	if opts.IndexRelations {
+
+		if len(opts.RelationsReaderURIs) == 0 {
+			return nil, fmt.Errorf("Missing relations reader URI")
+		}
+
+		readers := make([]reader.Reader, len(opts.RelationsReaderURIs))
+
+		for i, reader_uri := range opts.RelationsReaderURIs {
+
+			r, err := newRelationsReader(ctx, reader_uri, opts.RelationsCacheDir, time.Duration(opts.RelationsCacheMaxAge)*time.Second)
+
+			if err != nil {
+				return nil, fmt.Errorf("Failed to load reader (%s), %v", reader_uri, err)
+			}
+
+			readers[i] = r
+		}
+
+		relations_opts := &index.SQLiteFeaturesIndexRelationsFuncOptions{
+			Readers:    readers,
+			Properties: opts.RelationsProperties,
+			MaxDepth:   opts.RelationsMaxDepth,
+			Workers:    opts.RelationsWorkers,
+			BatchSize:  opts.RelationsBatchSize,
+		}
+
+		if transformer != nil {
+			relations_opts.Transformer = transformer
+			relations_opts.OriginalRecords = originals
+		}
+
+		// Alt files for relations are only indexed if one or more tables is indexing alt files.
+		// Each table still decides for itself whether or not to index a given alt file.
+
+		if alt_files || len(index_alt) > 0 {
+			relations_opts.IndexAltFiles = true
+			relations_opts.AltLabels = opts.RelationsAltLabels
+		}
+
+		if opts.Sync {
+			relations_opts.SeenIds = seen
+		}
+
+		relations_opts.Unresolved = index.NewUnresolvedRelations()
+
+		ri, err := index.NewRelationsIndexer(relations_opts)
 
 		if err != nil {
-			return fmt.Errorf("failed to create '%s' table because %s", sql_tables.ANCESTORS_TABLE_NAME, err)
+			return nil, fmt.Errorf("Failed to create relations indexer, %w", err)
+		}
+
+		relations_indexer = ri
+		unresolved = relations_opts.Unresolved
+
+		// Records skipped because they are unchanged are never passed to the PostIndexFunc callback so their
+		// relations are collected separately, otherwise sync would delete them.
+
+		if opts.Sync {
+			record_opts.Relations = relations_indexer
 		}
+		idx_opts.PostIndexFunc = relations_indexer.PostIndexFunc()
+	}
 
-		to_index = append(to_index, an)
+	if originals != nil {
+		idx_opts.PostIndexFunc = originals.PostIndexFunc(idx_opts.PostIndexFunc)
 	}
 
-	if concordances || all {
+	var batcher *index.RecordBatcher
+
+	if opts.BatchSize > 0 {
+
+		batcher_opts := &index.RecordBatcherOptions{
+			Size:     opts.BatchSize,
+			Interval: time.Duration(opts.BatchInterval) * time.Millisecond,
+		}
 
-		cn, err := tables.NewConcordancesTableWithDatabase(ctx, db)
+		b, err := index.NewRecordBatcher(ctx, db.(*index.BatchDatabase), batcher_opts)
 
 		if err != nil {
-			return fmt.Errorf("failed to create '%s' table because %s", sql_tables.CONCORDANCES_TABLE_NAME, err)
+			return nil, fmt.Errorf("Failed to create record batcher, %w", err)
 		}
 
-		to_index = append(to_index, cn)
+		// The final batch is committed, by the Close method, once all the records have been
+		// indexed. If anything fails before then it is rolled back.
+
+		defer b.Rollback(ctx)
+
+		// The batcher's tables are wrapped before (inside) those for recording index errors so that
+		// the writes for a record which fails are rolled back before the error is recorded.
+
+		batcher = b
+		idx_opts.Tables = batcher.Tables(idx_opts.Tables)
 	}
 
-	// see the way we don't check all here - that's so people who don't have
-	// spatialite installed can still use all (20180122/thisisaaronland)
+	var index_errors *index.IndexErrors
 
-	if geometries {
+	if opts.ContinueOnError {
 
-		geometries_opts, err := tables.DefaultGeometriesTableOptions()
+		e, err := index.NewIndexErrors(ctx, db)
 
 		if err != nil {
-			return fmt.Errorf("failed to create '%s' table options because %v", sql_tables.GEOMETRIES_TABLE_NAME, err)
+			return nil, fmt.Errorf("Failed to create index errors, %w", err)
 		}
 
-		// alt_files is deprecated (20240229/straup)
+		index_errors = e
+
+		idx_opts.LoadRecordFunc = index_errors.LoadRecordFunc(idx_opts.LoadRecordFunc)
+		idx_opts.Tables = index_errors.Tables(idx_opts.Tables)
+		idx_opts.PostIndexFunc = index_errors.PostIndexFunc(idx_opts.PostIndexFunc)
+	}
 
-		if alt_files || slices.Contains(index_alt, sql_tables.CONCORDANCES_TABLE_NAME) || slices.Contains(index_alt, index_alt_all) {
-			geometries_opts.IndexAltFiles = true
+	if batcher != nil {
+		idx_opts.PostIndexFunc = batcher.PostIndexFunc(idx_opts.PostIndexFunc)
+	}
+
+	idx, err := sql_index.NewSQLiteIndexer(idx_opts)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to create sqlite indexer because %v", err)
+	}
+
+	idx.Timings = opts.Timings
+	idx.Logger = logger
+
+	iterator_uri, err := iteratorURIWithProcesses(opts.IteratorURI, opts.Processes)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to derive iterator URI, %w", err)
+	}
+
+	if opts.GitDiffFrom != "" {
+
+		git_diff_to := opts.GitDiffTo
+
+		if git_diff_to == "" {
+			git_diff_to = "HEAD"
 		}
 
-		gm, err := tables.NewGeometriesTableWithDatabaseAndOptions(ctx, db, geometries_opts)
+		uri, err := gitDiffIteratorURI(iterator_uri, opts.GitDiffFrom, git_diff_to)
 
 		if err != nil {
-			return fmt.Errorf("failed to create '%s' table because %v", sql_tables.CONCORDANCES_TABLE_NAME, err)
+			return nil, fmt.Errorf("Failed to derive git diff iterator URI, %w", err)
 		}
 
-		to_index = append(to_index, gm)
+		iterator_uri = uri
+
+		// Remove deleted records first so that records which have been moved (deleted and re-added
+		// with the same ID) are not removed after they have been indexed.
+
+		err = removeGitDiffRecords(ctx, db, to_index, opts.URIs, opts.GitDiffFrom, git_diff_to, logger)
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to remove deleted records, %w", err)
+		}
 	}
 
-	// see the way we don't check all here either - that's because this table can be
-	// brutally slow to index and should probably really just be a separate database
-	// anyway... (20180214/thisisaaronland)
+	// Resolve the commits for the sources being indexed immediately before they are iterated over,
+	// unless they have already been resolved for all the shard databases being indexed.
 
-	if search {
+	commits := opts.commits
 
-		// ALT FILES...
+	if commits == nil {
+		commits = sourceCommits(ctx, iterator_uri, opts.URIs)
+	}
 
-		st, err := tables.NewSearchTableWithDatabase(ctx, db)
+	if opts.records != nil {
+		err = indexShardRecords(ctx, idx, opts.records, opts.Processes)
+	} else {
+		err = idx.IndexURIs(ctx, iterator_uri, opts.URIs...)
+	}
+
+	if err == nil {
+		err = indexPendingAlts(ctx, idx, pending_alts)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to index paths in %s mode because: %s", iterator_uri, err)
+	}
+
+	if batcher != nil {
+
+		err = batcher.Close(ctx)
 
 		if err != nil {
-			return fmt.Errorf("failed to create 'search' table because %v", err)
+			return nil, fmt.Errorf("Failed to commit final batch, %w", err)
+		}
+	}
+
+	if relations_indexer != nil {
+
+		err = relations_indexer.IndexRelations(ctx, db, to_index)
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to index relations, %w", err)
+		}
+
+		for i, stats := range relations_indexer.ReaderStats() {
+			logger.Printf("Relations reader %s: %d hits, %d misses", opts.RelationsReaderURIs[i], stats.Hits, stats.Misses)
 		}
 
-		to_index = append(to_index, st)
+		results.UnresolvedRelations = unresolved.Relations()
+
+		if len(results.UnresolvedRelations) > 0 {
+			logger.Printf("Failed to resolve %d relations", len(results.UnresolvedRelations))
+		}
+
+		if opts.RelationsReport != "" {
+
+			err = writeRelationsReport(opts.RelationsReport, results.UnresolvedRelations)
+
+			if err != nil {
+				return nil, fmt.Errorf("Failed to write relations report, %w", err)
+			}
+		}
 	}
 
-	if len(to_index) == 0 {
-		return fmt.Errorf("You forgot to specify which (any) tables to index")
+	if opts.Validate {
+
+		results.ValidationViolations = validation_summary.Violations()
+
+		rules := make([]string, 0, len(results.ValidationViolations))
+
+		for rule, _ := range results.ValidationViolations {
+			rules = append(rules, rule)
+		}
+
+		slices.Sort(rules)
+
+		logger.Printf("Validation violations: %d rules violated", len(rules))
+
+		for _, rule := range rules {
+			logger.Printf("Validation rule %s: %d violations", rule, results.ValidationViolations[rule])
+		}
 	}
 
-	record_opts := &index.SQLiteFeaturesLoadRecordFuncOptions{
-		StrictAltFiles: strict_alt_files,
+	if atomic.LoadInt64(&filtered) > 0 {
+		logger.Printf("Excluded %d records by filter", atomic.LoadInt64(&filtered))
 	}
 
-	record_func := index.SQLiteFeaturesLoadRecordFunc(record_opts)
+	if opts.Incremental {
+		logger.Printf("Skipped %d unchanged records", atomic.LoadInt64(&skipped))
+	}
 
-	idx_opts := &sql_index.SQLiteIndexerOptions{
-		DB:             db,
-		Tables:         to_index,
-		LoadRecordFunc: record_func,
+	if index_errors != nil {
+		results.IndexErrors = index_errors.Count()
 	}
 
-	if index_relations {
+	if opts.Sync {
 
-		r, err := reader.NewReader(ctx, relations_uri)
+		switch {
+		case results.IndexErrors > 0 && !opts.SyncForce:
+			logger.Printf("Skipping sync because %d records failed to be loaded or indexed", results.IndexErrors)
+		default:
 
-		if err != nil {
-			return fmt.Errorf("Failed to load reader (%s), %v", relations_uri, err)
+			err = syncDatabase(ctx, db, to_index, seen, opts.SyncDryRun, opts.SyncForce, logger)
+
+			if err != nil {
+				return nil, fmt.Errorf("Failed to sync database, %w", err)
+			}
 		}
+	}
+
+	counts, err := countTableRecords(ctx, db, to_index)
 
-		belongsto_func := index.SQLiteFeaturesIndexRelationsFunc(r)
-		idx_opts.PostIndexFunc = belongsto_func
+	if err != nil {
+		return nil, fmt.Errorf("Failed to count records, %w", err)
 	}
 
-	idx, err := sql_index.NewSQLiteIndexer(idx_opts)
+	meta := &index.IndexMeta{
+		Started:        started,
+		Finished:       time.Now(),
+		IteratorURI:    opts.IteratorURI,
+		URIs:           opts.URIs,
+		Commits:        commits,
+		Flags:          opts.Flags,
+		Tables:         table_names,
+		IndexAlt:       alt_tables,
+		StrictAltFiles: opts.StrictAltFiles,
+		IndexRelations: opts.IndexRelations,
+		Counts:         counts,
+		Indexed:        record_counts.Counts(),
+		IndexErrors:    results.IndexErrors,
+		Modules:        index.ModuleVersions(),
+		Shard:          opts.shard,
+	}
+
+	err = index.WriteIndexMeta(ctx, db, meta)
 
 	if err != nil {
-		return fmt.Errorf("failed to create sqlite indexer because %v", err)
+		return nil, fmt.Errorf("Failed to write index meta, %w", err)
 	}
 
-	idx.Timings = timings
-	idx.Logger = logger
+	if index_errors != nil {
+
+		if results.IndexErrors > 0 {
+			logger.Printf("Failed to index %d records, see the %s table for details", results.IndexErrors, index.INDEX_ERRORS_TABLE_NAME)
+		}
+
+		if results.IndexErrors > opts.ErrorThreshold {
+			return results, fmt.Errorf("Failed to index %d records, which exceeds the error threshold of %d", results.IndexErrors, opts.ErrorThreshold)
+		}
+	}
 
-	uris := fs.Args()
+	return results, nil
+}
+
+// iteratorURIWithProcesses returns a copy of 'iterator_uri' whose "_max_procs" parameter, which limits the number of
+// sources the iterator crawls concurrently, is set to 'procs'. If 'procs' is zero, or 'iterator_uri' already has a
+// "_max_procs" parameter, then 'iterator_uri' is returned unchanged.
+func iteratorURIWithProcesses(iterator_uri string, procs int) (string, error) {
+
+	if procs <= 0 {
+		return iterator_uri, nil
+	}
 
-	err = idx.IndexURIs(ctx, iterator_uri, uris...)
+	u, err := url.Parse(iterator_uri)
 
 	if err != nil {
-		return fmt.Errorf("Failed to index paths in %s mode because: %s", iterator_uri, err)
+		return "", fmt.Errorf("Failed to parse iterator URI, %w", err)
 	}
 
-	return nil
+	q := u.Query()
+
+	if q.Has("_max_procs") {
+		return iterator_uri, nil
+	}
+
+	q.Set("_max_procs", strconv.Itoa(procs))
+	u.RawQuery = q.Encode()
+
+	return u.String(), nil
 }
@@ -0,0 +1,2207 @@
+package index
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aaronland/go-sqlite/v2"
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/whosonfirst/go-reader"
+	wof_properties "github.com/whosonfirst/go-whosonfirst-feature/properties"
+	_ "github.com/whosonfirst/go-whosonfirst-iterate-git/v2"
+	"github.com/whosonfirst/go-whosonfirst-sqlite-features-index/v2"
+	"github.com/whosonfirst/go-whosonfirst-uri"
+)
+
+func TestRunWithOptions(t *testing.T) {
+
+	ctx := context.Background()
+
+	path_fixtures, err := filepath.Abs("../../fixtures")
+
+	if err != nil {
+		t.Fatalf("Failed to determine path for fixtures, %v", err)
+	}
+
+	path_data := filepath.Join(path_fixtures, "data")
+
+	tmp_dir := t.TempDir()
+
+	wg := new(sync.WaitGroup)
+	err_ch := make(chan error, 2)
+
+	db_uris := []string{
+		fmt.Sprintf("modernc://%s", filepath.Join(tmp_dir, "a.db")),
+		fmt.Sprintf("modernc://%s", filepath.Join(tmp_dir, "b.db")),
+	}
+
+	for i, db_uri := range db_uris {
+
+		opts := &RunOptions{
+			IteratorURI:     "directory://",
+			URIs:            []string{path_data},
+			DatabaseURI:     db_uri,
+			GeoJSON:         true,
+			SPR:             i == 1,
+			LiveHardDieFast: true,
+			StrictAltFiles:  true,
+			Optimize:        true,
+		}
+
+		wg.Add(1)
+
+		go func(opts *RunOptions) {
+
+			defer wg.Done()
+
+			_, err := RunWithOptions(ctx, opts, log.Default())
+
+			if err != nil {
+				err_ch <- fmt.Errorf("Failed to index %s, %w", opts.DatabaseURI, err)
+			}
+		}(opts)
+	}
+
+	wg.Wait()
+	close(err_ch)
+
+	for err := range err_ch {
+		t.Fatal(err)
+	}
+
+	for _, db_uri := range db_uris {
+
+		db, err := sqlite.NewDatabase(ctx, db_uri)
+
+		if err != nil {
+			t.Fatalf("Failed to open %s, %v", db_uri, err)
+		}
+
+		defer db.Close(ctx)
+
+		conn, err := db.Conn(ctx)
+
+		if err != nil {
+			t.Fatalf("Failed to connect to %s, %v", db_uri, err)
+		}
+
+		var count int
+
+		err = conn.QueryRow("SELECT COUNT(id) FROM geojson").Scan(&count)
+
+		if err != nil {
+			t.Fatalf("Failed to count geojson records in %s, %v", db_uri, err)
+		}
+
+		if count != 1 {
+			t.Fatalf("Expected 1 geojson records in %s, got %d", db_uri, count)
+		}
+	}
+}
+
+func TestRunWithOptionsSync(t *testing.T) {
+
+	ctx := context.Background()
+
+	path_fixtures, err := filepath.Abs("../../fixtures")
+
+	if err != nil {
+		t.Fatalf("Failed to determine path for fixtures, %v", err)
+	}
+
+	path_data := filepath.Join(path_fixtures, "data")
+
+	db_uri := fmt.Sprintf("modernc://%s", filepath.Join(t.TempDir(), "sync.db"))
+
+	opts := &RunOptions{
+		IteratorURI: "directory://",
+		URIs:        []string{path_data},
+		DatabaseURI: db_uri,
+		GeoJSON:     true,
+		SPR:         true,
+	}
+
+	_, err = RunWithOptions(ctx, opts, log.Default())
+
+	if err != nil {
+		t.Fatalf("Failed to index %s, %v", db_uri, err)
+	}
+
+	db, err := sqlite.NewDatabase(ctx, db_uri)
+
+	if err != nil {
+		t.Fatalf("Failed to open %s, %v", db_uri, err)
+	}
+
+	conn, err := db.Conn(ctx)
+
+	if err != nil {
+		t.Fatalf("Failed to connect to %s, %v", db_uri, err)
+	}
+
+	_, err = conn.Exec("INSERT INTO geojson (id, body, source, is_alt, alt_label, lastmodified) VALUES (999, '{}', 'test', 0, '', 0)")
+
+	if err != nil {
+		t.Fatalf("Failed to insert stale record, %v", err)
+	}
+
+	db.Close(ctx)
+
+	count_stale := func(expected int) {
+
+		db, err := sqlite.NewDatabase(ctx, db_uri)
+
+		if err != nil {
+			t.Fatalf("Failed to open %s, %v", db_uri, err)
+		}
+
+		defer db.Close(ctx)
+
+		conn, err := db.Conn(ctx)
+
+		if err != nil {
+			t.Fatalf("Failed to connect to %s, %v", db_uri, err)
+		}
+
+		var count int
+
+		err = conn.QueryRow("SELECT COUNT(id) FROM geojson WHERE id = 999").Scan(&count)
+
+		if err != nil {
+			t.Fatalf("Failed to count stale records, %v", err)
+		}
+
+		if count != expected {
+			t.Fatalf("Expected %d stale records, got %d", expected, count)
+		}
+	}
+
+	opts.Sync = true
+	opts.SyncDryRun = true
+
+	_, err = RunWithOptions(ctx, opts, log.Default())
+
+	if err != nil {
+		t.Fatalf("Failed to sync %s (dry run), %v", db_uri, err)
+	}
+
+	count_stale(1)
+
+	opts.SyncDryRun = false
+
+	_, err = RunWithOptions(ctx, opts, log.Default())
+
+	if err != nil {
+		t.Fatalf("Failed to sync %s, %v", db_uri, err)
+	}
+
+	count_stale(0)
+
+	count_records := func() int {
+
+		db, err := sqlite.NewDatabase(ctx, db_uri)
+
+		if err != nil {
+			t.Fatalf("Failed to open %s, %v", db_uri, err)
+		}
+
+		defer db.Close(ctx)
+
+		conn, err := db.Conn(ctx)
+
+		if err != nil {
+			t.Fatalf("Failed to connect to %s, %v", db_uri, err)
+		}
+
+		var count int
+
+		err = conn.QueryRow("SELECT COUNT(id) FROM geojson").Scan(&count)
+
+		if err != nil {
+			t.Fatalf("Failed to count records, %v", err)
+		}
+
+		return count
+	}
+
+	expected := count_records()
+
+	if expected == 0 {
+		t.Fatalf("Expected records in %s", db_uri)
+	}
+
+	// Records excluded by a filter are still considered to have been seen
+
+	opts.IncludePlacetypes = []string{"planet"}
+
+	_, err = RunWithOptions(ctx, opts, log.Default())
+
+	if err != nil {
+		t.Fatalf("Failed to sync %s with filters, %v", db_uri, err)
+	}
+
+	if count_records() != expected {
+		t.Fatalf("Expected %d records after syncing with filters, got %d", expected, count_records())
+	}
+
+	opts.IncludePlacetypes = nil
+
+	// Syncing from an empty source is refused unless forced
+
+	opts.URIs = []string{t.TempDir()}
+
+	_, err = RunWithOptions(ctx, opts, log.Default())
+
+	if err == nil {
+		t.Fatalf("Expected sync from an empty source to fail")
+	}
+
+	if count_records() != expected {
+		t.Fatalf("Expected %d records after refusing to sync, got %d", expected, count_records())
+	}
+
+	opts.SyncForce = true
+
+	_, err = RunWithOptions(ctx, opts, log.Default())
+
+	if err != nil {
+		t.Fatalf("Failed to force sync %s, %v", db_uri, err)
+	}
+
+	if count_records() != 0 {
+		t.Fatalf("Expected 0 records after forcing sync, got %d", count_records())
+	}
+}
+
+// writeTestRecord writes a minimal Who's On First record for 'id', which belongs to 'belongsto', to 'root' using its
+// standard relative path.
+func writeTestRecord(t *testing.T, root string, id int64, belongsto ...int64) {
+
+	if belongsto == nil {
+		belongsto = []int64{}
+	}
+
+	f := map[string]interface{}{
+		"type": "Feature",
+		"properties": map[string]interface{}{
+			"wof:id":           id,
+			"wof:name":         fmt.Sprintf("Test %d", id),
+			"wof:placetype":    "locality",
+			"wof:repo":         "whosonfirst-data-test",
+			"wof:parent_id":    -1,
+			"wof:belongsto":    belongsto,
+			"wof:lastmodified": 1700000000,
+		},
+		"geometry": map[string]interface{}{
+			"type":        "Point",
+			"coordinates": []float64{0, 0},
+		},
+	}
+
+	body, err := json.Marshal(f)
+
+	if err != nil {
+		t.Fatalf("Failed to marshal record %d, %v", id, err)
+	}
+
+	rel_path, err := uri.Id2RelPath(id)
+
+	if err != nil {
+		t.Fatalf("Failed to derive path for %d, %v", id, err)
+	}
+
+	path := filepath.Join(root, rel_path)
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+
+	if err != nil {
+		t.Fatalf("Failed to create %s, %v", filepath.Dir(path), err)
+	}
+
+	err = os.WriteFile(path, body, 0644)
+
+	if err != nil {
+		t.Fatalf("Failed to write %s, %v", path, err)
+	}
+}
+
+// tableIds returns the sorted list of IDs in the table 'name' of the database 'db_uri'.
+func tableIds(t *testing.T, db_uri string, name string) []int64 {
+
+	ctx := context.Background()
+
+	db, err := sqlite.NewDatabase(ctx, db_uri)
+
+	if err != nil {
+		t.Fatalf("Failed to open %s, %v", db_uri, err)
+	}
+
+	defer db.Close(ctx)
+
+	conn, err := db.Conn(ctx)
+
+	if err != nil {
+		t.Fatalf("Failed to connect to %s, %v", db_uri, err)
+	}
+
+	rows, err := conn.QueryContext(ctx, fmt.Sprintf("SELECT DISTINCT id FROM %s ORDER BY id", name))
+
+	if err != nil {
+		t.Fatalf("Failed to query %s table, %v", name, err)
+	}
+
+	defer rows.Close()
+
+	ids := make([]int64, 0)
+
+	for rows.Next() {
+
+		var id int64
+		err := rows.Scan(&id)
+
+		if err != nil {
+			t.Fatalf("Failed to scan ID, %v", err)
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids
+}
+
+func TestRunWithOptionsSyncIncrementalRelations(t *testing.T) {
+
+	ctx := context.Background()
+
+	tmp_dir := t.TempDir()
+
+	path_data := filepath.Join(tmp_dir, "data")
+	path_relations := filepath.Join(tmp_dir, "relations")
+
+	writeTestRecord(t, path_data, 1001, 2001)
+	writeTestRecord(t, path_relations, 2001)
+
+	db_uri := fmt.Sprintf("modernc://%s", filepath.Join(tmp_dir, "sync.db"))
+
+	opts := &RunOptions{
+		IteratorURI:         "directory://",
+		URIs:                []string{path_data},
+		DatabaseURI:         db_uri,
+		GeoJSON:             true,
+		IndexRelations:      true,
+		RelationsReaderURIs: []string{fmt.Sprintf("fs://%s", path_relations)},
+		RelationsMaxDepth:   1,
+		Sync:                true,
+	}
+
+	_, err := RunWithOptions(ctx, opts, log.Default())
+
+	if err != nil {
+		t.Fatalf("Failed to index %s, %v", db_uri, err)
+	}
+
+	expected := fmt.Sprintf("%v", []int64{1001, 2001})
+
+	ids := tableIds(t, db_uri, "geojson")
+
+	if fmt.Sprintf("%v", ids) != expected {
+		t.Fatalf("Expected %s after indexing, got %v", expected, ids)
+	}
+
+	// The relations of records which are skipped because they are unchanged are still considered to have been seen
+
+	opts.Incremental = true
+
+	_, err = RunWithOptions(ctx, opts, log.Default())
+
+	if err != nil {
+		t.Fatalf("Failed to sync %s incrementally, %v", db_uri, err)
+	}
+
+	ids = tableIds(t, db_uri, "geojson")
+
+	if fmt.Sprintf("%v", ids) != expected {
+		t.Fatalf("Expected %s after syncing incrementally, got %v", expected, ids)
+	}
+}
+
+func TestRunWithOptionsSyncRelations(t *testing.T) {
+
+	ctx := context.Background()
+
+	tmp_dir := t.TempDir()
+
+	path_data := filepath.Join(tmp_dir, "data")
+	path_relations := filepath.Join(tmp_dir, "relations")
+
+	writeTestRecord(t, path_data, 1001, 2001)
+	writeTestRecord(t, path_relations, 2001, 3001)
+	writeTestRecord(t, path_relations, 3001)
+
+	expected := fmt.Sprintf("%v", []int64{1001, 2001, 3001})
+
+	for _, table_name := range []string{"geojson", "spr"} {
+
+		db_uri := fmt.Sprintf("modernc://%s", filepath.Join(tmp_dir, fmt.Sprintf("%s.db", table_name)))
+
+		opts := &RunOptions{
+			IteratorURI:         "directory://",
+			URIs:                []string{path_data},
+			DatabaseURI:         db_uri,
+			GeoJSON:             table_name == "geojson",
+			SPR:                 table_name == "spr",
+			IndexRelations:      true,
+			RelationsReaderURIs: []string{fmt.Sprintf("fs://%s", path_relations)},
+			RelationsMaxDepth:   2,
+			Sync:                true,
+		}
+
+		// Ancestors indexed by a previous run are still considered to have been seen, whether their relations
+		// are derived from the 'geojson' table or read again
+
+		for i := 0; i < 2; i++ {
+
+			_, err := RunWithOptions(ctx, opts, log.Default())
+
+			if err != nil {
+				t.Fatalf("Failed to index %s (run %d), %v", db_uri, i, err)
+			}
+
+			ids := tableIds(t, db_uri, table_name)
+
+			if fmt.Sprintf("%v", ids) != expected {
+				t.Fatalf("Expected %s in %s table after run %d, got %v", expected, table_name, i, ids)
+			}
+		}
+	}
+}
+
+func TestRunWithOptionsFilterAltFiles(t *testing.T) {
+
+	ctx := context.Background()
+
+	body, err := os.ReadFile("../../fixtures/data/101/736/545/101736545.geojson")
+
+	if err != nil {
+		t.Fatalf("Failed to read fixture, %v", err)
+	}
+
+	var f map[string]interface{}
+
+	err = json.Unmarshal(body, &f)
+
+	if err != nil {
+		t.Fatalf("Failed to unmarshal fixture, %v", err)
+	}
+
+	f["properties"].(map[string]interface{})["src:alt_label"] = "quattroshapes"
+
+	alt_body, err := json.Marshal(f)
+
+	if err != nil {
+		t.Fatalf("Failed to marshal alt fixture, %v", err)
+	}
+
+	path_data := filepath.Join(t.TempDir(), "101", "736", "545")
+
+	err = os.MkdirAll(path_data, 0755)
+
+	if err != nil {
+		t.Fatalf("Failed to create %s, %v", path_data, err)
+	}
+
+	for fname, b := range map[string][]byte{"101736545.geojson": body, "101736545-alt-quattroshapes.geojson": alt_body} {
+
+		err = os.WriteFile(filepath.Join(path_data, fname), b, 0644)
+
+		if err != nil {
+			t.Fatalf("Failed to write %s, %v", fname, err)
+		}
+	}
+
+	// Alternate geometry files are included, or excluded, along with their principal record
+
+	tests := map[string]string{
+		"locality": "[101736545 101736545]",
+		"region":   "[]",
+	}
+
+	for placetype, expected := range tests {
+
+		db_uri := fmt.Sprintf("modernc://%s", filepath.Join(t.TempDir(), "filter.db"))
+
+		opts := &RunOptions{
+			IteratorURI:       "directory://",
+			URIs:              []string{path_data},
+			DatabaseURI:       db_uri,
+			GeoJSON:           true,
+			IndexAlt:          []string{"*"},
+			IncludePlacetypes: []string{placetype},
+		}
+
+		_, err := RunWithOptions(ctx, opts, log.Default())
+
+		if err != nil {
+			t.Fatalf("Failed to index %s, %v", db_uri, err)
+		}
+
+		db, err := sqlite.NewDatabase(ctx, db_uri)
+
+		if err != nil {
+			t.Fatalf("Failed to open %s, %v", db_uri, err)
+		}
+
+		conn, err := db.Conn(ctx)
+
+		if err != nil {
+			t.Fatalf("Failed to connect to %s, %v", db_uri, err)
+		}
+
+		rows, err := conn.QueryContext(ctx, "SELECT id FROM geojson ORDER BY id")
+
+		if err != nil {
+			t.Fatalf("Failed to query geojson table, %v", err)
+		}
+
+		ids := make([]int64, 0)
+
+		for rows.Next() {
+
+			var id int64
+			err := rows.Scan(&id)
+
+			if err != nil {
+				t.Fatalf("Failed to scan ID, %v", err)
+			}
+
+			ids = append(ids, id)
+		}
+
+		rows.Close()
+		db.Close(ctx)
+
+		if fmt.Sprintf("%v", ids) != expected {
+			t.Fatalf("Expected %s including %s records, got %v", expected, placetype, ids)
+		}
+	}
+}
+
+func TestRunWithOptionsRelationsReport(t *testing.T) {
+
+	ctx := context.Background()
+
+	path_fixtures, err := filepath.Abs("../../fixtures")
+
+	if err != nil {
+		t.Fatalf("Failed to determine path for fixtures, %v", err)
+	}
+
+	path_data := filepath.Join(path_fixtures, "data")
+
+	tmp_dir := t.TempDir()
+	report_path := filepath.Join(tmp_dir, "relations.csv")
+
+	opts := &RunOptions{
+		IteratorURI:         "directory://",
+		URIs:                []string{path_data},
+		DatabaseURI:         fmt.Sprintf("modernc://%s", filepath.Join(tmp_dir, "relations.db")),
+		GeoJSON:             true,
+		IndexRelations:      true,
+		RelationsReaderURIs: []string{fmt.Sprintf("fs://%s", filepath.Join(tmp_dir, "empty"))},
+		RelationsMaxDepth:   1,
+		RelationsReport:     report_path,
+	}
+
+	err = os.Mkdir(filepath.Join(tmp_dir, "empty"), 0755)
+
+	if err != nil {
+		t.Fatalf("Failed to create empty directory, %v", err)
+	}
+
+	results, err := RunWithOptions(ctx, opts, log.Default())
+
+	if err != nil {
+		t.Fatalf("Failed to index relations, %v", err)
+	}
+
+	if len(results.UnresolvedRelations) != 4 {
+		t.Fatalf("Expected 4 unresolved relations, got %d", len(results.UnresolvedRelations))
+	}
+
+	fh, err := os.Open(report_path)
+
+	if err != nil {
+		t.Fatalf("Failed to open relations report, %v", err)
+	}
+
+	defer fh.Close()
+
+	rows, err := csv.NewReader(fh).ReadAll()
+
+	if err != nil {
+		t.Fatalf("Failed to read relations report, %v", err)
+	}
+
+	if len(rows) != 5 {
+		t.Fatalf("Expected 5 rows (including header) in relations report, got %d", len(rows))
+	}
+
+	if rows[1][1] != "101736545" {
+		t.Fatalf("Unexpected referrers in relations report: %s", rows[1][1])
+	}
+}
+
+func TestRunWithOptionsContinueOnError(t *testing.T) {
+
+	ctx := context.Background()
+
+	path_data := t.TempDir()
+
+	err := os.WriteFile(filepath.Join(path_data, "broken.geojson"), []byte(`{"type":"Feature"`), 0644)
+
+	if err != nil {
+		t.Fatalf("Failed to write broken fixture, %v", err)
+	}
+
+	for threshold, expect_err := range map[int64]bool{0: true, 1: false} {
+
+		opts := &RunOptions{
+			IteratorURI:     "directory://",
+			URIs:            []string{path_data},
+			DatabaseURI:     fmt.Sprintf("modernc://%s", filepath.Join(t.TempDir(), "errors.db")),
+			GeoJSON:         true,
+			ContinueOnError: true,
+			ErrorThreshold:  threshold,
+		}
+
+		results, err := RunWithOptions(ctx, opts, log.Default())
+
+		if expect_err && err == nil {
+			t.Fatalf("Expected error threshold of %d to be exceeded", threshold)
+		}
+
+		if !expect_err && err != nil {
+			t.Fatalf("Unexpected error with error threshold of %d, %v", threshold, err)
+		}
+
+		if results.IndexErrors != 1 {
+			t.Fatalf("Expected 1 index error, got %d", results.IndexErrors)
+		}
+	}
+}
+
+func TestRunWithOptionsGitDiff(t *testing.T) {
+
+	ctx := context.Background()
+
+	path_fixture, err := filepath.Abs("../../fixtures/data/101/736/545/101736545.geojson")
+
+	if err != nil {
+		t.Fatalf("Failed to determine path for fixture, %v", err)
+	}
+
+	body, err := os.ReadFile(path_fixture)
+
+	if err != nil {
+		t.Fatalf("Failed to read fixture, %v", err)
+	}
+
+	repo_path := filepath.Join(t.TempDir(), "repo")
+
+	repo, err := gogit.PlainInit(repo_path, false)
+
+	if err != nil {
+		t.Fatalf("Failed to create repository, %v", err)
+	}
+
+	wt, err := repo.Worktree()
+
+	if err != nil {
+		t.Fatalf("Failed to derive worktree, %v", err)
+	}
+
+	commit := func(msg string) plumbing.Hash {
+
+		_, err := wt.Add("data")
+
+		if err != nil {
+			t.Fatalf("Failed to add files, %v", err)
+		}
+
+		commit_opts := &gogit.CommitOptions{
+			All: true,
+			Author: &object.Signature{
+				Name:  "test",
+				Email: "test@example.com",
+				When:  time.Now(),
+			},
+		}
+
+		h, err := wt.Commit(msg, commit_opts)
+
+		if err != nil {
+			t.Fatalf("Failed to commit, %v", err)
+		}
+
+		return h
+	}
+
+	write_record := func(id int64, lastmod int64) string {
+
+		rel_path, err := uri.Id2RelPath(id)
+
+		if err != nil {
+			t.Fatalf("Failed to derive path for %d, %v", id, err)
+		}
+
+		path := filepath.Join(repo_path, "data", rel_path)
+
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+
+		if err != nil {
+			t.Fatalf("Failed to create %s, %v", filepath.Dir(path), err)
+		}
+
+		var f map[string]interface{}
+
+		err = json.Unmarshal(body, &f)
+
+		if err != nil {
+			t.Fatalf("Failed to unmarshal fixture, %v", err)
+		}
+
+		props := f["properties"].(map[string]interface{})
+		props["wof:id"] = id
+		props["wof:lastmodified"] = lastmod
+
+		record, err := json.Marshal(f)
+
+		if err != nil {
+			t.Fatalf("Failed to marshal record, %v", err)
+		}
+
+		err = os.WriteFile(path, record, 0644)
+
+		if err != nil {
+			t.Fatalf("Failed to write %s, %v", path, err)
+		}
+
+		return path
+	}
+
+	write_record(101736545, 1)
+	path_removed := write_record(999, 1)
+
+	from := commit("first")
+
+	db_uri := fmt.Sprintf("modernc://%s", filepath.Join(t.TempDir(), "git.db"))
+
+	opts := &RunOptions{
+		IteratorURI: "repo://",
+		URIs:        []string{repo_path},
+		DatabaseURI: db_uri,
+		GeoJSON:     true,
+		SPR:         true,
+	}
+
+	_, err = RunWithOptions(ctx, opts, log.Default())
+
+	if err != nil {
+		t.Fatalf("Failed to index %s, %v", db_uri, err)
+	}
+
+	err = os.Remove(path_removed)
+
+	if err != nil {
+		t.Fatalf("Failed to remove %s, %v", path_removed, err)
+	}
+
+	write_record(101736545, 2)
+	write_record(1000, 2)
+
+	to := commit("second")
+
+	opts.GitDiffFrom = from.String()
+
+	_, err = RunWithOptions(ctx, opts, log.Default())
+
+	if err != nil {
+		t.Fatalf("Failed to index %s from git diff, %v", db_uri, err)
+	}
+
+	db, err := sqlite.NewDatabase(ctx, db_uri)
+
+	if err != nil {
+		t.Fatalf("Failed to open %s, %v", db_uri, err)
+	}
+
+	defer db.Close(ctx)
+
+	conn, err := db.Conn(ctx)
+
+	if err != nil {
+		t.Fatalf("Failed to connect to %s, %v", db_uri, err)
+	}
+
+	expected := map[int64]int64{
+		101736545: 2,
+		1000:      2,
+	}
+
+	for _, table := range []string{"geojson", "spr"} {
+
+		rows, err := conn.Query(fmt.Sprintf("SELECT id, lastmodified FROM %s", table))
+
+		if err != nil {
+			t.Fatalf("Failed to query %s table, %v", table, err)
+		}
+
+		count := 0
+
+		for rows.Next() {
+
+			var id int64
+			var lastmod int64
+
+			err := rows.Scan(&id, &lastmod)
+
+			if err != nil {
+				t.Fatalf("Failed to scan row, %v", err)
+			}
+
+			if expected[id] != lastmod {
+				t.Fatalf("Unexpected lastmodified for %d in %s table (%d)", id, table, lastmod)
+			}
+
+			count += 1
+		}
+
+		rows.Close()
+
+		if count != len(expected) {
+			t.Fatalf("Expected %d rows in %s table, got %d", len(expected), table, count)
+		}
+	}
+
+	meta, err := index.LatestIndexMeta(ctx, db)
+
+	if err != nil {
+		t.Fatalf("Failed to read index meta, %v", err)
+	}
+
+	if meta.Commits[repo_path] != to.String() {
+		t.Fatalf("Expected commit %s for %s, got %v", to, repo_path, meta.Commits)
+	}
+
+	if meta.Indexed["geojson"] != 2 || meta.Indexed["spr"] != 2 {
+		t.Fatalf("Unexpected indexed counts, %v", meta.Indexed)
+	}
+
+	// Remote repositories are resolved by listing their references rather than cloning them
+
+	commits := sourceCommits(ctx, "git://", []string{repo_path})
+
+	if commits[repo_path] != to.String() {
+		t.Fatalf("Expected commit %s for remote %s, got %v", to, repo_path, commits)
+	}
+
+	commits = sourceCommits(ctx, "git://?branch=missing", []string{repo_path})
+
+	if len(commits) != 0 {
+		t.Fatalf("Expected no commits for missing branch, got %v", commits)
+	}
+
+	// Commits are resolved once, when sharding records, and recorded for every shard database
+
+	shard_opts := &RunOptions{
+		IteratorURI: "git://",
+		URIs:        []string{repo_path},
+		DatabaseURI: fmt.Sprintf("modernc://%s", filepath.Join(t.TempDir(), "{shard}.db")),
+		GeoJSON:     true,
+		ShardBy:     SHARD_BY_PLACETYPE,
+	}
+
+	shard_results, err := RunWithOptions(ctx, shard_opts, log.Default())
+
+	if err != nil {
+		t.Fatalf("Failed to index %s from git, %v", repo_path, err)
+	}
+
+	if len(shard_results.Shards) == 0 {
+		t.Fatalf("Expected at least one shard database")
+	}
+
+	for value, shard_uri := range shard_results.Shards {
+
+		shard_db, err := sqlite.NewDatabase(ctx, shard_uri)
+
+		if err != nil {
+			t.Fatalf("Failed to open %s, %v", shard_uri, err)
+		}
+
+		shard_meta, err := index.LatestIndexMeta(ctx, shard_db)
+
+		shard_db.Close(ctx)
+
+		if err != nil {
+			t.Fatalf("Failed to read index meta for shard '%s', %v", value, err)
+		}
+
+		if shard_meta.Commits[repo_path] != to.String() {
+			t.Fatalf("Expected commit %s for %s in shard '%s', got %v", to, repo_path, value, shard_meta.Commits)
+		}
+	}
+}
+
+func TestRelationsCache(t *testing.T) {
+
+	ctx := context.Background()
+
+	body := []byte(`{"type":"Feature","properties":{"wof:id":1,"wof:lastmodified":1700000000},"geometry":{"type":"Point","coordinates":[0,0]}}`)
+	etag := `"v1"`
+	lastmod := "Tue, 14 Nov 2023 22:13:20 GMT"
+
+	statuses := make([]int, 0)
+	failing := false
+	mu := new(sync.Mutex)
+
+	handler := func(rsp http.ResponseWriter, req *http.Request) {
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		status := http.StatusOK
+
+		switch {
+		case failing:
+			status = http.StatusServiceUnavailable
+		case req.URL.Path != "/data/1.geojson":
+			status = http.StatusNotFound
+		case req.Header.Get("If-None-Match") == etag && req.Header.Get("If-Modified-Since") == lastmod:
+			status = http.StatusNotModified
+		}
+
+		statuses = append(statuses, status)
+
+		if status != http.StatusOK {
+			rsp.WriteHeader(status)
+			return
+		}
+
+		rsp.Header().Set("ETag", etag)
+		rsp.Header().Set("Last-Modified", lastmod)
+		rsp.Write(body)
+	}
+
+	s := httptest.NewServer(http.HandlerFunc(handler))
+
+	cache_dir := t.TempDir()
+
+	r, err := newRelationsReader(ctx, s.URL+"/data", cache_dir, 0)
+
+	if err != nil {
+		t.Fatalf("Failed to create relations reader, %v", err)
+	}
+
+	read := func(r reader.Reader) []byte {
+
+		fh, err := r.Read(ctx, "1.geojson")
+
+		if err != nil {
+			t.Fatalf("Failed to read record, %v", err)
+		}
+
+		defer fh.Close()
+
+		rsp_body, err := io.ReadAll(fh)
+
+		if err != nil {
+			t.Fatalf("Failed to read body, %v", err)
+		}
+
+		return rsp_body
+	}
+
+	check_statuses := func(expected ...int) {
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		if fmt.Sprintf("%v", statuses) != fmt.Sprintf("%v", expected) {
+			t.Fatalf("Expected response statuses %v, got %v", expected, statuses)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+
+		if string(read(r)) != string(body) {
+			t.Fatalf("Unexpected body for read %d", i)
+		}
+	}
+
+	_, err = r.Read(ctx, "2.geojson")
+
+	if err == nil {
+		t.Fatalf("Expected missing record to fail")
+	}
+
+	check_statuses(http.StatusOK, http.StatusNotModified, http.StatusNotFound)
+
+	// Cached records are used as-is, without a request, until they are older than the max age
+
+	fresh_r, err := newRelationsReader(ctx, s.URL+"/data", cache_dir, time.Hour)
+
+	if err != nil {
+		t.Fatalf("Failed to create relations reader, %v", err)
+	}
+
+	if string(read(fresh_r)) != string(body) {
+		t.Fatalf("Unexpected body for fresh read")
+	}
+
+	check_statuses(http.StatusOK, http.StatusNotModified, http.StatusNotFound)
+
+	// Cached records are still available when the endpoint returns a server error
+
+	mu.Lock()
+	failing = true
+	mu.Unlock()
+
+	if string(read(r)) != string(body) {
+		t.Fatalf("Unexpected body for read during server error")
+	}
+
+	check_statuses(http.StatusOK, http.StatusNotModified, http.StatusNotFound, http.StatusServiceUnavailable)
+
+	// Cached records are still available when the endpoint can not be reached
+
+	s.Close()
+
+	if string(read(r)) != string(body) {
+		t.Fatalf("Unexpected body for offline read")
+	}
+}
+
+// idsTable implements the `aaronland/go-sqlite.Table` interface for a table which stores the ID of each record.
+type idsTable struct {
+}
+
+func (t *idsTable) Name() string {
+	return "test_ids"
+}
+
+func (t *idsTable) Schema() string {
+	return "CREATE TABLE test_ids (id INTEGER PRIMARY KEY);"
+}
+
+func (t *idsTable) InitializeTable(ctx context.Context, db sqlite.Database) error {
+	return sqlite.CreateTableIfNecessary(ctx, db, t)
+}
+
+func (t *idsTable) IndexRecord(ctx context.Context, db sqlite.Database, i interface{}) error {
+
+	id, err := wof_properties.Id(i.([]byte))
+
+	if err != nil {
+		return err
+	}
+
+	conn, err := db.Conn(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.ExecContext(ctx, "INSERT OR REPLACE INTO test_ids (id) VALUES (?)", id)
+	return err
+}
+
+func TestRunWithOptionsTables(t *testing.T) {
+
+	ctx := context.Background()
+
+	err := index.RegisterTable(ctx, "test_ids", func(ctx context.Context, db sqlite.Database, opts *index.TableOptions) (sqlite.Table, error) {
+
+		t := &idsTable{}
+
+		err := t.InitializeTable(ctx, db)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return t, nil
+	})
+
+	if err != nil {
+		t.Fatalf("Failed to register table, %v", err)
+	}
+
+	path_data, err := filepath.Abs("../../fixtures/data")
+
+	if err != nil {
+		t.Fatalf("Failed to determine path for fixtures, %v", err)
+	}
+
+	db_uri := fmt.Sprintf("modernc://%s", filepath.Join(t.TempDir(), "tables.db"))
+
+	opts := &RunOptions{
+		IteratorURI: "directory://",
+		URIs:        []string{path_data},
+		DatabaseURI: db_uri,
+		Tables:      []string{"test_ids", "GeoJSON"},
+	}
+
+	_, err = RunWithOptions(ctx, opts, log.Default())
+
+	if err != nil {
+		t.Fatalf("Failed to index %s, %v", db_uri, err)
+	}
+
+	db, err := sqlite.NewDatabase(ctx, db_uri)
+
+	if err != nil {
+		t.Fatalf("Failed to open %s, %v", db_uri, err)
+	}
+
+	defer db.Close(ctx)
+
+	conn, err := db.Conn(ctx)
+
+	if err != nil {
+		t.Fatalf("Failed to connect to %s, %v", db_uri, err)
+	}
+
+	for _, table_name := range []string{"test_ids", "geojson"} {
+
+		var count int
+
+		err = conn.QueryRow(fmt.Sprintf("SELECT COUNT(id) FROM %s", table_name)).Scan(&count)
+
+		if err != nil {
+			t.Fatalf("Failed to count %s records, %v", table_name, err)
+		}
+
+		if count != 1 {
+			t.Fatalf("Expected 1 %s record, got %d", table_name, count)
+		}
+	}
+
+	opts.Tables = []string{"missing"}
+
+	_, err = RunWithOptions(ctx, opts, log.Default())
+
+	if err == nil {
+		t.Fatalf("Expected unregistered table to fail")
+	}
+}
+
+func TestDerivePragmas(t *testing.T) {
+
+	pragmas, err := derivePragmas(PRAGMA_PROFILE_SERVE, []string{"cache_size=-2000", "foreign_keys=ON"})
+
+	if err != nil {
+		t.Fatalf("Failed to derive pragmas, %v", err)
+	}
+
+	values := make(map[string]string)
+
+	for _, p := range pragmas {
+		values[p.Key] = p.Value
+	}
+
+	if values["journal_mode"] != "WAL" {
+		t.Fatalf("Unexpected journal_mode '%s'", values["journal_mode"])
+	}
+
+	if values["cache_size"] != "-2000" {
+		t.Fatalf("Expected cache_size to be overridden, got '%s'", values["cache_size"])
+	}
+
+	if pragmas[len(pragmas)-1].Key != "foreign_keys" {
+		t.Fatalf("Expected foreign_keys pragma to be appended")
+	}
+
+	if pragmas[0].Key != "page_size" {
+		t.Fatalf("Expected page_size to be the first pragma, got '%s'", pragmas[0].Key)
+	}
+
+	for _, bad := range []string{"cache_size", "cache_size=1; DROP TABLE geojson", "cache size=1"} {
+
+		_, err := derivePragmas("", []string{bad})
+
+		if err == nil {
+			t.Fatalf("Expected '%s' to be an invalid pragma", bad)
+		}
+	}
+
+	_, err = derivePragmas("fast-and-loose", nil)
+
+	if err == nil {
+		t.Fatalf("Expected invalid pragma profile to fail")
+	}
+
+	// The bulk-build profile must be the same as sqlite.LiveHardDieFast
+
+	bulk, err := PragmaProfile(PRAGMA_PROFILE_BULK_BUILD)
+
+	if err != nil {
+		t.Fatalf("Failed to derive bulk-build pragmas, %v", err)
+	}
+
+	live_hard := []string{
+		"PRAGMA journal_mode=OFF",
+		"PRAGMA synchronous=OFF",
+		"PRAGMA locking_mode=EXCLUSIVE",
+		"PRAGMA page_size=4096",
+		"PRAGMA cache_size=1000000",
+	}
+
+	bulk_strings := make([]string, len(bulk))
+
+	for i, p := range bulk {
+		bulk_strings[i] = p.String()
+	}
+
+	if !slices.Equal(bulk_strings, live_hard) {
+		t.Fatalf("Unexpected bulk-build pragmas, %v", bulk_strings)
+	}
+}
+
+func TestDatabaseURIWithPragmas(t *testing.T) {
+
+	ctx := context.Background()
+
+	pragmas, err := derivePragmas(PRAGMA_PROFILE_SAFE_UPDATE, []string{"busy_timeout=1234"})
+
+	if err != nil {
+		t.Fatalf("Failed to derive pragmas, %v", err)
+	}
+
+	db_uri := fmt.Sprintf("modernc://%s", filepath.Join(t.TempDir(), "pragma.db"))
+
+	if !supportsDatabaseURIPragmas(db_uri) {
+		t.Fatalf("Expected %s to support pragmas", db_uri)
+	}
+
+	if supportsDatabaseURIPragmas("mattn:///tmp/pragma.db") {
+		t.Fatalf("Expected mattn:// URIs not to support pragmas")
+	}
+
+	pragma_uri, err := databaseURIWithPragmas(db_uri, pragmas)
+
+	if err != nil {
+		t.Fatalf("Failed to add pragmas to %s, %v", db_uri, err)
+	}
+
+	db, err := sqlite.NewDatabase(ctx, pragma_uri)
+
+	if err != nil {
+		t.Fatalf("Failed to open %s, %v", pragma_uri, err)
+	}
+
+	defer db.Close(ctx)
+
+	pool, err := db.Conn(ctx)
+
+	if err != nil {
+		t.Fatalf("Failed to connect to %s, %v", pragma_uri, err)
+	}
+
+	// Hold more than one connection open at the same time to ensure that the pragmas are
+	// applied to every connection in the pool and not just the first one.
+
+	for i := 0; i < 3; i++ {
+
+		conn, err := pool.Conn(ctx)
+
+		if err != nil {
+			t.Fatalf("Failed to establish connection %d, %v", i, err)
+		}
+
+		defer conn.Close()
+
+		var busy_timeout int
+		var synchronous int
+
+		err = conn.QueryRowContext(ctx, "PRAGMA busy_timeout").Scan(&busy_timeout)
+
+		if err != nil {
+			t.Fatalf("Failed to determine busy_timeout for connection %d, %v", i, err)
+		}
+
+		if busy_timeout != 1234 {
+			t.Fatalf("Expected busy_timeout for connection %d to be 1234, got %d", i, busy_timeout)
+		}
+
+		err = conn.QueryRowContext(ctx, "PRAGMA synchronous").Scan(&synchronous)
+
+		if err != nil {
+			t.Fatalf("Failed to determine synchronous for connection %d, %v", i, err)
+		}
+
+		// NORMAL
+
+		if synchronous != 1 {
+			t.Fatalf("Expected synchronous for connection %d to be 1, got %d", i, synchronous)
+		}
+	}
+}
+
+func TestRunWithOptionsPragmaProfile(t *testing.T) {
+
+	ctx := context.Background()
+
+	path_fixtures, err := filepath.Abs("../../fixtures")
+
+	if err != nil {
+		t.Fatalf("Failed to determine path for fixtures, %v", err)
+	}
+
+	path_data := filepath.Join(path_fixtures, "data")
+
+	db_uri := fmt.Sprintf("modernc://%s", filepath.Join(t.TempDir(), "pragma.db"))
+
+	opts := &RunOptions{
+		IteratorURI:     "directory://",
+		URIs:            []string{path_data},
+		DatabaseURI:     db_uri,
+		GeoJSON:         true,
+		LiveHardDieFast: true,
+		PragmaProfile:   PRAGMA_PROFILE_SAFE_UPDATE,
+		Pragmas:         []string{"cache_size=-2000"},
+		StrictAltFiles:  true,
+	}
+
+	_, err = RunWithOptions(ctx, opts, log.Default())
+
+	if err != nil {
+		t.Fatalf("Failed to index %s, %v", db_uri, err)
+	}
+
+	db, err := sqlite.NewDatabase(ctx, db_uri)
+
+	if err != nil {
+		t.Fatalf("Failed to open %s, %v", db_uri, err)
+	}
+
+	defer db.Close(ctx)
+
+	conn, err := db.Conn(ctx)
+
+	if err != nil {
+		t.Fatalf("Failed to connect to %s, %v", db_uri, err)
+	}
+
+	// journal_mode=WAL is persistent so it should still be set when the database is reopened.
+
+	var journal_mode string
+
+	err = conn.QueryRow("PRAGMA journal_mode").Scan(&journal_mode)
+
+	if err != nil {
+		t.Fatalf("Failed to determine journal mode, %v", err)
+	}
+
+	if journal_mode != "wal" {
+		t.Fatalf("Expected journal mode to be 'wal', got '%s'", journal_mode)
+	}
+
+	opts.Pragmas = []string{"journal_mode=WAL; DROP TABLE geojson"}
+
+	_, err = RunWithOptions(ctx, opts, log.Default())
+
+	if err == nil {
+		t.Fatalf("Expected invalid pragma to fail")
+	}
+}
+
+func TestRunWithOptionsAtomic(t *testing.T) {
+
+	ctx := context.Background()
+
+	path_fixtures, err := filepath.Abs("../../fixtures")
+
+	if err != nil {
+		t.Fatalf("Failed to determine path for fixtures, %v", err)
+	}
+
+	path_data := filepath.Join(path_fixtures, "data")
+
+	tmp_dir := t.TempDir()
+	db_uri := fmt.Sprintf("modernc://%s", filepath.Join(tmp_dir, "atomic.db"))
+
+	count_records := func(table string) int {
+
+		db, err := sqlite.NewDatabase(ctx, db_uri)
+
+		if err != nil {
+			t.Fatalf("Failed to open %s, %v", db_uri, err)
+		}
+
+		defer db.Close(ctx)
+
+		conn, err := db.Conn(ctx)
+
+		if err != nil {
+			t.Fatalf("Failed to connect to %s, %v", db_uri, err)
+		}
+
+		var count int
+
+		err = conn.QueryRow(fmt.Sprintf("SELECT COUNT(id) FROM %s", table)).Scan(&count)
+
+		if err != nil {
+			t.Fatalf("Failed to count %s records in %s, %v", table, db_uri, err)
+		}
+
+		return count
+	}
+
+	ensure_no_temporary_files := func() {
+
+		entries, err := os.ReadDir(tmp_dir)
+
+		if err != nil {
+			t.Fatalf("Failed to read %s, %v", tmp_dir, err)
+		}
+
+		for _, e := range entries {
+
+			if e.Name() != "atomic.db" {
+				t.Fatalf("Unexpected file %s", e.Name())
+			}
+		}
+	}
+
+	opts := &RunOptions{
+		IteratorURI:     "directory://",
+		URIs:            []string{path_data},
+		DatabaseURI:     db_uri,
+		GeoJSON:         true,
+		LiveHardDieFast: true,
+		StrictAltFiles:  true,
+		Atomic:          true,
+	}
+
+	_, err = RunWithOptions(ctx, opts, log.Default())
+
+	if err != nil {
+		t.Fatalf("Failed to index %s, %v", db_uri, err)
+	}
+
+	if count_records("geojson") != 1 {
+		t.Fatalf("Expected 1 geojson record")
+	}
+
+	ensure_no_temporary_files()
+
+	db_path := filepath.Join(tmp_dir, "atomic.db")
+
+	check_mode := func(expected fs.FileMode) {
+
+		info, err := os.Stat(db_path)
+
+		if err != nil {
+			t.Fatalf("Failed to stat %s, %v", db_path, err)
+		}
+
+		if info.Mode().Perm() != expected {
+			t.Fatalf("Expected %s to have mode %v, got %v", db_path, expected, info.Mode().Perm())
+		}
+	}
+
+	// New databases get the same permissions as any other new file (0644, less the umask)
+
+	probe_path := filepath.Join(t.TempDir(), "probe")
+
+	probe_fh, err := os.OpenFile(probe_path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+
+	if err != nil {
+		t.Fatalf("Failed to create %s, %v", probe_path, err)
+	}
+
+	probe_fh.Close()
+
+	probe_info, err := os.Stat(probe_path)
+
+	if err != nil {
+		t.Fatalf("Failed to stat %s, %v", probe_path, err)
+	}
+
+	check_mode(probe_info.Mode().Perm())
+
+	// Existing databases keep their permissions
+
+	err = os.Chmod(db_path, 0640)
+
+	if err != nil {
+		t.Fatalf("Failed to change mode for %s, %v", db_path, err)
+	}
+
+	// Indexing an existing database starts with a copy of it
+
+	opts.GeoJSON = false
+	opts.SPR = true
+
+	_, err = RunWithOptions(ctx, opts, log.Default())
+
+	if err != nil {
+		t.Fatalf("Failed to reindex %s, %v", db_uri, err)
+	}
+
+	if count_records("geojson") != 1 || count_records("spr") != 1 {
+		t.Fatalf("Expected 1 geojson record and 1 spr record")
+	}
+
+	ensure_no_temporary_files()
+	check_mode(0640)
+
+	// A failed run leaves the existing database untouched
+
+	opts.Pragmas = []string{"bogus"}
+
+	_, err = RunWithOptions(ctx, opts, log.Default())
+
+	if err == nil {
+		t.Fatalf("Expected invalid pragma to fail")
+	}
+
+	if count_records("geojson") != 1 {
+		t.Fatalf("Expected 1 geojson record after failed run")
+	}
+
+	ensure_no_temporary_files()
+
+	opts.Pragmas = nil
+	opts.DatabaseURI = "modernc://mem"
+
+	_, err = RunWithOptions(ctx, opts, log.Default())
+
+	if err == nil {
+		t.Fatalf("Expected atomic mode to fail for in-memory database")
+	}
+}
+
+func TestRemoveStaleJournal(t *testing.T) {
+
+	db_path := filepath.Join(t.TempDir(), "atomic.db")
+
+	write_file := func(path string) {
+
+		err := os.WriteFile(path, []byte(""), 0644)
+
+		if err != nil {
+			t.Fatalf("Failed to write %s, %v", path, err)
+		}
+	}
+
+	exists := func(path string) bool {
+
+		_, err := os.Stat(path)
+		return err == nil
+	}
+
+	// A rollback journal is left alone if there is a write-ahead log (which may be in use)
+
+	write_file(db_path + "-journal")
+	write_file(db_path + "-wal")
+	write_file(db_path + "-shm")
+
+	err := removeStaleJournal(db_path)
+
+	if err != nil {
+		t.Fatalf("Failed to remove stale journal, %v", err)
+	}
+
+	for _, suffix := range []string{"-journal", "-wal", "-shm"} {
+
+		if !exists(db_path + suffix) {
+			t.Fatalf("Expected %s%s to be left alone", db_path, suffix)
+		}
+	}
+
+	os.Remove(db_path + "-wal")
+	os.Remove(db_path + "-shm")
+
+	err = removeStaleJournal(db_path)
+
+	if err != nil {
+		t.Fatalf("Failed to remove stale journal, %v", err)
+	}
+
+	if exists(db_path + "-journal") {
+		t.Fatalf("Expected %s-journal to be removed", db_path)
+	}
+
+	// No journal at all is not an error
+
+	err = removeStaleJournal(db_path)
+
+	if err != nil {
+		t.Fatalf("Expected missing journal not to fail, %v", err)
+	}
+}
+
+func TestRunWithOptionsIndexMeta(t *testing.T) {
+
+	ctx := context.Background()
+
+	path_fixtures, err := filepath.Abs("../../fixtures")
+
+	if err != nil {
+		t.Fatalf("Failed to determine path for fixtures, %v", err)
+	}
+
+	path_data := filepath.Join(path_fixtures, "data")
+
+	db_uri := fmt.Sprintf("modernc://%s", filepath.Join(t.TempDir(), "meta.db"))
+
+	fs := DefaultFlagSet()
+
+	err = fs.Parse([]string{
+		"-iterator-uri", "directory://",
+		"-database-uri", db_uri,
+		"-geojson",
+		"-spr",
+		"-index-alt", "spr",
+		path_data,
+	})
+
+	if err != nil {
+		t.Fatalf("Failed to parse flags, %v", err)
+	}
+
+	opts, err := RunOptionsFromFlagSet(fs)
+
+	if err != nil {
+		t.Fatalf("Failed to derive run options, %v", err)
+	}
+
+	_, err = RunWithOptions(ctx, opts, log.Default())
+
+	if err != nil {
+		t.Fatalf("Failed to index %s, %v", db_uri, err)
+	}
+
+	db, err := sqlite.NewDatabase(ctx, db_uri)
+
+	if err != nil {
+		t.Fatalf("Failed to open %s, %v", db_uri, err)
+	}
+
+	defer db.Close(ctx)
+
+	meta, err := index.LatestIndexMeta(ctx, db)
+
+	if err != nil {
+		t.Fatalf("Failed to read index meta, %v", err)
+	}
+
+	if meta.IteratorURI != "directory://" || len(meta.URIs) != 1 || meta.URIs[0] != path_data {
+		t.Fatalf("Unexpected sources, %s %v", meta.IteratorURI, meta.URIs)
+	}
+
+	if !slices.Equal(meta.Tables, []string{"geojson", "spr"}) {
+		t.Fatalf("Unexpected tables, %v", meta.Tables)
+	}
+
+	if !slices.Equal(meta.IndexAlt, []string{"spr"}) {
+		t.Fatalf("Unexpected alt tables, %v", meta.IndexAlt)
+	}
+
+	if meta.Counts["geojson"] != 1 || meta.Counts["spr"] != 1 {
+		t.Fatalf("Unexpected counts, %v", meta.Counts)
+	}
+
+	if meta.Indexed["geojson"] != 1 || meta.Indexed["spr"] != 1 {
+		t.Fatalf("Unexpected indexed counts, %v", meta.Indexed)
+	}
+
+	if meta.Flags["database-uri"] != db_uri || meta.Flags["geojson"] != "true" {
+		t.Fatalf("Unexpected flags, %v", meta.Flags)
+	}
+
+	if _, ok := meta.Flags["rtree"]; ok {
+		t.Fatalf("Expected flags that were not set to be omitted")
+	}
+
+	if meta.Finished.Before(meta.Started) {
+		t.Fatalf("Finished (%v) before started (%v)", meta.Finished, meta.Started)
+	}
+}
+
+func TestRunWithOptionsShardBy(t *testing.T) {
+
+	ctx := context.Background()
+
+	path_fixtures, err := filepath.Abs("../../fixtures")
+
+	if err != nil {
+		t.Fatalf("Failed to determine path for fixtures, %v", err)
+	}
+
+	body, err := os.ReadFile(filepath.Join(path_fixtures, "data", "101", "736", "545", "101736545.geojson"))
+
+	if err != nil {
+		t.Fatalf("Failed to read fixture, %v", err)
+	}
+
+	path_data := t.TempDir()
+	path_out := t.TempDir()
+
+	write_record := func(id int64, update func(props map[string]interface{}), uri_args ...*uri.URIArgs) {
+
+		var f map[string]interface{}
+
+		err := json.Unmarshal(body, &f)
+
+		if err != nil {
+			t.Fatalf("Failed to unmarshal fixture, %v", err)
+		}
+
+		props := f["properties"].(map[string]interface{})
+		props["wof:id"] = id
+
+		update(props)
+
+		record, err := json.Marshal(f)
+
+		if err != nil {
+			t.Fatalf("Failed to marshal record, %v", err)
+		}
+
+		rel_path, err := uri.Id2RelPath(id, uri_args...)
+
+		if err != nil {
+			t.Fatalf("Failed to derive path for %d, %v", id, err)
+		}
+
+		path := filepath.Join(path_data, rel_path)
+
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+
+		if err != nil {
+			t.Fatalf("Failed to create %s, %v", filepath.Dir(path), err)
+		}
+
+		err = os.WriteFile(path, record, 0644)
+
+		if err != nil {
+			t.Fatalf("Failed to write %s, %v", path, err)
+		}
+	}
+
+	write_record(101736545, func(props map[string]interface{}) {})
+
+	write_record(1001, func(props map[string]interface{}) {
+		props["wof:placetype"] = "county"
+	})
+
+	write_record(1002, func(props map[string]interface{}) {})
+
+	// Alt files are routed to the same database as their principal record, regardless of their own properties
+
+	alt_args, err := uri.NewAlternateURIArgsFromAltLabel("quattroshapes")
+
+	if err != nil {
+		t.Fatalf("Failed to derive alt URI args, %v", err)
+	}
+
+	write_record(101736545, func(props map[string]interface{}) {
+		props["src:alt_label"] = "quattroshapes"
+		props["wof:placetype"] = "county"
+	}, alt_args)
+
+	db_template := fmt.Sprintf("modernc://%s", filepath.Join(path_out, "whosonfirst-data-{placetype}-latest.db"))
+
+	opts := &RunOptions{
+		IteratorURI:     "directory://",
+		URIs:            []string{path_data},
+		DatabaseURI:     db_template,
+		GeoJSON:         true,
+		IndexAlt:        []string{"geojson"},
+		LiveHardDieFast: true,
+		StrictAltFiles:  true,
+		ShardBy:         SHARD_BY_PLACETYPE,
+		Processes:       2,
+	}
+
+	results, err := RunWithOptions(ctx, opts, log.Default())
+
+	if err != nil {
+		t.Fatalf("Failed to index shards, %v", err)
+	}
+
+	if len(results.Shards) != 2 {
+		t.Fatalf("Expected 2 shards, got %v", results.Shards)
+	}
+
+	expected := map[string]int{
+		"locality": 3,
+		"county":   1,
+	}
+
+	for placetype, count := range expected {
+
+		db_uri := fmt.Sprintf("modernc://%s", filepath.Join(path_out, fmt.Sprintf("whosonfirst-data-%s-latest.db", placetype)))
+
+		if results.Shards[placetype] != db_uri {
+			t.Fatalf("Unexpected database URI for %s shard, %s", placetype, results.Shards[placetype])
+		}
+
+		db, err := sqlite.NewDatabase(ctx, db_uri)
+
+		if err != nil {
+			t.Fatalf("Failed to open %s, %v", db_uri, err)
+		}
+
+		defer db.Close(ctx)
+
+		conn, err := db.Conn(ctx)
+
+		if err != nil {
+			t.Fatalf("Failed to connect to %s, %v", db_uri, err)
+		}
+
+		var geojson_count int
+
+		err = conn.QueryRow("SELECT COUNT(id) FROM geojson").Scan(&geojson_count)
+
+		if err != nil {
+			t.Fatalf("Failed to count geojson records in %s, %v", db_uri, err)
+		}
+
+		if geojson_count != count {
+			t.Fatalf("Expected %d geojson records in %s, got %d", count, db_uri, geojson_count)
+		}
+
+		meta, err := index.LatestIndexMeta(ctx, db)
+
+		if err != nil {
+			t.Fatalf("Failed to read index meta for %s, %v", db_uri, err)
+		}
+
+		if meta.Shard != placetype {
+			t.Fatalf("Unexpected shard '%s' in %s", meta.Shard, db_uri)
+		}
+	}
+
+	opts.DatabaseURI = fmt.Sprintf("modernc://%s", filepath.Join(path_out, "whosonfirst-data-{repo}-latest.db"))
+
+	_, err = RunWithOptions(ctx, opts, log.Default())
+
+	if err == nil {
+		t.Fatalf("Expected database URI without a matching placeholder to fail")
+	}
+}
+
+// batchProbeTable implements the `aaronland/go-sqlite.Table` interface for a table which records, for each record it
+// indexes, the number of geojson rows that have been committed (as seen by a separate connection to the database).
+type batchProbeTable struct {
+	// reader is a separate (private cache) connection to the database being indexed.
+	reader *sql.DB
+	// committed is the number of committed geojson rows seen by each (successive) call to IndexRecord.
+	committed []int
+	// delay is the amount of time to wait, while the database is locked, before indexing each record.
+	delay time.Duration
+	// fail_id is the ID of a record which the table fails to index.
+	fail_id int64
+}
+
+// batch_probe is the `batchProbeTable` instance returned by the "test_batch_probe" table's initialization function.
+var batch_probe *batchProbeTable
+
+func (t *batchProbeTable) Name() string {
+	return "test_batch_probe"
+}
+
+func (t *batchProbeTable) Schema() string {
+	return "CREATE TABLE test_batch_probe (id INTEGER PRIMARY KEY);"
+}
+
+func (t *batchProbeTable) InitializeTable(ctx context.Context, db sqlite.Database) error {
+	return sqlite.CreateTableIfNecessary(ctx, db, t)
+}
+
+func (t *batchProbeTable) IndexRecord(ctx context.Context, db sqlite.Database, i interface{}) error {
+
+	id, err := wof_properties.Id(i.([]byte))
+
+	if err != nil {
+		return err
+	}
+
+	if id == t.fail_id {
+		return fmt.Errorf("Failed to index %d", id)
+	}
+
+	time.Sleep(t.delay)
+
+	var count int
+
+	err = t.reader.QueryRowContext(ctx, "SELECT COUNT(id) FROM geojson").Scan(&count)
+
+	if err != nil {
+		return err
+	}
+
+	t.committed = append(t.committed, count)
+
+	conn, err := db.Conn(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.ExecContext(ctx, "INSERT OR REPLACE INTO test_batch_probe (id) VALUES (?)", id)
+	return err
+}
+
+func TestRunWithOptionsBatchSize(t *testing.T) {
+
+	ctx := context.Background()
+
+	body, err := os.ReadFile("../../fixtures/data/101/736/545/101736545.geojson")
+
+	if err != nil {
+		t.Fatalf("Failed to read fixture, %v", err)
+	}
+
+	path_data := t.TempDir()
+
+	ids := []int64{1001, 1002, 1003, 1004, 1005}
+
+	for _, id := range ids {
+
+		var f map[string]interface{}
+
+		err := json.Unmarshal(body, &f)
+
+		if err != nil {
+			t.Fatalf("Failed to unmarshal fixture, %v", err)
+		}
+
+		f["properties"].(map[string]interface{})["wof:id"] = id
+
+		record, err := json.Marshal(f)
+
+		if err != nil {
+			t.Fatalf("Failed to marshal record, %v", err)
+		}
+
+		rel_path, err := uri.Id2RelPath(id)
+
+		if err != nil {
+			t.Fatalf("Failed to derive path for %d, %v", id, err)
+		}
+
+		path := filepath.Join(path_data, rel_path)
+
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+
+		if err != nil {
+			t.Fatalf("Failed to create %s, %v", filepath.Dir(path), err)
+		}
+
+		err = os.WriteFile(path, record, 0644)
+
+		if err != nil {
+			t.Fatalf("Failed to write %s, %v", path, err)
+		}
+	}
+
+	// The probe table is created (and reset) for each run by assigning it to 'batch_probe'
+
+	if !slices.Contains(index.TableNames(), "test_batch_probe") {
+
+		err = index.RegisterTable(ctx, "test_batch_probe", func(ctx context.Context, db sqlite.Database, opts *index.TableOptions) (sqlite.Table, error) {
+
+			err := batch_probe.InitializeTable(ctx, db)
+
+			if err != nil {
+				return nil, err
+			}
+
+			return batch_probe, nil
+		})
+
+		if err != nil {
+			t.Fatalf("Failed to register table, %v", err)
+		}
+	}
+
+	run := func(opts *RunOptions, p *batchProbeTable) (*RunResults, *sql.DB, error) {
+
+		db_path := filepath.Join(t.TempDir(), "batch.db")
+		db_uri := fmt.Sprintf("modernc://%s", db_path)
+
+		// The probe reads the database using a connection which does not share its cache with the
+		// indexer's connections so that it only sees committed rows.
+
+		reader, err := sql.Open("sqlite", fmt.Sprintf("file:%s?cache=private&mode=rwc", db_path))
+
+		if err != nil {
+			t.Fatalf("Failed to open %s, %v", db_path, err)
+		}
+
+		t.Cleanup(func() {
+			reader.Close()
+		})
+
+		p.reader = reader
+		batch_probe = p
+
+		opts.IteratorURI = "directory://"
+		opts.URIs = []string{path_data}
+		opts.DatabaseURI = db_uri
+		opts.GeoJSON = true
+		opts.SPR = true
+		opts.Tables = []string{"test_batch_probe"}
+		opts.PragmaProfile = PRAGMA_PROFILE_SAFE_UPDATE
+
+		results, err := RunWithOptions(ctx, opts, log.Default())
+
+		return results, reader, err
+	}
+
+	count_rows := func(db *sql.DB, table string, id int64) int {
+
+		var count int
+
+		q := fmt.Sprintf("SELECT COUNT(id) FROM %s", table)
+		args := make([]interface{}, 0)
+
+		if id != 0 {
+			q = fmt.Sprintf("%s WHERE id = ?", q)
+			args = append(args, id)
+		}
+
+		err := db.QueryRowContext(ctx, q, args...).Scan(&count)
+
+		if err != nil {
+			t.Fatalf("Failed to count %s rows, %v", table, err)
+		}
+
+		return count
+	}
+
+	// Transactions are committed every two records, and the remaining record when indexing finishes
+
+	p := &batchProbeTable{}
+
+	_, db, err := run(&RunOptions{BatchSize: 2}, p)
+
+	if err != nil {
+		t.Fatalf("Failed to index records with batch size, %v", err)
+	}
+
+	if !slices.Equal(p.committed, []int{0, 0, 2, 2, 4}) {
+		t.Fatalf("Unexpected committed rows while indexing, %v", p.committed)
+	}
+
+	for _, table := range []string{"geojson", "spr", "test_batch_probe"} {
+
+		count := count_rows(db, table, 0)
+
+		if count != len(ids) {
+			t.Fatalf("Expected %d %s rows after closing batch, got %d", len(ids), table, count)
+		}
+	}
+
+	// Transactions are committed once the interval has elapsed, regardless of the number of records
+
+	p = &batchProbeTable{
+		delay: 50 * time.Millisecond,
+	}
+
+	_, db, err = run(&RunOptions{BatchSize: 100, BatchInterval: 10}, p)
+
+	if err != nil {
+		t.Fatalf("Failed to index records with batch interval, %v", err)
+	}
+
+	if len(p.committed) != len(ids) || p.committed[len(ids)-1] == 0 {
+		t.Fatalf("Expected rows to be committed after interval, %v", p.committed)
+	}
+
+	if !slices.IsSorted(p.committed) {
+		t.Fatalf("Expected committed rows to increase, %v", p.committed)
+	}
+
+	if count_rows(db, "geojson", 0) != len(ids) {
+		t.Fatalf("Expected %d geojson rows after closing batch", len(ids))
+	}
+
+	// A record which fails to be indexed by one table is rolled back in all the tables
+
+	p = &batchProbeTable{
+		fail_id: 1003,
+	}
+
+	results, db, err := run(&RunOptions{BatchSize: 2, ContinueOnError: true, ErrorThreshold: 1}, p)
+
+	if err != nil {
+		t.Fatalf("Failed to index records with failing table, %v", err)
+	}
+
+	if results.IndexErrors != 1 {
+		t.Fatalf("Expected 1 index error, got %d", results.IndexErrors)
+	}
+
+	for _, table := range []string{"geojson", "spr", "test_batch_probe"} {
+
+		if count_rows(db, table, 1003) != 0 {
+			t.Fatalf("Expected no %s rows for failed record", table)
+		}
+
+		count := count_rows(db, table, 0)
+
+		if count != len(ids)-1 {
+			t.Fatalf("Expected %d %s rows, got %d", len(ids)-1, table, count)
+		}
+	}
+
+	// A run which fails does not commit the records in the current batch
+
+	p = &batchProbeTable{
+		fail_id: 1003,
+	}
+
+	_, db, err = run(&RunOptions{BatchSize: 10}, p)
+
+	if err == nil {
+		t.Fatalf("Expected failing table to fail")
+	}
+
+	for _, table := range []string{"geojson", "spr", "test_batch_probe"} {
+
+		count := count_rows(db, table, 0)
+
+		if count != 0 {
+			t.Fatalf("Expected no %s rows after failed run, got %d", table, count)
+		}
+	}
+
+	_, _, err = run(&RunOptions{BatchSize: -1}, &batchProbeTable{})
+
+	if err == nil {
+		t.Fatalf("Expected negative batch size to fail")
+	}
+}
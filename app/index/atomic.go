@@ -0,0 +1,341 @@
+package index
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"math/rand"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aaronland/go-sqlite/v2"
+)
+
+// sqlite_sidecar_suffixes are the suffixes of the files SQLite creates alongside a database file.
+var sqlite_sidecar_suffixes = []string{
+	"-journal",
+	"-wal",
+	"-shm",
+}
+
+// runAtomic indexes Who's On First records in a temporary copy of the database defined by 'opts.DatabaseURI', in the
+// same directory as that database, and only replaces the database with the temporary copy once indexing has completed
+// successfully and the temporary copy has been optimized and has passed an integrity check.
+func runAtomic(ctx context.Context, opts *RunOptions, logger *log.Logger) (*RunResults, error) {
+
+	db_path, err := databasePathFromURI(opts.DatabaseURI)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to derive database path for atomic mode, %w", err)
+	}
+
+	// The temporary database is created with the same permissions SQLite would use (0644, less
+	// the umask) for a new database so that it is not left readable only by its owner, which is what
+	// os.CreateTemp would do, once it has been renamed.
+
+	tmp_path, err := createTempDatabase(filepath.Dir(db_path), filepath.Base(db_path), 0644)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create temporary database, %w", err)
+	}
+
+	renamed := false
+
+	defer func() {
+
+		if renamed {
+			return
+		}
+
+		removeDatabaseFiles(tmp_path, logger)
+	}()
+
+	tmp_uri, err := databaseURIWithPath(opts.DatabaseURI, tmp_path)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to derive temporary database URI, %w", err)
+	}
+
+	// Incremental, sync and git diff modes (or simply adding tables) all expect to update
+	// an existing database so start with a consistent copy of it, if present.
+
+	db_info, err := os.Stat(db_path)
+
+	switch {
+	case err == nil:
+
+		err = copyDatabase(ctx, opts.DatabaseURI, tmp_path)
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to copy %s to temporary database, %w", db_path, err)
+		}
+
+		// Preserve the permissions of the database being replaced
+
+		err = os.Chmod(tmp_path, db_info.Mode().Perm())
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to set permissions for temporary database, %w", err)
+		}
+
+	case errors.Is(err, fs.ErrNotExist):
+		// pass
+	default:
+		return nil, fmt.Errorf("Failed to stat %s, %w", db_path, err)
+	}
+
+	tmp_opts := *opts
+	tmp_opts.Atomic = false
+	tmp_opts.DatabaseURI = tmp_uri
+
+	results, err := RunWithOptions(ctx, &tmp_opts, logger)
+
+	if err != nil {
+		return results, err
+	}
+
+	err = verifyDatabase(ctx, tmp_uri)
+
+	if err != nil {
+		return results, fmt.Errorf("Failed to verify temporary database, %w", err)
+	}
+
+	// The -wal and -shm files for the database being replaced are left alone since they may
+	// still be in use by processes reading the old version of the database. A (stale) rollback
+	// journal, which SQLite would otherwise try to apply to the new database, is removed but only
+	// if there is no -wal file since the two can not both be in use for the same database.
+
+	err = removeStaleJournal(db_path)
+
+	if err != nil {
+		return results, fmt.Errorf("Failed to remove stale journal for %s, %w", db_path, err)
+	}
+
+	err = os.Rename(tmp_path, db_path)
+
+	if err != nil {
+		return results, fmt.Errorf("Failed to rename temporary database to %s, %w", db_path, err)
+	}
+
+	renamed = true
+
+	removeDatabaseFiles(tmp_path, logger)
+	return results, nil
+}
+
+// removeStaleJournal removes the rollback journal ("-journal") file for the database at 'db_path', if present, unless
+// that database also has a write-ahead log ("-wal") file.
+func removeStaleJournal(db_path string) error {
+
+	_, err := os.Stat(db_path + "-wal")
+
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, fs.ErrNotExist):
+		// pass
+	default:
+		return err
+	}
+
+	err = os.Remove(db_path + "-journal")
+
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// createTempDatabase creates a new, empty, file in 'dir' whose name is derived from 'base' and a random suffix, with
+// the permissions 'perm' (before the umask is applied), and returns its path.
+func createTempDatabase(dir string, base string, perm fs.FileMode) (string, error) {
+
+	for i := 0; i < 100; i++ {
+
+		path := filepath.Join(dir, fmt.Sprintf(".%s.%d.tmp", base, rand.Uint32()))
+
+		fh, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, perm)
+
+		if errors.Is(err, fs.ErrExist) {
+			continue
+		}
+
+		if err != nil {
+			return "", err
+		}
+
+		err = fh.Close()
+
+		if err != nil {
+			os.Remove(path)
+			return "", fmt.Errorf("Failed to close %s, %w", path, err)
+		}
+
+		return path, nil
+	}
+
+	return "", fmt.Errorf("Failed to derive a unique temporary file name in %s", dir)
+}
+
+// databasePathFromURI returns the path of the (local) database file defined by 'uri'.
+func databasePathFromURI(uri string) (string, error) {
+
+	u, err := url.Parse(uri)
+
+	if err != nil {
+		return "", fmt.Errorf("Failed to parse URI, %w", err)
+	}
+
+	path := u.Path
+
+	switch u.Host {
+	case "mem", "vfs":
+		return "", fmt.Errorf("Unsupported database host '%s', atomic mode requires a database file", u.Host)
+	case "cwd":
+
+		cwd, err := os.Getwd()
+
+		if err != nil {
+			return "", fmt.Errorf("Failed to derive current working directory, %w", err)
+		}
+
+		path = filepath.Join(cwd, path)
+
+	default:
+		// pass
+	}
+
+	if path == "" || path == "/" {
+		return "", fmt.Errorf("Missing database path")
+	}
+
+	return filepath.Abs(path)
+}
+
+// databaseURIWithPath returns a copy of 'uri' whose database file is 'path'.
+func databaseURIWithPath(uri string, path string) (string, error) {
+
+	u, err := url.Parse(uri)
+
+	if err != nil {
+		return "", fmt.Errorf("Failed to parse URI, %w", err)
+	}
+
+	u.Host = ""
+	u.Path = path
+
+	return u.String(), nil
+}
+
+// copyDatabase writes a consistent copy of the database defined by 'uri' to 'path', which must not exist or be empty.
+func copyDatabase(ctx context.Context, uri string, path string) error {
+
+	db, err := sqlite.NewDatabase(ctx, uri)
+
+	if err != nil {
+		return fmt.Errorf("Failed to create database, %w", err)
+	}
+
+	defer db.Close(ctx)
+
+	conn, err := db.Conn(ctx)
+
+	if err != nil {
+		return fmt.Errorf("Failed to establish database connection, %w", err)
+	}
+
+	q := fmt.Sprintf("VACUUM INTO '%s'", strings.ReplaceAll(path, "'", "''"))
+
+	_, err = conn.ExecContext(ctx, q)
+
+	if err != nil {
+		return fmt.Errorf("Failed to vacuum database, %w", err)
+	}
+
+	return nil
+}
+
+// verifyDatabase runs `PRAGMA optimize` and `PRAGMA integrity_check` on the database defined by 'uri'.
+func verifyDatabase(ctx context.Context, uri string) error {
+
+	db, err := sqlite.NewDatabase(ctx, uri)
+
+	if err != nil {
+		return fmt.Errorf("Failed to create database, %w", err)
+	}
+
+	defer db.Close(ctx)
+
+	conn, err := db.Conn(ctx)
+
+	if err != nil {
+		return fmt.Errorf("Failed to establish database connection, %w", err)
+	}
+
+	_, err = conn.ExecContext(ctx, "PRAGMA optimize")
+
+	if err != nil {
+		return fmt.Errorf("Failed to optimize database, %w", err)
+	}
+
+	rows, err := conn.QueryContext(ctx, "PRAGMA integrity_check")
+
+	if err != nil {
+		return fmt.Errorf("Failed to check database integrity, %w", err)
+	}
+
+	defer rows.Close()
+
+	problems := make([]string, 0)
+
+	for rows.Next() {
+
+		var result string
+
+		err := rows.Scan(&result)
+
+		if err != nil {
+			return fmt.Errorf("Failed to scan integrity check result, %w", err)
+		}
+
+		if result != "ok" {
+			problems = append(problems, result)
+		}
+	}
+
+	err = rows.Err()
+
+	if err != nil {
+		return fmt.Errorf("Failed to check database integrity, %w", err)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("Integrity check failed: %s", strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// removeDatabaseFiles removes the database file 'path', and any files SQLite has created alongside it, if present.
+func removeDatabaseFiles(path string, logger *log.Logger) {
+
+	paths := []string{path}
+
+	for _, suffix := range sqlite_sidecar_suffixes {
+		paths = append(paths, path+suffix)
+	}
+
+	for _, p := range paths {
+
+		err := os.Remove(p)
+
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			logger.Printf("Failed to remove %s, %v", p, err)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package index
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/whosonfirst/go-ioutil"
+	"github.com/whosonfirst/go-reader"
+)
+
+// relations_reader_timeout is the maximum amount of time to wait for a response from a relations reader's endpoint.
+const relations_reader_timeout time.Duration = 30 * time.Second
+
+// cacheMetadata is a struct containing the metadata used to validate a cached record.
+type cacheMetadata struct {
+	// ETag is the value of the ETag header returned when the record was fetched.
+	ETag string `json:"etag,omitempty"`
+	// LastModified is the value of the Last-Modified header returned when the record was fetched.
+	LastModified string `json:"last_modified,omitempty"`
+	// Validated is the Unix timestamp when the record was last fetched, or revalidated, from the endpoint.
+	Validated int64 `json:"validated,omitempty"`
+}
+
+// cachingHTTPReader implements the `whosonfirst/go-reader.Reader` interface for reading documents from an HTTP(S) endpoint,
+// storing a copy of each document in a local directory. Cached documents are used as-is for up to 'max_age' after they were
+// last fetched, or revalidated, and then revalidated using a conditional request (with the document's ETag and Last-Modified
+// headers). Cached documents are also used as-is if the endpoint can not be reached or returns a server error.
+type cachingHTTPReader struct {
+	url        *url.URL
+	root       string
+	user_agent string
+	max_age    time.Duration
+	client     *http.Client
+}
+
+// newRelationsReader returns a new `whosonfirst/go-reader.Reader` instance for 'reader_uri'. If 'cache_dir' is not empty and
+// 'reader_uri' is an HTTP(S) URI the reader will cache documents in 'cache_dir', revalidating them once they are older than 'max_age'.
+func newRelationsReader(ctx context.Context, reader_uri string, cache_dir string, max_age time.Duration) (reader.Reader, error) {
+
+	if cache_dir == "" {
+		return reader.NewReader(ctx, reader_uri)
+	}
+
+	u, err := url.Parse(reader_uri)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse reader URI, %w", err)
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		// pass
+	default:
+		return reader.NewReader(ctx, reader_uri)
+	}
+
+	// Each endpoint gets its own cache so that records from different sources are never mixed up
+
+	root := filepath.Join(cache_dir, u.Host, filepath.FromSlash(u.Path))
+
+	err = os.MkdirAll(root, 0755)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create cache directory, %w", err)
+	}
+
+	r := &cachingHTTPReader{
+		url:        u,
+		root:       root,
+		user_agent: u.Query().Get("user-agent"),
+		max_age:    max_age,
+		client: &http.Client{
+			Timeout: relations_reader_timeout,
+		},
+	}
+
+	return r, nil
+}
+
+// Read returns an `io.ReadSeekCloser` instance for 'path', from the local cache if it is still fresh, has not been
+// modified or the endpoint can not be reached, and from the endpoint otherwise.
+func (r *cachingHTTPReader) Read(ctx context.Context, path string) (io.ReadSeekCloser, error) {
+
+	cache_path := filepath.Join(r.root, filepath.FromSlash(path))
+	meta_path := cache_path + ".meta"
+
+	cached_body, cached_meta, cached := r.readCache(cache_path, meta_path)
+
+	if cached && time.Since(time.Unix(cached_meta.Validated, 0)) < r.max_age {
+		return ioutil.NewReadSeekCloser(bytes.NewReader(cached_body))
+	}
+
+	u := *r.url
+	u.Path, _ = url.JoinPath(u.Path, path)
+	u.RawQuery = ""
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create new request, %w", err)
+	}
+
+	if r.user_agent != "" {
+		req.Header.Set("User-Agent", r.user_agent)
+	}
+
+	if cached {
+
+		if cached_meta.ETag != "" {
+			req.Header.Set("If-None-Match", cached_meta.ETag)
+		}
+
+		if cached_meta.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached_meta.LastModified)
+		}
+	}
+
+	rsp, err := r.client.Do(req)
+
+	if err != nil {
+
+		// Offline, or the endpoint is unreachable, so use the cached copy if there is one
+
+		if cached {
+			return ioutil.NewReadSeekCloser(bytes.NewReader(cached_body))
+		}
+
+		return nil, fmt.Errorf("Failed to execute request, %w", err)
+	}
+
+	defer rsp.Body.Close()
+
+	switch {
+	case rsp.StatusCode == http.StatusNotModified:
+
+		if !cached {
+			return nil, fmt.Errorf("Unexpected status code for uncached record: %s", rsp.Status)
+		}
+
+		cached_meta.Validated = time.Now().Unix()
+
+		err := r.writeMetadata(meta_path, cached_meta)
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to update cache metadata for %s, %w", path, err)
+		}
+
+		return ioutil.NewReadSeekCloser(bytes.NewReader(cached_body))
+
+	case rsp.StatusCode == http.StatusOK:
+		// pass
+	case rsp.StatusCode >= http.StatusInternalServerError && cached:
+
+		// The endpoint is having problems so use the cached copy
+		return ioutil.NewReadSeekCloser(bytes.NewReader(cached_body))
+
+	default:
+		return nil, fmt.Errorf("Unexpected status code: %s", rsp.Status)
+	}
+
+	body, err := io.ReadAll(rsp.Body)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read response body, %w", err)
+	}
+
+	meta := &cacheMetadata{
+		ETag:         rsp.Header.Get("ETag"),
+		LastModified: rsp.Header.Get("Last-Modified"),
+		Validated:    time.Now().Unix(),
+	}
+
+	// Servers that don't support conditional requests will send the record again so only
+	// rewrite the cached record if it has actually changed
+
+	if cached && bytes.Equal(cached_body, body) {
+		err = r.writeMetadata(meta_path, meta)
+	} else {
+		err = r.writeCache(cache_path, meta_path, body, meta)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to cache %s, %w", path, err)
+	}
+
+	return ioutil.NewReadSeekCloser(bytes.NewReader(body))
+}
+
+// ReaderURI returns the absolute URL for 'path'.
+func (r *cachingHTTPReader) ReaderURI(ctx context.Context, path string) string {
+
+	u := *r.url
+	u.Path, _ = url.JoinPath(u.Path, path)
+	u.RawQuery = ""
+
+	return u.String()
+}
+
+// readCache returns the cached body and metadata stored in 'cache_path' and 'meta_path' and a boolean flag
+// indicating whether they exist and are readable.
+func (r *cachingHTTPReader) readCache(cache_path string, meta_path string) ([]byte, *cacheMetadata, bool) {
+
+	body, err := os.ReadFile(cache_path)
+
+	if err != nil {
+		return nil, nil, false
+	}
+
+	meta_body, err := os.ReadFile(meta_path)
+
+	if err != nil {
+		return nil, nil, false
+	}
+
+	var meta *cacheMetadata
+
+	err = json.Unmarshal(meta_body, &meta)
+
+	if err != nil || meta == nil {
+		return nil, nil, false
+	}
+
+	return body, meta, true
+}
+
+// writeCache (atomically) writes 'body' and 'meta' to 'cache_path' and 'meta_path' respectively.
+func (r *cachingHTTPReader) writeCache(cache_path string, meta_path string, body []byte, meta *cacheMetadata) error {
+
+	err := os.MkdirAll(filepath.Dir(cache_path), 0755)
+
+	if err != nil {
+		return fmt.Errorf("Failed to create cache directory, %w", err)
+	}
+
+	// The metadata is written last so that a partially written entry is never considered valid
+
+	os.Remove(meta_path)
+
+	err = writeFileAtomic(cache_path, body)
+
+	if err != nil {
+		return err
+	}
+
+	return r.writeMetadata(meta_path, meta)
+}
+
+// writeMetadata (atomically) writes 'meta' to 'meta_path'.
+func (r *cachingHTTPReader) writeMetadata(meta_path string, meta *cacheMetadata) error {
+
+	meta_body, err := json.Marshal(meta)
+
+	if err != nil {
+		return fmt.Errorf("Failed to marshal cache metadata, %w", err)
+	}
+
+	return writeFileAtomic(meta_path, meta_body)
+}
+
+// writeFileAtomic writes 'body' to a temporary file in the same directory as 'path' and then renames it to 'path'.
+func writeFileAtomic(path string, body []byte) error {
+
+	tmp_fh, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+
+	if err != nil {
+		return fmt.Errorf("Failed to create temporary file, %w", err)
+	}
+
+	tmp_path := tmp_fh.Name()
+
+	_, err = tmp_fh.Write(body)
+
+	if err != nil {
+		tmp_fh.Close()
+		os.Remove(tmp_path)
+		return fmt.Errorf("Failed to write temporary file, %w", err)
+	}
+
+	err = tmp_fh.Close()
+
+	if err != nil {
+		os.Remove(tmp_path)
+		return fmt.Errorf("Failed to close temporary file, %w", err)
+	}
+
+	err = os.Rename(tmp_path, path)
+
+	if err != nil {
+		os.Remove(tmp_path)
+		return fmt.Errorf("Failed to rename temporary file, %w", err)
+	}
+
+	return nil
+}
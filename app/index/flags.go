@@ -9,6 +9,7 @@ import (
 	"github.com/sfomuseum/go-flags/flagset"
 	"github.com/sfomuseum/go-flags/multi"
 	"github.com/whosonfirst/go-whosonfirst-iterate/v2/emitter"
+	"github.com/whosonfirst/go-whosonfirst-sqlite-features-index/v2"
 )
 
 var iterator_uri string
@@ -31,8 +32,17 @@ var spatial_tables bool
 var spelunker_tables bool
 
 var live_hard bool
+
+var pragma_profile string
+var pragmas multi.MultiString
 var timings bool
 var optimize bool
+var atomic_mode bool
+
+var batch_size int
+var batch_interval int
+
+var shard_by string
 
 var alt_files bool
 var strict_alt_files bool
@@ -40,7 +50,51 @@ var strict_alt_files bool
 var index_alt multi.MultiString
 
 var index_relations bool
-var relations_uri string
+var relations_uris multi.MultiString
+var relations_cache_dir string
+var relations_cache_max_age int
+var relations_properties multi.MultiString
+var relations_max_depth int
+var relations_alt_labels multi.MultiString
+var relations_workers int
+var relations_batch_size int
+var relations_report string
+
+var continue_on_error bool
+var error_threshold int64
+
+var extra_tables multi.MultiString
+
+var include_placetypes multi.MultiString
+var exclude_placetypes multi.MultiString
+var is_current multi.MultiInt64
+var is_deprecated multi.MultiInt64
+var is_ceased multi.MultiInt64
+var is_superseded multi.MultiInt64
+var include_repos multi.MultiString
+var property_filters multi.MultiString
+var filter_mode string
+var intersects_bbox string
+var include_properties multi.MultiString
+var exclude_properties multi.MultiString
+var simplify_tolerance float64
+var simplify_algorithm string
+var coordinate_precision int
+var transformer_uris multi.MultiString
+var intersects_geojson string
+
+var validate bool
+var validation_mode string
+var validation_rules multi.MultiString
+
+var incremental bool
+
+var sync_db bool
+var sync_dry_run bool
+var sync_force bool
+
+var git_diff_from string
+var git_diff_to string
 
 var procs int
 
@@ -70,18 +124,69 @@ func DefaultFlagSet() *flag.FlagSet {
 	fs.BoolVar(&spatial_tables, "spatial-tables", false, "If true then index the necessary tables for use with the whosonfirst/go-whosonfirst-spatial-sqlite package.")
 	fs.BoolVar(&spelunker_tables, "spelunker-tables", false, "If true then index the necessary tables for use with the whosonfirst/go-whosonfirst-spelunker packages")	
 
-	fs.BoolVar(&live_hard, "live-hard-die-fast", true, "Enable various performance-related pragmas at the expense of possible (unlikely) database corruption")
+	fs.BoolVar(&live_hard, "live-hard-die-fast", true, "Enable various performance-related pragmas at the expense of possible (unlikely) database corruption. This is equivalent to -pragma-profile=bulk-build and is ignored if -pragma-profile is set.")
+	fs.StringVar(&pragma_profile, "pragma-profile", "", fmt.Sprintf("The name of a pragma profile to apply to the database. Valid options are: %s", strings.Join(PragmaProfiles(), ", ")))
+	fs.Var(&pragmas, "pragma", "Zero or more KEY=VALUE pragmas to apply to the database. These replace, or are added to, the pragmas defined by -pragma-profile (or -live-hard-die-fast).")
 	fs.BoolVar(&timings, "timings", false, "Display timings during and after indexing")
 	fs.BoolVar(&optimize, "optimize", true, "Attempt to optimize the database before closing connection")
+	fs.StringVar(&shard_by, "shard-by", "", "Route records to different databases, in a single pass, by the value of a property. Valid options are: repo, placetype, country or a gjson path (for example properties.wof:belongsto.0). If set -database-uri is expected to contain a {shard} placeholder (or {repo}, {placetype} or {country} for the corresponding rule) which is replaced by each record's (lower-cased) value.")
+	fs.BoolVar(&atomic_mode, "atomic", false, "Index records in a temporary copy of the database, in the same directory, and only replace the database once indexing has completed successfully and the copy has passed an integrity check")
 
 	fs.BoolVar(&alt_files, "index-alt-files", false, "Index alt geometries. This flag is deprecated, please use -index-alt=TABLE,TABLE,etc. instead. To index alt geometries in all the applicable tables use -index-alt=*")
 	fs.Var(&index_alt, "index-alt", "Zero or more table names where alt geometry files should be indexed.")
 
 	fs.BoolVar(&strict_alt_files, "strict-alt-files", true, "Be strict when indexing alt geometries")
 
-	fs.BoolVar(&index_relations, "index-relations", false, "Index the records related to a feature, specifically wof:belongsto, wof:depicts and wof:involves. Alt files for relations are not indexed at this time.")
-	fs.StringVar(&relations_uri, "index-relations-reader-uri", "", "A valid go-reader.Reader URI from which to read data for a relations candidate.")
-
+	fs.BoolVar(&index_relations, "index-relations", false, "Index the records related to a feature, specifically wof:belongsto, wof:depicts and wof:involves. Alt files for relations are indexed (in those tables where alt files are enabled) if the -index-alt or -index-alt-files flags are set.")
+	fs.Var(&relations_uris, "index-relations-reader-uri", "One or more valid go-reader.Reader URIs from which to read data for a relations candidate. Readers are tried in the order they are specified until one is able to read a relation.")
+	fs.StringVar(&relations_cache_dir, "index-relations-cache-dir", "", "An optional path to a local directory used to cache the records read by HTTP(S) relations readers. Cached records are revalidated using their ETag and Last-Modified headers and used as-is if the reader can not be reached or returns a server error.")
+	fs.IntVar(&relations_cache_max_age, "index-relations-cache-max-age", 3600, "The number of seconds that records cached by the -index-relations-cache-dir flag are used as-is, after they were last fetched or revalidated, before they are revalidated. If zero cached records are revalidated every time they are read.")
+	fs.IntVar(&relations_max_depth, "index-relations-max-depth", 1, "The maximum number of levels of relations to index. For example a value of 2 will index a feature's relations and the relations of those relations.")
+	fs.Var(&relations_alt_labels, "index-relations-alt-label", "Zero or more alt geometry labels to look for when indexing the alt files for relations, in addition to those listed in a relation's src:geom_alt property.")
+	fs.IntVar(&relations_workers, "index-relations-workers", 10, "The number of relations to read concurrently. Relations are indexed after all the features have been indexed.")
+	fs.IntVar(&relations_batch_size, "index-relations-batch-size", 0, "The number of relations to write in a single transaction. If zero each table commits each relation in its own transaction.")
+	fs.StringVar(&relations_report, "relations-report", "", "An optional path to a file where the relations that could not be read or parsed, and the records that reference them, will be written. If the path ends in '.csv' the report is written as CSV, otherwise as JSON.")
+	fs.Var(&relations_properties, "index-relations-property", "Zero or more gjson paths used to derive the IDs of a feature's relations, for example 'properties.wof:parent_id' or 'properties.wof:hierarchy'. If empty the default properties are properties.wof:belongsto, properties.wof:involves and properties.wof:depicts.")
+
+	fs.BoolVar(&incremental, "incremental", false, "Skip records that are already present, and unchanged, in the database. Records are compared using their wof:lastmodified property (and their body if the 'geojson' table is present) against the 'geojson' or 'spr' tables.")
+
+	fs.BoolVar(&sync_db, "sync", false, "After indexing, remove any records (from all the tables being indexed) whose wof:id was not encountered during iteration. Records excluded by a filter, or that fail to load or validate, are still considered to have been encountered. Be careful combining this flag with iterator filters since anything the iterator excludes will be removed.")
+	fs.BoolVar(&sync_dry_run, "sync-dry-run", false, "Log the records that would be removed by the -sync flag but do not remove them.")
+	fs.BoolVar(&sync_force, "sync-force", false, "Remove records with the -sync flag even if no records were encountered during iteration or some records failed to be loaded or indexed (with the -continue-on-error flag).")
+
+	fs.StringVar(&git_diff_from, "git-diff-from", "", "If not empty, treat each URI to index as a local Git repository and only index the records added or modified between this revision and the -git-diff-to revision, removing the records that were deleted from all the tables being indexed. The -iterator-uri flag's scheme is ignored in this mode but its query filters are preserved.")
+	fs.StringVar(&git_diff_to, "git-diff-to", "HEAD", "The revision to compare against the -git-diff-from revision.")
+
+	fs.Var(&extra_tables, "table", fmt.Sprintf("Zero or more table names to index, in addition to those enabled by the boolean table flags. Tables are registered using the index.RegisterTable method. Valid tables are: %s", strings.Join(index.TableNames(), ", ")))
+
+	fs.Var(&include_placetypes, "include-placetype", "Zero or more placetypes. If present only records with one of these placetypes will be indexed. Filters are not applied to relations.")
+	fs.Var(&exclude_placetypes, "exclude-placetype", "Zero or more placetypes. Records with one of these placetypes will not be indexed.")
+	fs.Var(&is_current, "is-current", "Zero or more existential flag values (1, 0 or -1). If present only records whose 'is current' flag matches one of these values will be indexed.")
+	fs.Var(&is_deprecated, "is-deprecated", "Zero or more existential flag values (1, 0 or -1). If present only records whose 'is deprecated' flag matches one of these values will be indexed.")
+	fs.Var(&is_ceased, "is-ceased", "Zero or more existential flag values (1, 0 or -1). If present only records whose 'is ceased' flag matches one of these values will be indexed.")
+	fs.Var(&is_superseded, "is-superseded", "Zero or more existential flag values (1, 0 or -1). If present only records whose 'is superseded' flag matches one of these values will be indexed.")
+	fs.Var(&include_repos, "include-repo", "Zero or more wof:repo values. If present only records from one of these repos will be indexed.")
+	fs.Var(&property_filters, "filter", "Zero or more {PATH}={REGULAR_EXPRESSION} or {PATH}!={REGULAR_EXPRESSION} filters, where {PATH} is a tidwall/gjson path, that records must match in order to be indexed. For example: -filter 'properties.wof:country=^US$' -filter 'properties.mz:is_funky!=^1$'")
+	fs.StringVar(&intersects_bbox, "intersects-bbox", "", "An optional comma-separated minx,miny,maxx,maxy bounding box. If present only records whose geometry intersects it will be indexed.")
+	fs.StringVar(&intersects_geojson, "intersects-geojson", "", "The optional path to a GeoJSON Polygon or MultiPolygon geometry, Feature or FeatureCollection. If present only records whose geometry intersects it will be indexed.")
+	fs.StringVar(&filter_mode, "filter-mode", "AND", "Whether records must match all (AND) or any (OR) of the -filter flags.")
+
+	fs.Var(&include_properties, "include-property", "Zero or more property names, which may contain '*' wildcards (for example 'name:*'), to retain. If present all other properties, except those needed to index a record, will be removed before a record is indexed.")
+	fs.Float64Var(&simplify_tolerance, "simplify-tolerance", 0.0, "If greater than zero, the tolerance used to simplify geometries before they are indexed. For the douglas-peucker algorithm this is a distance in decimal degrees and for the visvalingam algorithm it is an area in square decimal degrees. The 'rtree' table always indexes the original geometries.")
+	fs.StringVar(&simplify_algorithm, "simplify-algorithm", "douglas-peucker", "The algorithm used to simplify geometries when the -simplify-tolerance flag is set. Valid options are: douglas-peucker, visvalingam.")
+	fs.IntVar(&coordinate_precision, "coordinate-precision", 0, "If greater than zero, the number of decimal places to round coordinates to before they are indexed. The 'rtree' table always indexes the original geometries.")
+	fs.Var(&transformer_uris, "transformer-uri", fmt.Sprintf("Zero or more index.RecordTransformer URIs used to transform records before they are indexed. Transformers are applied in the order they are specified, after the -include-property, -exclude-property, -simplify-tolerance and -coordinate-precision flags. Valid schemes are: %s", strings.Join(index.RecordTransformerSchemes(), ", ")))
+	fs.Var(&exclude_properties, "exclude-property", "Zero or more dot-separated property paths, which may contain '*' wildcards (for example 'edtf:*', 'name:*_x_variant' or 'wof:concordances.gn:id'), to remove before a record is indexed.")
+
+	fs.BoolVar(&validate, "validate", false, "Validate each record before it is indexed and print a summary of violations for each rule once indexing is complete.")
+	fs.StringVar(&validation_mode, "validate-mode", "warn", "What to do with records that fail validation. Valid options are: reject (stop indexing), warn (log the violations and index the record anyway) and quarantine (write the record to the 'quarantine' table instead of indexing it).")
+	fs.Var(&validation_rules, "validate-rule", "Zero or more validation rules to apply. Valid options are: placetype, repo, parent, edtf, rings. If empty all the rules are applied.")
+
+	fs.BoolVar(&continue_on_error, "continue-on-error", false, "Write records that fail to be loaded or indexed to the 'index_errors' table rather than stopping indexing.")
+	fs.Int64Var(&error_threshold, "error-threshold", 0, "The maximum number of records that may fail to be loaded or indexed, when the -continue-on-error flag is set, before the application exits with an error.")
+
+	fs.IntVar(&batch_size, "batch-size", 0, "The maximum number of records to index, across all tables, in a single transaction. If zero each table commits each record in its own transaction. Batching records makes indexing practical when the -live-hard-die-fast flag (or the bulk-build pragma profile) is not used.")
+	fs.IntVar(&batch_interval, "batch-interval", 1000, "The maximum number of milliseconds to wait, after the first record in a transaction has been indexed, before committing the transaction when -batch-size is greater than zero. If zero transactions are only committed once -batch-size records have been indexed.")
 	fs.IntVar(&procs, "processes", (runtime.NumCPU() * 2), "The number of concurrent processes to index data with")
 
 	return fs
@@ -0,0 +1,345 @@
+package index
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"path/filepath"
+
+	"github.com/aaronland/go-sqlite/v2"
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/utils/merkletrie"
+	"github.com/whosonfirst/go-whosonfirst-feature/alt"
+	wof_properties "github.com/whosonfirst/go-whosonfirst-feature/properties"
+	"github.com/whosonfirst/go-whosonfirst-iterate/v2/emitter"
+	"github.com/whosonfirst/go-whosonfirst-iterate/v2/filters"
+	"github.com/whosonfirst/go-whosonfirst-sqlite-features-index/v2"
+)
+
+const git_diff_scheme string = "git-diff"
+
+func init() {
+	ctx := context.Background()
+	emitter.RegisterEmitter(ctx, git_diff_scheme, newGitDiffEmitter)
+}
+
+// gitDiffRemoval is a struct describing a Who's On First record that was removed between two commits.
+type gitDiffRemoval struct {
+	// Id is the Who's On First ID of the removed record.
+	Id int64
+	// AltLabel is the alternate geometry label of the removed record, or an empty string if it was not an alternate geometry.
+	AltLabel string
+}
+
+// gitDiff is a struct describing the Who's On First records that changed between two commits.
+type gitDiff struct {
+	// The (to) tree containing the records listed in `Updated`.
+	tree *object.Tree
+	// Updated is the list of relative paths for records that were added or modified.
+	Updated []string
+	// Removed is the list of records that were removed.
+	Removed []*gitDiffRemoval
+}
+
+// diffCommits returns a `gitDiff` instance describing the GeoJSON files that changed between the 'from' and 'to'
+// revisions in the Git repository at 'repo_path'. Revisions may be anything understood by `git rev-parse`
+// (commit hashes, branch names, tags, "HEAD~1", etc.)
+func diffCommits(ctx context.Context, repo_path string, from string, to string) (*gitDiff, error) {
+
+	repo, err := gogit.PlainOpen(repo_path)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open repository %s, %w", repo_path, err)
+	}
+
+	from_tree, err := revisionTree(repo, from)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to derive tree for '%s', %w", from, err)
+	}
+
+	to_tree, err := revisionTree(repo, to)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to derive tree for '%s', %w", to, err)
+	}
+
+	changes, err := object.DiffTreeContext(ctx, from_tree, to_tree)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to diff trees, %w", err)
+	}
+
+	d := &gitDiff{
+		tree:    to_tree,
+		Updated: make([]string, 0),
+		Removed: make([]*gitDiffRemoval, 0),
+	}
+
+	for _, ch := range changes {
+
+		action, err := ch.Action()
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to derive action for change, %w", err)
+		}
+
+		switch action {
+		case merkletrie.Insert, merkletrie.Modify:
+
+			if filepath.Ext(ch.To.Name) != ".geojson" {
+				continue
+			}
+
+			d.Updated = append(d.Updated, ch.To.Name)
+
+		case merkletrie.Delete:
+
+			if filepath.Ext(ch.From.Name) != ".geojson" {
+				continue
+			}
+
+			body, err := readTreeFile(from_tree, ch.From.Name)
+
+			if err != nil {
+				return nil, fmt.Errorf("Failed to read removed file %s, %w", ch.From.Name, err)
+			}
+
+			id, err := wof_properties.Id(body)
+
+			if err != nil {
+				return nil, fmt.Errorf("Failed to derive wof:id for removed file %s, %w", ch.From.Name, err)
+			}
+
+			r := &gitDiffRemoval{
+				Id: id,
+			}
+
+			if alt.IsAlt(body) {
+
+				alt_label, err := wof_properties.AltLabel(body)
+
+				if err != nil {
+					return nil, fmt.Errorf("Failed to derive alt label for removed file %s, %w", ch.From.Name, err)
+				}
+
+				r.AltLabel = alt_label
+			}
+
+			d.Removed = append(d.Removed, r)
+		}
+	}
+
+	return d, nil
+}
+
+// revisionTree returns the tree for the commit associated with 'rev' in 'repo'.
+func revisionTree(repo *gogit.Repository, rev string) (*object.Tree, error) {
+
+	hash, err := repo.ResolveRevision(plumbing.Revision(rev))
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to resolve revision, %w", err)
+	}
+
+	commit, err := repo.CommitObject(*hash)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to derive commit, %w", err)
+	}
+
+	return commit.Tree()
+}
+
+// readTreeFile returns the contents of the file at 'path' in 'tree'.
+func readTreeFile(tree *object.Tree, path string) ([]byte, error) {
+
+	f, err := tree.File(path)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to find file, %w", err)
+	}
+
+	r, err := f.Reader()
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create reader, %w", err)
+	}
+
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+// gitDiffEmitter implements the `whosonfirst/go-whosonfirst-iterate/v2/emitter.Emitter` interface for crawling
+// the records that were added or modified between two commits in a local Git repository.
+type gitDiffEmitter struct {
+	from    string
+	to      string
+	filters filters.Filters
+}
+
+// newGitDiffEmitter returns a new `gitDiffEmitter` instance configured by 'uri' in the form of:
+//
+//	git-diff://?from={REVISION}&to={REVISION}&{PARAMETERS}
+//
+// Where {PARAMETERS} may be any of the query filter parameters supported by the `directory://` emitter.
+// If the `to` parameter is empty it defaults to "HEAD".
+func newGitDiffEmitter(ctx context.Context, uri string) (emitter.Emitter, error) {
+
+	u, err := url.Parse(uri)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse URI, %w", err)
+	}
+
+	q := u.Query()
+
+	f, err := filters.NewQueryFiltersFromQuery(ctx, q)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create query filters, %w", err)
+	}
+
+	em := &gitDiffEmitter{
+		from:    q.Get("from"),
+		to:      q.Get("to"),
+		filters: f,
+	}
+
+	if em.from == "" {
+		return nil, fmt.Errorf("Missing ?from= parameter")
+	}
+
+	if em.to == "" {
+		em.to = "HEAD"
+	}
+
+	return em, nil
+}
+
+// WalkURI() emits the records that were added or modified between the emitter's 'from' and 'to' revisions in the local
+// Git repository at 'uri'. Records are read from the 'to' revision rather than the working tree.
+func (em *gitDiffEmitter) WalkURI(ctx context.Context, index_cb emitter.EmitterCallbackFunc, uri string) error {
+
+	d, err := diffCommits(ctx, uri, em.from, em.to)
+
+	if err != nil {
+		return fmt.Errorf("Failed to diff commits, %w", err)
+	}
+
+	for _, path := range d.Updated {
+
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+			// pass
+		}
+
+		body, err := readTreeFile(d.tree, path)
+
+		if err != nil {
+			return fmt.Errorf("Failed to read %s, %w", path, err)
+		}
+
+		fh := bytes.NewReader(body)
+
+		if em.filters != nil {
+
+			ok, err := em.filters.Apply(ctx, fh)
+
+			if err != nil {
+				return fmt.Errorf("Failed to apply query filters to %s, %w", path, err)
+			}
+
+			if !ok {
+				continue
+			}
+
+			_, err = fh.Seek(0, 0)
+
+			if err != nil {
+				return fmt.Errorf("Failed to reset filehandle for %s, %w", path, err)
+			}
+		}
+
+		err = index_cb(ctx, filepath.Join(uri, path), fh)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// gitDiffIteratorURI returns a `git-diff://` iterator URI for the 'from' and 'to' revisions which preserves any
+// query filters defined in 'iterator_uri'.
+func gitDiffIteratorURI(iterator_uri string, from string, to string) (string, error) {
+
+	u, err := url.Parse(iterator_uri)
+
+	if err != nil {
+		return "", fmt.Errorf("Failed to parse iterator URI, %w", err)
+	}
+
+	q := u.Query()
+	q.Set("from", from)
+	q.Set("to", to)
+
+	diff_u := url.URL{
+		Scheme:   git_diff_scheme,
+		RawQuery: q.Encode(),
+	}
+
+	return diff_u.String(), nil
+}
+
+// removeGitDiffRecords removes the records that were deleted between the 'from' and 'to' revisions in each of the
+// local Git repositories in 'repos' from 'tables'.
+func removeGitDiffRecords(ctx context.Context, db sqlite.Database, tables []sqlite.Table, repos []string, from string, to string, logger *log.Logger) error {
+
+	db.Lock(ctx)
+	defer db.Unlock(ctx)
+
+	for _, repo := range repos {
+
+		d, err := diffCommits(ctx, repo, from, to)
+
+		if err != nil {
+			return fmt.Errorf("Failed to diff commits for %s, %w", repo, err)
+		}
+
+		ids := make([]int64, 0)
+
+		for _, r := range d.Removed {
+
+			if r.AltLabel == "" {
+				ids = append(ids, r.Id)
+				continue
+			}
+
+			err := index.RemoveAltFeature(ctx, db, tables, r.Id, r.AltLabel)
+
+			if err != nil {
+				return fmt.Errorf("Failed to remove alt feature %d (%s), %w", r.Id, r.AltLabel, err)
+			}
+		}
+
+		err = index.RemoveFeatures(ctx, db, tables, ids)
+
+		if err != nil {
+			return fmt.Errorf("Failed to remove features, %w", err)
+		}
+
+		logger.Printf("Removed %d records deleted between %s and %s in %s", len(d.Removed), from, to, repo)
+	}
+
+	return nil
+}
@@ -0,0 +1,202 @@
+package index
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/aaronland/go-sqlite/v2"
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+// flagValues returns a map of the flags in 'fs' that have been explicitly set and their values.
+func flagValues(fs *flag.FlagSet) map[string]string {
+
+	values := make(map[string]string)
+
+	fs.Visit(func(f *flag.Flag) {
+		values[f.Name] = f.Value.String()
+	})
+
+	return values
+}
+
+// sourceCommits returns a map of the elements in 'uris' and the commit hash of the revision that will be indexed for each
+// one, as determined by 'iterator_uri'. For "git://" iterators this is the commit at the tip of the remote repository's
+// default (or ?branch=) branch; for "git-diff://" iterators it is the ?to= revision of each local repository; and for all
+// other iterators it is the commit hash of HEAD for local Git repositories. Sources whose commit can not be resolved are ignored.
+func sourceCommits(ctx context.Context, iterator_uri string, uris []string) map[string]string {
+
+	u, err := url.Parse(iterator_uri)
+
+	if err != nil {
+		return gitCommits(uris)
+	}
+
+	q := u.Query()
+
+	switch u.Scheme {
+	case "git":
+		return remoteGitCommits(ctx, uris, q.Get("branch"))
+	case git_diff_scheme:
+
+		to := q.Get("to")
+
+		if to == "" {
+			to = "HEAD"
+		}
+
+		return revisionCommits(uris, to)
+
+	default:
+		return gitCommits(uris)
+	}
+}
+
+// remoteGitCommits returns a map of the elements in 'uris' which are remote Git repositories and the commit hash at the
+// tip of 'branch' or, if empty, the repository's default branch (HEAD). Anything else is ignored.
+func remoteGitCommits(ctx context.Context, uris []string, branch string) map[string]string {
+
+	commits := make(map[string]string)
+
+	ref_name := plumbing.HEAD
+
+	if branch != "" {
+		ref_name = plumbing.NewBranchReferenceName(branch)
+	}
+
+	for _, uri := range uris {
+
+		remote := gogit.NewRemote(memory.NewStorage(), &config.RemoteConfig{
+			Name: gogit.DefaultRemoteName,
+			URLs: []string{uri},
+		})
+
+		refs, err := remote.ListContext(ctx, &gogit.ListOptions{})
+
+		if err != nil {
+			continue
+		}
+
+		resolved := make(map[plumbing.ReferenceName]*plumbing.Reference)
+
+		for _, ref := range refs {
+			resolved[ref.Name()] = ref
+		}
+
+		ref, ok := resolved[ref_name]
+
+		// HEAD is usually advertised as a symbolic reference to the default branch
+
+		if ok && ref.Type() == plumbing.SymbolicReference {
+			ref, ok = resolved[ref.Target()]
+		}
+
+		if !ok || ref.Hash().IsZero() {
+			continue
+		}
+
+		commits[uri] = ref.Hash().String()
+	}
+
+	return commits
+}
+
+// revisionCommits returns a map of the elements in 'uris' which are local Git repositories and the commit hash that
+// 'rev' resolves to in each one. Anything else is ignored.
+func revisionCommits(uris []string, rev string) map[string]string {
+
+	commits := make(map[string]string)
+
+	for _, uri := range uris {
+
+		repo, err := gogit.PlainOpen(uri)
+
+		if err != nil {
+			continue
+		}
+
+		hash, err := repo.ResolveRevision(plumbing.Revision(rev))
+
+		if err != nil {
+			continue
+		}
+
+		commits[uri] = hash.String()
+	}
+
+	return commits
+}
+
+// gitCommits returns a map of the elements in 'uris' which are (local) Git repositories, or directories inside a
+// Git repository, and the commit hash of their HEAD. Anything else is ignored.
+func gitCommits(uris []string) map[string]string {
+
+	commits := make(map[string]string)
+
+	for _, uri := range uris {
+
+		abs_path, err := filepath.Abs(uri)
+
+		if err != nil {
+			continue
+		}
+
+		info, err := os.Stat(abs_path)
+
+		if err != nil || !info.IsDir() {
+			continue
+		}
+
+		repo, err := gogit.PlainOpenWithOptions(abs_path, &gogit.PlainOpenOptions{DetectDotGit: true})
+
+		if err != nil {
+			continue
+		}
+
+		head, err := repo.Head()
+
+		if err != nil {
+			continue
+		}
+
+		commits[uri] = head.Hash().String()
+	}
+
+	return commits
+}
+
+// countTableRecords returns a map of the names of 'tables' and the number of rows in each table in 'db'.
+func countTableRecords(ctx context.Context, db sqlite.Database, tables []sqlite.Table) (map[string]int64, error) {
+
+	counts := make(map[string]int64)
+
+	conn, err := db.Conn(ctx)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to establish database connection, %w", err)
+	}
+
+	for _, t := range tables {
+
+		var count int64
+
+		q := fmt.Sprintf("SELECT COUNT(*) FROM %s", t.Name())
+
+		err := conn.QueryRowContext(ctx, q).Scan(&count)
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to count rows in %s table, %w", t.Name(), err)
+		}
+
+		counts[t.Name()] = count
+	}
+
+	return counts, nil
+}
@@ -0,0 +1,254 @@
+package index
+
+import (
+	"flag"
+)
+
+// RunOptions is a struct containing configuration options for indexing Who's On First records
+// in a SQLite database using the `RunWithOptions` method.
+type RunOptions struct {
+	// IteratorURI is a valid whosonfirst/go-whosonfirst-iterate/v2 URI.
+	IteratorURI string
+	// URIs is the list of URIs to be processed by the iterator defined by `IteratorURI`.
+	URIs []string
+	// DatabaseURI is a valid aaronland/go-sqlite/v2 database URI.
+	DatabaseURI string
+	// All is a boolean flag indicating whether to index all tables (except the 'search' and 'geometries' tables).
+	All bool
+	// Ancestors is a boolean flag indicating whether to index the 'ancestors' table.
+	Ancestors bool
+	// Concordances is a boolean flag indicating whether to index the 'concordances' table.
+	Concordances bool
+	// GeoJSON is a boolean flag indicating whether to index the 'geojson' table.
+	GeoJSON bool
+	// Geometries is a boolean flag indicating whether to index the 'geometries' table.
+	Geometries bool
+	// Names is a boolean flag indicating whether to index the 'names' table.
+	Names bool
+	// RTree is a boolean flag indicating whether to index the 'rtree' table.
+	RTree bool
+	// Properties is a boolean flag indicating whether to index the 'properties' table.
+	Properties bool
+	// Search is a boolean flag indicating whether to index the 'search' table.
+	Search bool
+	// SPR is a boolean flag indicating whether to index the 'spr' table.
+	SPR bool
+	// Supersedes is a boolean flag indicating whether to index the 'supersedes' table.
+	Supersedes bool
+	// SpatialTables is a boolean flag indicating whether to index the tables necessary for use with the whosonfirst/go-whosonfirst-spatial-sqlite package.
+	SpatialTables bool
+	// SpelunkerTables is a boolean flag indicating whether to index the tables necessary for use with the whosonfirst/go-whosonfirst-spelunker packages.
+	SpelunkerTables bool
+	// LiveHardDieFast is a boolean flag indicating whether to enable various performance-related pragmas at the expense of possible (unlikely) database corruption.
+	LiveHardDieFast bool
+	// PragmaProfile is the name of a pragma profile (bulk-build, safe-update or serve) to apply to the database. If not empty it takes precedence over `LiveHardDieFast`.
+	PragmaProfile string
+	// Pragmas is an optional list of "{KEY}={VALUE}" pragmas which replace, or are added to, those defined by `PragmaProfile`.
+	Pragmas []string
+	// Timings is a boolean flag indicating whether to display timings during and after indexing.
+	Timings bool
+	// Optimize is a boolean flag indicating whether to attempt to optimize the database before closing connection.
+	Optimize bool
+	// Atomic is a boolean flag indicating whether to index records in a temporary copy of the database, in the same directory, which only replaces the database once indexing has completed successfully and the copy has been optimized and has passed an integrity check.
+	Atomic bool
+	// IndexAltFiles is a boolean flag indicating whether to index alt geometries in all the applicable tables. Deprecated, use `IndexAlt` instead.
+	IndexAltFiles bool
+	// StrictAltFiles is a boolean flag indicating whether to be strict when indexing alt geometries.
+	StrictAltFiles bool
+	// IndexAlt is a list of zero or more table names where alt geometry files should be indexed. Use "*" to index alt geometries in all the applicable tables.
+	IndexAlt []string
+	// IndexRelations is a boolean flag indicating whether to index the records related to a feature (wof:belongsto, wof:depicts and wof:involves).
+	IndexRelations bool
+	// RelationsReaderURIs is an ordered list of valid whosonfirst/go-reader URIs from which to read data for a relations candidate.
+	// Each reader is tried in turn until one is able to read a relation.
+	RelationsReaderURIs []string
+	// RelationsCacheDir is an optional path to a local directory used to cache the records read by HTTP(S) relations readers.
+	// Cached records are revalidated using their ETag and Last-Modified headers and used as-is if the reader's endpoint can not be reached
+	// or returns a server error.
+	RelationsCacheDir string
+	// RelationsCacheMaxAge is the number of seconds that records cached in `RelationsCacheDir` are used as-is, after they were last fetched
+	// or revalidated, before they are revalidated. If zero cached records are revalidated every time they are read.
+	RelationsCacheMaxAge int
+	// RelationsProperties is a list of zero or more gjson paths used to derive the IDs of a feature's relations. If empty the default
+	// properties (wof:belongsto, wof:involves and wof:depicts) are used.
+	RelationsProperties []string
+	// RelationsMaxDepth is the maximum number of levels of relations to index. Values less than or equal to 1 will only index a feature's direct relations.
+	RelationsMaxDepth int
+	// RelationsAltLabels is a list of zero or more alt geometry labels to look for when indexing the alt files for relations, in addition
+	// to those listed in a relation's src:geom_alt property. Alt files for relations are only indexed if `IndexAltFiles` or `IndexAlt` are set.
+	RelationsAltLabels []string
+	// RelationsWorkers is the number of relations to read concurrently. If zero the number of CPUs is used.
+	RelationsWorkers int
+	// RelationsBatchSize is the number of relations to write in a single transaction. If zero each table commits each relation
+	// in its own transaction.
+	RelationsBatchSize int
+	// RelationsReport is an optional path to a file where the relations that could not be read or parsed, and the records that
+	// reference them, will be written. If the path has a ".csv" extension the report is written as CSV, otherwise as JSON.
+	RelationsReport string
+	// Incremental is a boolean flag indicating whether to skip records that are already present, and unchanged, in the database.
+	Incremental bool
+	// Sync is a boolean flag indicating whether to remove records (from all the tables being indexed) whose wof:id was not encountered during iteration.
+	Sync bool
+	// SyncDryRun is a boolean flag indicating whether to only log the records that would be removed by `Sync`.
+	SyncDryRun bool
+	// SyncForce is a boolean flag indicating whether `Sync` should remove records even if no records were encountered
+	// during iteration or some records failed to be loaded or indexed (when `ContinueOnError` is true).
+	SyncForce bool
+	// GitDiffFrom is an optional Git revision. If not empty each of `URIs` is treated as a local Git repository and only the records
+	// added or modified between `GitDiffFrom` and `GitDiffTo` are indexed. Records deleted between the two revisions are removed from
+	// all the tables being indexed.
+	GitDiffFrom string
+	// GitDiffTo is the Git revision to compare against `GitDiffFrom`. If empty it defaults to "HEAD".
+	GitDiffTo string
+	// Tables is a list of zero or more table names, registered using the `index.RegisterTable` method, to index in addition to those enabled by the boolean table flags.
+	Tables []string
+	// IncludePlacetypes is a list of zero or more placetypes. If not empty only records with one of these placetypes are indexed. Filters are not applied to relations.
+	IncludePlacetypes []string
+	// ExcludePlacetypes is a list of zero or more placetypes. Records with one of these placetypes are not indexed.
+	ExcludePlacetypes []string
+	// IsCurrent is a list of zero or more existential flag values (1, 0 or -1). If not empty only records whose "is current" flag matches one of these values are indexed.
+	IsCurrent []int64
+	// IsDeprecated is a list of zero or more existential flag values (1, 0 or -1). If not empty only records whose "is deprecated" flag matches one of these values are indexed.
+	IsDeprecated []int64
+	// IsCeased is a list of zero or more existential flag values (1, 0 or -1). If not empty only records whose "is ceased" flag matches one of these values are indexed.
+	IsCeased []int64
+	// IsSuperseded is a list of zero or more existential flag values (1, 0 or -1). If not empty only records whose "is superseded" flag matches one of these values are indexed.
+	IsSuperseded []int64
+	// IncludeRepos is a list of zero or more wof:repo values. If not empty only records from one of these repos are indexed.
+	IncludeRepos []string
+	// Filters is a list of zero or more "{PATH}={REGULAR_EXPRESSION}" or "{PATH}!={REGULAR_EXPRESSION}" property filters that records must match in order to be indexed.
+	Filters []string
+	// IntersectsBbox is an optional "{MINX},{MINY},{MAXX},{MAXY}" bounding box. If not empty only records whose geometry intersects it are indexed.
+	IntersectsBbox string
+	// IntersectsGeoJSON is the optional path to a GeoJSON (multi) polygon geometry, Feature or FeatureCollection. If not empty only records whose geometry intersects it are indexed.
+	IntersectsGeoJSON string
+	// FilterMode defines whether records must match all ("AND") or any ("OR") of Filters. If empty "AND" is used.
+	FilterMode string
+	// IncludeProperties is a list of zero or more property names, which may contain "*" wildcards. If not empty all other properties, except those needed to index a record, are removed before a record is indexed.
+	IncludeProperties []string
+	// ExcludeProperties is a list of zero or more dot-separated property paths, which may contain "*" wildcards, to remove before a record is indexed.
+	ExcludeProperties []string
+	// SimplifyTolerance is the tolerance used to simplify geometries before they are indexed: a distance, in decimal degrees, for the "douglas-peucker" algorithm or an area, in square decimal degrees, for the "visvalingam" algorithm. If zero geometries are not simplified. The 'rtree' table always indexes the original geometries.
+	SimplifyTolerance float64
+	// SimplifyAlgorithm is the algorithm used to simplify geometries: "douglas-peucker" or "visvalingam". If empty "douglas-peucker" is used.
+	SimplifyAlgorithm string
+	// CoordinatePrecision is the number of decimal places to round coordinates to before they are indexed. If zero coordinates are not rounded. The 'rtree' table always indexes the original geometries.
+	CoordinatePrecision int
+	// TransformerURIs is a list of zero or more `index.RecordTransformer` URIs. Transformers are applied, in order, after the transforms defined by IncludeProperties, ExcludeProperties, SimplifyTolerance and CoordinatePrecision.
+	TransformerURIs []string
+	// Validate is a boolean flag indicating whether to validate each record, using `ValidationRules`, before it is indexed.
+	Validate bool
+	// ValidationMode defines what happens to records that fail validation: "reject", "warn" or "quarantine". If empty "warn" is used.
+	ValidationMode string
+	// ValidationRules is a list of zero or more names of the validation rules to apply. If empty all the default rules are applied.
+	ValidationRules []string
+	// ContinueOnError is a boolean flag indicating whether records that fail to be loaded or indexed should be written to the
+	// 'index_errors' table, rather than stopping indexing.
+	ContinueOnError bool
+	// ErrorThreshold is the maximum number of records that may fail to be loaded or indexed, when `ContinueOnError` is true,
+	// before `RunWithOptions` returns an error. Indexing is not stopped when the threshold is exceeded.
+	ErrorThreshold int64
+	// Processes is the number of concurrent processes to index data with. It is passed to the iterator as its "_max_procs" parameter,
+	// unless `IteratorURI` already defines one, and used as the number of workers when indexing a shard database. If zero the iterator's
+	// default is used.
+	Processes int
+	// BatchSize is the maximum number of records to index, across all tables, in a single transaction. If zero each table
+	// commits each record in its own transaction.
+	BatchSize int
+	// BatchInterval is the maximum number of milliseconds to wait, after the first record in a transaction has been indexed,
+	// before committing the transaction when `BatchSize` is greater than zero. If zero transactions are only committed once
+	// `BatchSize` records have been indexed.
+	BatchInterval int
+	// Flags is an optional map of the command line flags, and their values, used to derive these options. It is recorded,
+	// along with other details about the run, in the `index.INDEX_META_TABLE_NAME` table.
+	Flags map[string]string
+	// ShardBy is an optional sharding rule used to route records to different databases in a single pass. Valid options are
+	// "repo", "placetype", "country" or a gjson path (for example "properties.wof:belongsto.0"). If not empty `DatabaseURI` is
+	// expected to be a template containing a "{shard}" placeholder (or "{repo}", "{placetype}" or "{country}" for the named rules).
+	ShardBy string
+	// shard is the shard value of the records being indexed when indexing a single shard database.
+	shard string
+	// records is the channel of records to index, instead of iterating over `URIs`, when indexing a single shard database.
+	records chan *shardRecord
+	// commits is the map of sources and the commit hash of the revision being indexed, resolved (once) by `runSharded`
+	// before any shard databases are indexed. If nil it is resolved by `RunWithOptions`.
+	commits map[string]string
+}
+
+// RunOptionsFromFlagSet returns a new `RunOptions` instance derived from the (parsed) flags in 'fs'.
+func RunOptionsFromFlagSet(fs *flag.FlagSet) (*RunOptions, error) {
+
+	opts := &RunOptions{
+		IteratorURI:          iterator_uri,
+		URIs:                 fs.Args(),
+		DatabaseURI:          db_uri,
+		All:                  all,
+		Ancestors:            ancestors,
+		Concordances:         concordances,
+		GeoJSON:              geojson,
+		Geometries:           geometries,
+		Names:                names,
+		RTree:                rtree,
+		Properties:           properties,
+		Search:               search,
+		SPR:                  spr,
+		Supersedes:           supersedes,
+		SpatialTables:        spatial_tables,
+		SpelunkerTables:      spelunker_tables,
+		LiveHardDieFast:      live_hard,
+		PragmaProfile:        pragma_profile,
+		Pragmas:              pragmas,
+		Timings:              timings,
+		Optimize:             optimize,
+		Atomic:               atomic_mode,
+		IndexAltFiles:        alt_files,
+		StrictAltFiles:       strict_alt_files,
+		IndexAlt:             index_alt,
+		IndexRelations:       index_relations,
+		RelationsReaderURIs:  relations_uris,
+		RelationsCacheDir:    relations_cache_dir,
+		RelationsCacheMaxAge: relations_cache_max_age,
+		RelationsProperties:  relations_properties,
+		RelationsMaxDepth:    relations_max_depth,
+		RelationsAltLabels:   relations_alt_labels,
+		RelationsWorkers:     relations_workers,
+		RelationsBatchSize:   relations_batch_size,
+		RelationsReport:      relations_report,
+		Incremental:          incremental,
+		Sync:                 sync_db || sync_dry_run,
+		SyncDryRun:           sync_dry_run,
+		SyncForce:            sync_force,
+		GitDiffFrom:          git_diff_from,
+		GitDiffTo:            git_diff_to,
+		Tables:               extra_tables,
+		IncludePlacetypes:    include_placetypes,
+		ExcludePlacetypes:    exclude_placetypes,
+		IsCurrent:            is_current,
+		IsDeprecated:         is_deprecated,
+		IsCeased:             is_ceased,
+		IsSuperseded:         is_superseded,
+		IncludeRepos:         include_repos,
+		Filters:              property_filters,
+		FilterMode:           filter_mode,
+		IntersectsBbox:       intersects_bbox,
+		IntersectsGeoJSON:    intersects_geojson,
+		IncludeProperties:    include_properties,
+		ExcludeProperties:    exclude_properties,
+		SimplifyTolerance:    simplify_tolerance,
+		SimplifyAlgorithm:    simplify_algorithm,
+		CoordinatePrecision:  coordinate_precision,
+		TransformerURIs:      transformer_uris,
+		Validate:             validate,
+		ValidationMode:       validation_mode,
+		ValidationRules:      validation_rules,
+		ContinueOnError:      continue_on_error,
+		ErrorThreshold:       error_threshold,
+		Processes:            procs,
+		BatchSize:            batch_size,
+		BatchInterval:        batch_interval,
+		ShardBy:              shard_by,
+		Flags:                flagValues(fs),
+	}
+
+	return opts, nil
+}
@@ -0,0 +1,246 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/aaronland/go-sqlite/v2"
+)
+
+const (
+	// PRAGMA_PROFILE_BULK_BUILD is the name of the pragma profile for building new databases as quickly as possible at the
+	// expense of possible (unlikely) database corruption. It is the profile used by the -live-hard-die-fast flag.
+	PRAGMA_PROFILE_BULK_BUILD string = "bulk-build"
+	// PRAGMA_PROFILE_SAFE_UPDATE is the name of the pragma profile for updating existing databases in place while they
+	// are being read by other processes.
+	PRAGMA_PROFILE_SAFE_UPDATE string = "safe-update"
+	// PRAGMA_PROFILE_SERVE is the name of the pragma profile for databases which are being served, and read concurrently,
+	// while they are being updated.
+	PRAGMA_PROFILE_SERVE string = "serve"
+)
+
+// pragma_dsn_scheme is the database URI scheme for the (modernc.org/sqlite) driver which supports "_pragma" query parameters.
+const pragma_dsn_scheme string = "modernc"
+
+var re_pragma_key = regexp.MustCompile(`^[a-z_]+$`)
+
+var re_pragma_value = regexp.MustCompile(`^\-?[A-Za-z0-9_]+$`)
+
+// Pragma is a struct describing a SQLite PRAGMA statement.
+type Pragma struct {
+	// Key is the (lower-cased) name of the pragma.
+	Key string
+	// Value is the value of the pragma.
+	Value string
+}
+
+// String returns the SQL statement for the pragma.
+func (p *Pragma) String() string {
+	return fmt.Sprintf("PRAGMA %s=%s", p.Key, p.Value)
+}
+
+// NewPragma returns a new `Pragma` instance derived from 'str' which is expected to take the form of "{KEY}={VALUE}".
+func NewPragma(str string) (*Pragma, error) {
+
+	k, v, ok := strings.Cut(str, "=")
+
+	if !ok {
+		return nil, fmt.Errorf("Invalid pragma '%s', expected KEY=VALUE", str)
+	}
+
+	k = strings.ToLower(strings.TrimSpace(k))
+	v = strings.TrimSpace(v)
+
+	if !re_pragma_key.MatchString(k) {
+		return nil, fmt.Errorf("Invalid pragma key '%s'", k)
+	}
+
+	if !re_pragma_value.MatchString(v) {
+		return nil, fmt.Errorf("Invalid pragma value '%s'", v)
+	}
+
+	p := &Pragma{
+		Key:   k,
+		Value: v,
+	}
+
+	return p, nil
+}
+
+// PragmaProfiles returns the list of valid pragma profile names.
+func PragmaProfiles() []string {
+	return []string{PRAGMA_PROFILE_BULK_BUILD, PRAGMA_PROFILE_SAFE_UPDATE, PRAGMA_PROFILE_SERVE}
+}
+
+// PragmaProfile returns the (ordered) list of `Pragma` instances for the profile 'name'.
+func PragmaProfile(name string) ([]*Pragma, error) {
+
+	var pragmas []string
+
+	// Note that page_size needs to be set before journal_mode=WAL since the page size
+	// of a WAL database can not be changed.
+
+	switch name {
+	case PRAGMA_PROFILE_BULK_BUILD:
+
+		// These are the same pragmas, in the same order, set by aaronland/go-sqlite's
+		// LiveHardDieFast function which the -live-hard-die-fast flag has always used.
+
+		pragmas = []string{
+			"journal_mode=OFF",
+			"synchronous=OFF",
+			"locking_mode=EXCLUSIVE",
+			// https://www.gaia-gis.it/gaia-sins/spatialite-cookbook/html/system.html
+			"page_size=4096",
+			"cache_size=1000000",
+		}
+
+	case PRAGMA_PROFILE_SAFE_UPDATE:
+
+		pragmas = []string{
+			"page_size=4096",
+			"journal_mode=WAL",
+			"synchronous=NORMAL",
+			"busy_timeout=5000",
+			// 64MB
+			"cache_size=-64000",
+			"temp_store=MEMORY",
+		}
+
+	case PRAGMA_PROFILE_SERVE:
+
+		pragmas = []string{
+			"page_size=4096",
+			"journal_mode=WAL",
+			"synchronous=NORMAL",
+			"busy_timeout=5000",
+			// 64MB
+			"cache_size=-64000",
+			// 256MB
+			"mmap_size=268435456",
+			"temp_store=MEMORY",
+		}
+
+	default:
+		return nil, fmt.Errorf("Invalid pragma profile '%s'", name)
+	}
+
+	profile := make([]*Pragma, len(pragmas))
+
+	for i, str := range pragmas {
+
+		p, err := NewPragma(str)
+
+		if err != nil {
+			return nil, err
+		}
+
+		profile[i] = p
+	}
+
+	return profile, nil
+}
+
+// derivePragmas returns the list of `Pragma` instances for the profile 'name', if not empty, with the "{KEY}={VALUE}"
+// strings in 'overrides' replacing, or appended to, the pragmas in that profile.
+func derivePragmas(name string, overrides []string) ([]*Pragma, error) {
+
+	pragmas := make([]*Pragma, 0)
+
+	if name != "" {
+
+		profile, err := PragmaProfile(name)
+
+		if err != nil {
+			return nil, err
+		}
+
+		pragmas = profile
+	}
+
+	for _, str := range overrides {
+
+		p, err := NewPragma(str)
+
+		if err != nil {
+			return nil, err
+		}
+
+		idx := slices.IndexFunc(pragmas, func(existing *Pragma) bool {
+			return existing.Key == p.Key
+		})
+
+		if idx == -1 {
+			pragmas = append(pragmas, p)
+		} else {
+			pragmas[idx] = p
+		}
+	}
+
+	return pragmas, nil
+}
+
+// databaseURIWithPragmas returns a copy of the database URI 'uri' with each of 'pragmas' appended, in order, as a "_pragma"
+// query parameter. Only the modernc.org/sqlite driver supports this parameter, which it uses to execute each pragma every
+// time it opens a new connection. That is necessary because most pragmas (synchronous, busy_timeout, cache_size, etc.)
+// only apply to the connection they are executed in and a `sql.DB` instance is a pool of connections.
+func databaseURIWithPragmas(uri string, pragmas []*Pragma) (string, error) {
+
+	u, err := url.Parse(uri)
+
+	if err != nil {
+		return "", fmt.Errorf("Failed to parse URI, %w", err)
+	}
+
+	q := u.Query()
+
+	for _, p := range pragmas {
+		q.Add("_pragma", fmt.Sprintf("%s(%s)", p.Key, p.Value))
+	}
+
+	u.RawQuery = q.Encode()
+
+	return u.String(), nil
+}
+
+// supportsDatabaseURIPragmas returns a boolean value indicating whether pragmas can be added to the database URI 'uri'
+// using the `databaseURIWithPragmas` function.
+func supportsDatabaseURIPragmas(uri string) bool {
+
+	u, err := url.Parse(uri)
+
+	if err != nil {
+		return false
+	}
+
+	return u.Scheme == pragma_dsn_scheme
+}
+
+// applyPragmas executes each of 'pragmas', in order, in 'db'. Since most pragmas only apply to the connection they are
+// executed in the maximum number of open connections for 'db' is set to one so that every query uses the connection the
+// pragmas were applied to. It is used for databases whose URI does not support pragmas (see `databaseURIWithPragmas`).
+func applyPragmas(ctx context.Context, db sqlite.Database, pragmas []*Pragma) error {
+
+	conn, err := db.Conn(ctx)
+
+	if err != nil {
+		return fmt.Errorf("Failed to establish database connection, %w", err)
+	}
+
+	conn.SetMaxOpenConns(1)
+
+	for _, p := range pragmas {
+
+		_, err = conn.ExecContext(ctx, p.String())
+
+		if err != nil {
+			return fmt.Errorf("Failed to set pragma '%s', %w", p, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,97 @@
+package index
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/whosonfirst/go-whosonfirst-iterate/v2/emitter"
+	"github.com/whosonfirst/go-whosonfirst-sqlite-features-index/v2"
+	sql_index "github.com/whosonfirst/go-whosonfirst-sqlite-index/v4"
+)
+
+const records_scheme string = "wof-sqlite-index-records"
+
+func init() {
+	ctx := context.Background()
+	emitter.RegisterEmitter(ctx, records_scheme, newRecordsEmitter)
+}
+
+// recordsSourceFunc is a function which emits records by invoking an `emitter.EmitterCallbackFunc` callback.
+type recordsSourceFunc func(context.Context, emitter.EmitterCallbackFunc) error
+
+// records_sources is a map of the keys assigned by `registerRecordsSource` and their `recordsSourceFunc` functions.
+var records_sources = new(sync.Map)
+
+// records_count is used to derive unique keys for `registerRecordsSource`.
+var records_count int64
+
+// registerRecordsSource registers 'fn' so that it can be used by a `recordsEmitter` and returns the iterator URI, and the
+// URI to walk, for emitting its records. The function returned should be invoked once the records have been emitted.
+//
+// This allows records which have already been read (for example, from a channel or a `index.PendingAlts` instance) to be
+// indexed using the same `sql_index.SQLiteIndexer` instance, and callback, as the records read from the sources being indexed.
+func registerRecordsSource(fn recordsSourceFunc) (string, string, func()) {
+
+	key := strconv.FormatInt(atomic.AddInt64(&records_count, 1), 10)
+	records_sources.Store(key, fn)
+
+	iterator_uri := fmt.Sprintf("%s://", records_scheme)
+
+	unregister := func() {
+		records_sources.Delete(key)
+	}
+
+	return iterator_uri, key, unregister
+}
+
+// recordsEmitter implements the `whosonfirst/go-whosonfirst-iterate/v2/emitter.Emitter` interface for emitting the records
+// of a `recordsSourceFunc` function registered by `registerRecordsSource`.
+type recordsEmitter struct{}
+
+// newRecordsEmitter returns a new `recordsEmitter` instance configured by 'uri' in the form of:
+//
+//	wof-sqlite-index-records://
+func newRecordsEmitter(ctx context.Context, uri string) (emitter.Emitter, error) {
+
+	_, err := url.Parse(uri)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse URI, %w", err)
+	}
+
+	em := &recordsEmitter{}
+	return em, nil
+}
+
+// WalkURI() emits the records of the `recordsSourceFunc` function registered with the key 'uri'.
+func (em *recordsEmitter) WalkURI(ctx context.Context, index_cb emitter.EmitterCallbackFunc, uri string) error {
+
+	v, ok := records_sources.Load(uri)
+
+	if !ok {
+		return fmt.Errorf("No records registered for '%s'", uri)
+	}
+
+	return v.(recordsSourceFunc)(ctx, index_cb)
+}
+
+// indexPendingAlts indexes the alternate geometry files in 'pending' using 'idx'. Each file is included, or excluded, with
+// its principal record which will have been filtered by now.
+func indexPendingAlts(ctx context.Context, idx *sql_index.SQLiteIndexer, pending *index.PendingAlts) error {
+
+	iterator_uri, key, unregister := registerRecordsSource(func(ctx context.Context, index_cb emitter.EmitterCallbackFunc) error {
+
+		return pending.Replay(func(path string, body []byte) error {
+			return index_cb(ctx, path, bytes.NewReader(body))
+		})
+	})
+
+	defer unregister()
+
+	return idx.IndexURIs(ctx, iterator_uri, key)
+}
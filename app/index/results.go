@@ -0,0 +1,90 @@
+package index
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/whosonfirst/go-whosonfirst-sqlite-features-index/v2"
+)
+
+// RunResults is a struct containing details about a completed run.
+type RunResults struct {
+	// UnresolvedRelations is the list of relations that could not be read or parsed, and the records that reference them.
+	UnresolvedRelations []*index.UnresolvedRelation
+	// ValidationViolations is a map of validation rule names and the number of records that violated them.
+	ValidationViolations map[string]int64
+	// IndexErrors is the number of records that failed to be loaded or indexed when `RunOptions.ContinueOnError` is true.
+	IndexErrors int64
+	// Shards is a map of shard values and the URIs of the databases their records were indexed in, when `RunOptions.ShardBy` is set.
+	Shards map[string]string
+}
+
+// writeRelationsReport writes 'relations' to 'path' as CSV, if 'path' has a ".csv" extension, or JSON otherwise.
+func writeRelationsReport(path string, relations []*index.UnresolvedRelation) error {
+
+	fh, err := os.Create(path)
+
+	if err != nil {
+		return fmt.Errorf("Failed to create %s, %w", path, err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		err = writeRelationsReportCSV(fh, relations)
+	default:
+
+		enc := json.NewEncoder(fh)
+		enc.SetIndent("", "  ")
+
+		err = enc.Encode(relations)
+	}
+
+	if err != nil {
+		fh.Close()
+		return fmt.Errorf("Failed to write %s, %w", path, err)
+	}
+
+	return fh.Close()
+}
+
+// writeRelationsReportCSV writes 'relations' to 'fh' as CSV with one row per relation. The IDs of the records
+// referencing a relation are separated by semi-colons.
+func writeRelationsReportCSV(fh *os.File, relations []*index.UnresolvedRelation) error {
+
+	wr := csv.NewWriter(fh)
+
+	err := wr.Write([]string{"id", "referenced_by", "error"})
+
+	if err != nil {
+		return err
+	}
+
+	for _, rel := range relations {
+
+		referenced_by := make([]string, len(rel.ReferencedBy))
+
+		for i, id := range rel.ReferencedBy {
+			referenced_by[i] = strconv.FormatInt(id, 10)
+		}
+
+		row := []string{
+			strconv.FormatInt(rel.Id, 10),
+			strings.Join(referenced_by, ";"),
+			rel.Error,
+		}
+
+		err := wr.Write(row)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	wr.Flush()
+	return wr.Error()
+}
@@ -0,0 +1,451 @@
+package index
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/tidwall/gjson"
+	wof_properties "github.com/whosonfirst/go-whosonfirst-feature/properties"
+	"github.com/whosonfirst/go-whosonfirst-iterate/v2/emitter"
+	"github.com/whosonfirst/go-whosonfirst-iterate/v2/iterator"
+	"github.com/whosonfirst/go-whosonfirst-sqlite-features-index/v2"
+	sql_index "github.com/whosonfirst/go-whosonfirst-sqlite-index/v4"
+	"github.com/whosonfirst/go-whosonfirst-uri"
+)
+
+const (
+	// SHARD_BY_REPO is the sharding rule for routing records to databases by their `wof:repo` property.
+	SHARD_BY_REPO string = "repo"
+	// SHARD_BY_PLACETYPE is the sharding rule for routing records to databases by their `wof:placetype` property.
+	SHARD_BY_PLACETYPE string = "placetype"
+	// SHARD_BY_COUNTRY is the sharding rule for routing records to databases by their `wof:country` property.
+	SHARD_BY_COUNTRY string = "country"
+)
+
+// shard_placeholder is the placeholder, in a database URI template, which is replaced by the shard value for any sharding rule.
+const shard_placeholder string = "{shard}"
+
+// shard_paths is a map of (named) sharding rules and the paths of the properties they shard records by.
+var shard_paths = map[string]string{
+	SHARD_BY_REPO:      "properties.wof:repo",
+	SHARD_BY_PLACETYPE: "properties.wof:placetype",
+	SHARD_BY_COUNTRY:   "properties.wof:country",
+}
+
+var re_shard_value = regexp.MustCompile(`[^a-z0-9_\.\-]+`)
+
+// shardRecord is a record, read by `runSharded`, to be indexed in a shard database.
+type shardRecord struct {
+	path string
+	body []byte
+}
+
+// shardRule is a struct describing how records are routed to shard databases.
+type shardRule struct {
+	// path is the gjson path of the property used to derive a record's shard value.
+	path string
+	// placeholders is the list of placeholders, in a database URI template, replaced by a record's shard value.
+	placeholders []string
+}
+
+// newShardRule returns a new `shardRule` instance for 'name' which is either one of the named sharding rules or a gjson path.
+func newShardRule(name string) (*shardRule, error) {
+
+	if strings.TrimSpace(name) == "" {
+		return nil, fmt.Errorf("Missing sharding rule")
+	}
+
+	rule := &shardRule{
+		path:         name,
+		placeholders: []string{shard_placeholder},
+	}
+
+	path, ok := shard_paths[strings.ToLower(name)]
+
+	if ok {
+		rule.path = path
+		rule.placeholders = append(rule.placeholders, fmt.Sprintf("{%s}", strings.ToLower(name)))
+	}
+
+	return rule, nil
+}
+
+// Expand returns a copy of 'template' with each of the rule's placeholders replaced by 'value'.
+func (r *shardRule) Expand(template string, value string) string {
+
+	for _, p := range r.placeholders {
+		template = strings.ReplaceAll(template, p, value)
+	}
+
+	return template
+}
+
+// HasPlaceholder returns a boolean value indicating whether 'template' contains any of the rule's placeholders.
+func (r *shardRule) HasPlaceholder(template string) bool {
+
+	for _, p := range r.placeholders {
+
+		if strings.Contains(template, p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Value returns the (sanitized) shard value for the record 'body'. Values are lower-cased and any characters other than
+// letters, numbers, "_", "." or "-" are replaced by "-". If the record has no value for the rule's path an empty string is returned.
+func (r *shardRule) Value(body []byte) string {
+
+	rsp := gjson.GetBytes(body, r.path)
+
+	if !rsp.Exists() {
+		return ""
+	}
+
+	value := strings.ToLower(strings.TrimSpace(rsp.String()))
+	value = re_shard_value.ReplaceAllString(value, "-")
+
+	return strings.Trim(value, "-.")
+}
+
+// runSharded iterates over the sources defined by 'opts' once, routing each record to a database derived from the
+// 'opts.DatabaseURI' template and the record's shard value. Shard databases are created (and indexed, using 'opts')
+// the first time a record with their shard value is encountered. Alternate geometry files are routed to the same
+// database as their principal record as soon as its shard value is known; those encountered before their principal
+// record are written to a temporary file and routed once iterating over the sources has finished.
+//
+// There is no limit on the number of shard databases which are open, and being indexed, at the same time. Each one stays
+// open until iterating over the sources has finished so the number of distinct shard values determines the number of
+// open databases (and goroutines and file handles).
+func runSharded(ctx context.Context, opts *RunOptions, logger *log.Logger) (*RunResults, error) {
+
+	rule, err := newShardRule(opts.ShardBy)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !rule.HasPlaceholder(opts.DatabaseURI) {
+		return nil, fmt.Errorf("Database URI must contain a placeholder (%s) when sharding records", strings.Join(rule.placeholders, " or "))
+	}
+
+	if opts.GitDiffFrom != "" {
+		return nil, fmt.Errorf("Git diff mode can not be used when sharding records")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	mu := new(sync.Mutex)
+	wg := new(sync.WaitGroup)
+
+	shards := make(map[string]chan *shardRecord)
+	shard_results := make(map[string]*RunResults)
+	shard_errors := make([]error, 0)
+
+	// The shard values of principal records, used to route alternate geometry files
+	principal_shards := new(sync.Map)
+
+	// Alternate geometry files encountered before their principal record
+	pending_alts := index.NewPendingAlts()
+	defer pending_alts.Close()
+
+	var skipped int64
+
+	// Resolve the commits for the sources being indexed once, rather than for every shard database
+	// (which, for "git://" iterators, means querying each remote repository).
+
+	commits := sourceCommits(ctx, opts.IteratorURI, opts.URIs)
+
+	// shard_channel returns the channel for the shard 'value', creating the channel and starting
+	// to index the shard database if necessary.
+	shard_channel := func(value string) (chan *shardRecord, error) {
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		if len(shard_errors) > 0 {
+			return nil, shard_errors[0]
+		}
+
+		ch, ok := shards[value]
+
+		if !ok {
+
+			ch = make(chan *shardRecord, 100)
+			shards[value] = ch
+
+			shard_opts := *opts
+			shard_opts.DatabaseURI = rule.Expand(opts.DatabaseURI, value)
+			shard_opts.shard = value
+			shard_opts.records = ch
+			shard_opts.commits = commits
+
+			if opts.RelationsReport != "" {
+				shard_opts.RelationsReport = rule.Expand(opts.RelationsReport, value)
+			}
+
+			logger.Printf("Index records with shard value '%s' in %s", value, shard_opts.DatabaseURI)
+
+			wg.Add(1)
+
+			go func(value string, shard_opts *RunOptions) {
+
+				defer wg.Done()
+
+				rsp, err := RunWithOptions(ctx, shard_opts, logger)
+
+				// Drain any remaining records so that the iterator is not blocked
+
+				for range shard_opts.records {
+					// pass
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+
+				if rsp != nil {
+					shard_results[value] = rsp
+				}
+
+				if err != nil {
+					shard_errors = append(shard_errors, fmt.Errorf("Failed to index shard '%s', %w", value, err))
+					cancel()
+				}
+
+			}(value, &shard_opts)
+		}
+
+		return ch, nil
+	}
+
+	route := func(rec *shardRecord, value string) error {
+
+		ch, err := shard_channel(value)
+
+		if err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case ch <- rec:
+			return nil
+		}
+	}
+
+	iter_cb := func(ctx context.Context, path string, r io.ReadSeeker, args ...interface{}) error {
+
+		body, err := io.ReadAll(r)
+
+		if err != nil {
+			return fmt.Errorf("Failed to read %s, %w", path, err)
+		}
+
+		rec := &shardRecord{
+			path: path,
+			body: body,
+		}
+
+		is_alt := false
+
+		if path != "" {
+
+			alt, err := uri.IsAltFile(path)
+
+			if err == nil {
+				is_alt = alt
+			}
+		}
+
+		id, id_err := wof_properties.Id(body)
+
+		if is_alt && id_err == nil {
+
+			v, ok := principal_shards.Load(id)
+
+			if !ok {
+				return pending_alts.Write(rec.path, rec.body)
+			}
+
+			return route(rec, v.(string))
+		}
+
+		value := rule.Value(body)
+
+		if value == "" {
+
+			mu.Lock()
+			skipped += 1
+			mu.Unlock()
+
+			return nil
+		}
+
+		if id_err == nil {
+			principal_shards.Store(id, value)
+		}
+
+		return route(rec, value)
+	}
+
+	iterator_uri, err := iteratorURIWithProcesses(opts.IteratorURI, opts.Processes)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to derive iterator URI, %w", err)
+	}
+
+	iter, err := iterator.NewIterator(ctx, iterator_uri, iter_cb)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create new iterator, %w", err)
+	}
+
+	iter_err := iter.IterateURIs(ctx, opts.URIs...)
+
+	if iter_err == nil {
+
+		iter_err = pending_alts.Replay(func(path string, body []byte) error {
+
+			rec := &shardRecord{
+				path: path,
+				body: body,
+			}
+
+			id, _ := wof_properties.Id(rec.body)
+
+			v, ok := principal_shards.Load(id)
+
+			if !ok {
+				logger.Printf("Unable to determine shard for %s, because its principal record was not indexed", rec.path)
+				skipped += 1
+				return nil
+			}
+
+			return route(rec, v.(string))
+		})
+	}
+
+	// Make sure that shard databases are not finalized (or renamed into place in atomic mode)
+	// if iterating over the sources failed.
+
+	if iter_err != nil {
+		cancel()
+	}
+
+	mu.Lock()
+
+	for _, ch := range shards {
+		close(ch)
+	}
+
+	mu.Unlock()
+
+	wg.Wait()
+
+	if skipped > 0 {
+		logger.Printf("Skipped %d records with no shard value", skipped)
+	}
+
+	results := &RunResults{
+		UnresolvedRelations:  make([]*index.UnresolvedRelation, 0),
+		ValidationViolations: make(map[string]int64),
+		Shards:               make(map[string]string),
+	}
+
+	for value, rsp := range shard_results {
+
+		results.UnresolvedRelations = append(results.UnresolvedRelations, rsp.UnresolvedRelations...)
+		results.IndexErrors += rsp.IndexErrors
+
+		for rule, count := range rsp.ValidationViolations {
+			results.ValidationViolations[rule] += count
+		}
+
+		results.Shards[value] = rule.Expand(opts.DatabaseURI, value)
+	}
+
+	if len(shard_errors) > 0 {
+		return results, shard_errors[0]
+	}
+
+	if iter_err != nil {
+		return results, fmt.Errorf("Failed to index paths in %s mode because: %s", opts.IteratorURI, iter_err)
+	}
+
+	return results, nil
+}
+
+// indexShardRecords indexes each of the records in 'records' using 'idx', and the same callback used to index the records
+// emitted by an iterator, with 'processes' workers. If 'processes' is zero the number of CPUs is used.
+func indexShardRecords(ctx context.Context, idx *sql_index.SQLiteIndexer, records <-chan *shardRecord, processes int) error {
+
+	workers := processes
+
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	iterator_uri, key, unregister := registerRecordsSource(func(ctx context.Context, index_cb emitter.EmitterCallbackFunc) error {
+
+		parent_ctx := ctx
+
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		err_ch := make(chan error, workers)
+		wg := new(sync.WaitGroup)
+
+		for i := 0; i < workers; i++ {
+
+			wg.Add(1)
+
+			go func() {
+
+				defer wg.Done()
+
+				for rec := range records {
+
+					select {
+					case <-ctx.Done():
+						return
+					default:
+						// pass
+					}
+
+					err := index_cb(ctx, rec.path, bytes.NewReader(rec.body))
+
+					if err != nil {
+						err_ch <- err
+						cancel()
+						return
+					}
+				}
+			}()
+		}
+
+		wg.Wait()
+		close(err_ch)
+
+		err := <-err_ch
+
+		if err != nil {
+			return err
+		}
+
+		return parent_ctx.Err()
+	})
+
+	defer unregister()
+
+	return idx.IndexURIs(ctx, iterator_uri, key)
+}
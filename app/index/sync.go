@@ -0,0 +1,68 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/aaronland/go-sqlite/v2"
+	"github.com/whosonfirst/go-whosonfirst-sqlite-features-index/v2"
+)
+
+// syncDatabase removes the rows for any Who's On First ID present in 'tables' but not in 'seen'. If 'dry_run'
+// is true the IDs that would be removed are logged but the database is not modified. Since an empty 'seen' map
+// would remove every record, usually because the sources being indexed were missing or unreadable, it returns an
+// error in that case unless 'force' is true.
+func syncDatabase(ctx context.Context, db sqlite.Database, tables []sqlite.Table, seen *sync.Map, dry_run bool, force bool, logger *log.Logger) error {
+
+	is_empty := true
+
+	seen.Range(func(k any, v any) bool {
+		is_empty = false
+		return false
+	})
+
+	if is_empty && !force {
+		return fmt.Errorf("Refusing to sync database because no records were encountered during indexing")
+	}
+
+	db.Lock(ctx)
+	defer db.Unlock(ctx)
+
+	ids, err := index.FeatureIds(ctx, db, tables)
+
+	if err != nil {
+		return fmt.Errorf("Failed to derive feature IDs, %w", err)
+	}
+
+	stale := make([]int64, 0)
+
+	for _, id := range ids {
+
+		_, ok := seen.Load(id)
+
+		if !ok {
+			stale = append(stale, id)
+		}
+	}
+
+	if dry_run {
+
+		for _, id := range stale {
+			logger.Printf("Would remove %d", id)
+		}
+
+		logger.Printf("Would remove %d records not seen during indexing", len(stale))
+		return nil
+	}
+
+	err = index.RemoveFeatures(ctx, db, tables, stale)
+
+	if err != nil {
+		return fmt.Errorf("Failed to remove stale features, %w", err)
+	}
+
+	logger.Printf("Removed %d records not seen during indexing", len(stale))
+	return nil
+}
@@ -0,0 +1,847 @@
+package index
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"log"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/aaronland/go-sqlite/v2"
+	sql_index "github.com/whosonfirst/go-whosonfirst-sqlite-index/v4"
+)
+
+// BatchDatabase implements the `aaronland/go-sqlite.Database` interface wrapping an existing database such that all the
+// writes performed between calls to the `BeginBatch` and `CommitBatch` (or `RollbackBatch`) methods happen in a single transaction.
+//
+// Tables in the `whosonfirst/go-whosonfirst-sqlite-features` package begin and commit their own transaction for every record
+// and SQLite transactions can not be nested so, while a batch is open, those transactions are turned in to savepoints of the
+// batch transaction. This is done by the connections of the `sql.DB` instance returned by the `Conn` method, which is limited
+// to a single connection since the batch transaction (and its uncommitted writes) belong to the connection that started it.
+type BatchDatabase struct {
+	db   sqlite.Database
+	conn *sql.DB
+	// mu is used to guard the state (below) of the current batch.
+	mu *sync.Mutex
+	// in_batch is a boolean flag indicating whether a batch is open.
+	in_batch bool
+	// in_tx is a boolean flag indicating whether a (real) transaction has been started for the current batch.
+	in_tx bool
+	// in_record is a boolean flag indicating whether a savepoint has been started for the current record.
+	in_record bool
+}
+
+// batch_record_savepoint is the name of the savepoint used to group the writes for an individual record.
+const batch_record_savepoint string = "batch_record"
+
+// batch_tx_savepoint is the name of the savepoint used for each transaction started while a batch is open.
+const batch_tx_savepoint string = "batch_tx"
+
+// NewBatchDatabase returns a new `BatchDatabase` instance wrapping 'db', which should not be used directly once it has been
+// wrapped. Closing the `BatchDatabase` will also close 'db'.
+func NewBatchDatabase(ctx context.Context, db sqlite.Database) (*BatchDatabase, error) {
+
+	db_conn, err := db.Conn(ctx)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to establish database connection, %w", err)
+	}
+
+	bdb := &BatchDatabase{
+		db: db,
+		mu: new(sync.Mutex),
+	}
+
+	connector := &batchConnector{
+		driver: db_conn.Driver(),
+		dsn:    db.DSN(ctx),
+		db:     bdb,
+	}
+
+	conn := sql.OpenDB(connector)
+
+	// Connections are never expired so that per-connection pragmas are preserved.
+
+	conn.SetMaxOpenConns(1)
+	conn.SetMaxIdleConns(1)
+	conn.SetConnMaxLifetime(0)
+
+	bdb.conn = conn
+	return bdb, nil
+}
+
+// DSN returns the DSN of the underlying database.
+func (bdb *BatchDatabase) DSN(ctx context.Context) string {
+	return bdb.db.DSN(ctx)
+}
+
+// Conn returns the `sql.DB` instance whose transactions are part of the current batch, if there is one.
+func (bdb *BatchDatabase) Conn(ctx context.Context) (*sql.DB, error) {
+	return bdb.conn, nil
+}
+
+// Lock locks the underlying database.
+func (bdb *BatchDatabase) Lock(ctx context.Context) error {
+	return bdb.db.Lock(ctx)
+}
+
+// Unlock unlocks the underlying database.
+func (bdb *BatchDatabase) Unlock(ctx context.Context) error {
+	return bdb.db.Unlock(ctx)
+}
+
+// SetLogger assigns 'logger' to the underlying database.
+func (bdb *BatchDatabase) SetLogger(ctx context.Context, logger *log.Logger) error {
+	return bdb.db.SetLogger(ctx, logger)
+}
+
+// Close rolls back the current batch, if any, and closes the database. Batches are only ever committed by the `CommitBatch` method.
+func (bdb *BatchDatabase) Close(ctx context.Context) error {
+
+	rollback_err := bdb.RollbackBatch(ctx)
+
+	err := bdb.conn.Close()
+
+	if err != nil {
+		return fmt.Errorf("Failed to close batch connection, %w", err)
+	}
+
+	err = bdb.db.Close(ctx)
+
+	if err != nil {
+		return fmt.Errorf("Failed to close database, %w", err)
+	}
+
+	if rollback_err != nil {
+		return fmt.Errorf("Failed to roll back pending batch, %w", rollback_err)
+	}
+
+	return nil
+}
+
+// BeginBatch starts a new batch, if one is not already open. The batch transaction itself is started by the first write.
+func (bdb *BatchDatabase) BeginBatch(ctx context.Context) error {
+
+	bdb.mu.Lock()
+	defer bdb.mu.Unlock()
+
+	bdb.in_batch = true
+	return nil
+}
+
+// CommitBatch commits the current batch, if any, and closes it. The writes for a record which has not been committed are rolled back first.
+func (bdb *BatchDatabase) CommitBatch(ctx context.Context) error {
+
+	err := bdb.RollbackRecord(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	bdb.mu.Lock()
+	in_tx := bdb.in_tx
+	bdb.in_batch = false
+	bdb.mu.Unlock()
+
+	if !in_tx {
+		return nil
+	}
+
+	_, err = bdb.conn.ExecContext(ctx, "COMMIT")
+
+	if err != nil {
+		return fmt.Errorf("Failed to commit batch transaction, %w", err)
+	}
+
+	bdb.mu.Lock()
+	bdb.in_tx = false
+	bdb.mu.Unlock()
+
+	return nil
+}
+
+// RollbackBatch rolls back the current batch, if any, and closes it.
+func (bdb *BatchDatabase) RollbackBatch(ctx context.Context) error {
+
+	bdb.mu.Lock()
+	in_tx := bdb.in_tx
+	bdb.in_batch = false
+	bdb.mu.Unlock()
+
+	if !in_tx {
+		return nil
+	}
+
+	_, err := bdb.conn.ExecContext(ctx, "ROLLBACK")
+
+	if err != nil {
+		return fmt.Errorf("Failed to roll back batch transaction, %w", err)
+	}
+
+	bdb.mu.Lock()
+	bdb.in_tx = false
+	bdb.in_record = false
+	bdb.mu.Unlock()
+
+	return nil
+}
+
+// BeginRecord starts a savepoint, if one is not already open, in which all the writes for an individual record are grouped.
+// It returns an error if a batch is not open.
+func (bdb *BatchDatabase) BeginRecord(ctx context.Context) error {
+
+	bdb.mu.Lock()
+	in_batch := bdb.in_batch
+	in_tx := bdb.in_tx
+	in_record := bdb.in_record
+	bdb.mu.Unlock()
+
+	if !in_batch {
+		return fmt.Errorf("Batch has not been started")
+	}
+
+	if in_record {
+		return nil
+	}
+
+	// A savepoint outside of a transaction starts (and, when released, commits) its own
+	// transaction so make sure the batch transaction has been started first.
+
+	if !in_tx {
+
+		_, err := bdb.conn.ExecContext(ctx, "BEGIN")
+
+		if err != nil {
+			return fmt.Errorf("Failed to begin batch transaction, %w", err)
+		}
+
+		bdb.mu.Lock()
+		bdb.in_tx = true
+		bdb.mu.Unlock()
+	}
+
+	_, err := bdb.conn.ExecContext(ctx, fmt.Sprintf("SAVEPOINT %s", batch_record_savepoint))
+
+	if err != nil {
+		return fmt.Errorf("Failed to begin record savepoint, %w", err)
+	}
+
+	bdb.mu.Lock()
+	bdb.in_record = true
+	bdb.mu.Unlock()
+
+	return nil
+}
+
+// CommitRecord releases the savepoint for the current record, if any, keeping its writes as part of the batch.
+func (bdb *BatchDatabase) CommitRecord(ctx context.Context) error {
+
+	bdb.mu.Lock()
+	in_record := bdb.in_record
+	bdb.mu.Unlock()
+
+	if !in_record {
+		return nil
+	}
+
+	_, err := bdb.conn.ExecContext(ctx, fmt.Sprintf("RELEASE SAVEPOINT %s", batch_record_savepoint))
+
+	if err != nil {
+		return fmt.Errorf("Failed to release record savepoint, %w", err)
+	}
+
+	bdb.mu.Lock()
+	bdb.in_record = false
+	bdb.mu.Unlock()
+
+	return nil
+}
+
+// RollbackRecord rolls back the writes for the current record, if any, leaving the rest of the batch intact.
+func (bdb *BatchDatabase) RollbackRecord(ctx context.Context) error {
+
+	bdb.mu.Lock()
+	in_record := bdb.in_record
+	bdb.mu.Unlock()
+
+	if !in_record {
+		return nil
+	}
+
+	for _, q := range []string{
+		fmt.Sprintf("ROLLBACK TO SAVEPOINT %s", batch_record_savepoint),
+		fmt.Sprintf("RELEASE SAVEPOINT %s", batch_record_savepoint),
+	} {
+
+		_, err := bdb.conn.ExecContext(ctx, q)
+
+		if err != nil {
+			return fmt.Errorf("Failed to roll back record savepoint, %w", err)
+		}
+	}
+
+	bdb.mu.Lock()
+	bdb.in_record = false
+	bdb.mu.Unlock()
+
+	return nil
+}
+
+// beginTx returns a `driver.Tx` for 'c' which is a savepoint of the batch transaction if a batch is open or a regular transaction otherwise.
+func (bdb *BatchDatabase) beginTx(ctx context.Context, c *batchConn, opts driver.TxOptions) (driver.Tx, error) {
+
+	bdb.mu.Lock()
+	defer bdb.mu.Unlock()
+
+	if !bdb.in_batch {
+		return c.beginTx(ctx, opts)
+	}
+
+	if !bdb.in_tx {
+
+		_, err := c.exec(ctx, "BEGIN")
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to begin batch transaction, %w", err)
+		}
+
+		bdb.in_tx = true
+	}
+
+	_, err := c.exec(ctx, fmt.Sprintf("SAVEPOINT %s", batch_tx_savepoint))
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to begin savepoint, %w", err)
+	}
+
+	tx := &batchTx{
+		conn: c,
+	}
+
+	return tx, nil
+}
+
+// batchTx implements the `driver.Tx` interface for transactions, which are savepoints, that are part of a batch.
+type batchTx struct {
+	conn *batchConn
+}
+
+// Commit releases the transaction's savepoint, keeping its writes as part of the batch.
+func (tx *batchTx) Commit() error {
+
+	ctx := context.Background()
+
+	_, err := tx.conn.exec(ctx, fmt.Sprintf("RELEASE SAVEPOINT %s", batch_tx_savepoint))
+
+	if err != nil {
+		return fmt.Errorf("Failed to release savepoint, %w", err)
+	}
+
+	return nil
+}
+
+// Rollback rolls back the writes made since the transaction's savepoint, leaving the rest of the batch intact.
+func (tx *batchTx) Rollback() error {
+
+	ctx := context.Background()
+
+	for _, q := range []string{
+		fmt.Sprintf("ROLLBACK TO SAVEPOINT %s", batch_tx_savepoint),
+		fmt.Sprintf("RELEASE SAVEPOINT %s", batch_tx_savepoint),
+	} {
+
+		_, err := tx.conn.exec(ctx, q)
+
+		if err != nil {
+			return fmt.Errorf("Failed to roll back savepoint, %w", err)
+		}
+	}
+
+	return nil
+}
+
+// batchConnector implements the `driver.Connector` interface returning `batchConn` connections.
+type batchConnector struct {
+	driver driver.Driver
+	dsn    string
+	db     *BatchDatabase
+}
+
+// Connect returns a new `batchConn` connection.
+func (c *batchConnector) Connect(ctx context.Context) (driver.Conn, error) {
+
+	conn, err := c.driver.Open(c.dsn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	bc := &batchConn{
+		conn: conn,
+		db:   c.db,
+	}
+
+	return bc, nil
+}
+
+// Driver returns the underlying `driver.Driver` instance.
+func (c *batchConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// batchConn implements the `driver.Conn` interface wrapping a connection for the underlying driver whose transactions are
+// started by its `BatchDatabase`.
+type batchConn struct {
+	conn driver.Conn
+	db   *BatchDatabase
+}
+
+// Prepare prepares 'query' using the underlying connection.
+func (c *batchConn) Prepare(query string) (driver.Stmt, error) {
+	return c.conn.Prepare(query)
+}
+
+// PrepareContext prepares 'query' using the underlying connection.
+func (c *batchConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+
+	pc, ok := c.conn.(driver.ConnPrepareContext)
+
+	if !ok {
+		return c.conn.Prepare(query)
+	}
+
+	return pc.PrepareContext(ctx, query)
+}
+
+// Close closes the underlying connection.
+func (c *batchConn) Close() error {
+	return c.conn.Close()
+}
+
+// Begin starts a transaction (which may be part of a batch).
+func (c *batchConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+// BeginTx starts a transaction (which may be part of a batch).
+func (c *batchConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return c.db.beginTx(ctx, c, opts)
+}
+
+// ExecContext executes 'query' using the underlying connection.
+func (c *batchConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+
+	ec, ok := c.conn.(driver.ExecerContext)
+
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	return ec.ExecContext(ctx, query, args)
+}
+
+// QueryContext executes 'query' using the underlying connection.
+func (c *batchConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+
+	qc, ok := c.conn.(driver.QueryerContext)
+
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	return qc.QueryContext(ctx, query, args)
+}
+
+// CheckNamedValue defers to the underlying connection's `CheckNamedValue` method, if present.
+func (c *batchConn) CheckNamedValue(nv *driver.NamedValue) error {
+
+	nc, ok := c.conn.(driver.NamedValueChecker)
+
+	if !ok {
+		return driver.ErrSkip
+	}
+
+	return nc.CheckNamedValue(nv)
+}
+
+// ResetSession defers to the underlying connection's `ResetSession` method, if present.
+func (c *batchConn) ResetSession(ctx context.Context) error {
+
+	sr, ok := c.conn.(driver.SessionResetter)
+
+	if !ok {
+		return nil
+	}
+
+	return sr.ResetSession(ctx)
+}
+
+// IsValid defers to the underlying connection's `IsValid` method, if present.
+func (c *batchConn) IsValid() bool {
+
+	v, ok := c.conn.(driver.Validator)
+
+	if !ok {
+		return true
+	}
+
+	return v.IsValid()
+}
+
+// beginTx starts a regular transaction using the underlying connection.
+func (c *batchConn) beginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+
+	bc, ok := c.conn.(driver.ConnBeginTx)
+
+	if !ok {
+		return c.conn.Begin()
+	}
+
+	return bc.BeginTx(ctx, opts)
+}
+
+// exec executes 'query', which takes no arguments, using the underlying connection.
+func (c *batchConn) exec(ctx context.Context, query string) (driver.Result, error) {
+
+	ec, ok := c.conn.(driver.ExecerContext)
+
+	if ok {
+		return ec.ExecContext(ctx, query, nil)
+	}
+
+	stmt, err := c.PrepareContext(ctx, query)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer stmt.Close()
+
+	return stmt.Exec(nil)
+}
+
+// RecordBatcherOptions is a struct to define options when creating a `RecordBatcher` instance.
+type RecordBatcherOptions struct {
+	// Size is the maximum number of records to index in a single transaction.
+	Size int
+	// Interval is the maximum amount of time to wait, after the first record in a transaction has been indexed, before
+	// committing the transaction. If zero transactions are only committed once `Size` records have been indexed.
+	Interval time.Duration
+}
+
+// RecordBatcher groups the records indexed by a `sql_index.SQLiteIndexer` instance, across all its tables, in to
+// transactions of (up to) a fixed number of records, or a fixed amount of time, using a `BatchDatabase`. The writes for
+// a record which fails to be indexed by any table are rolled back, across all the tables, rather than being partially committed.
+type RecordBatcher struct {
+	db      *BatchDatabase
+	options *RecordBatcherOptions
+	// mu is used to guard the state (below) of the current transaction.
+	mu *sync.Mutex
+	// count is the number of records indexed in the current transaction.
+	count int
+	// started is the time the first record in the current transaction was indexed.
+	started time.Time
+	// failed is the set of keys, derived by `recordKey`, of the records which have failed to be indexed by one of the
+	// tables and whose `PostIndexFunc` callback has not been invoked yet.
+	failed map[string]bool
+	// closed is a boolean flag indicating whether the `Close` or `Rollback` method has been called.
+	closed  bool
+	done_ch chan bool
+	wg      *sync.WaitGroup
+}
+
+// NewRecordBatcher returns a new `RecordBatcher` instance for 'db' and starts the first batch. Callers must invoke the
+// `Close` method to commit the final batch or the `Rollback` method to discard it.
+func NewRecordBatcher(ctx context.Context, db *BatchDatabase, opts *RecordBatcherOptions) (*RecordBatcher, error) {
+
+	if opts.Size <= 0 {
+		return nil, fmt.Errorf("Invalid batch size, %d", opts.Size)
+	}
+
+	if opts.Interval < 0 {
+		return nil, fmt.Errorf("Invalid batch interval, %v", opts.Interval)
+	}
+
+	b := &RecordBatcher{
+		db:      db,
+		options: opts,
+		mu:      new(sync.Mutex),
+		failed:  make(map[string]bool),
+		done_ch: make(chan bool),
+		wg:      new(sync.WaitGroup),
+	}
+
+	err := db.BeginBatch(ctx)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to begin batch, %w", err)
+	}
+
+	// If records stop arriving (for example, while the iterator is crawling a large
+	// directory) the current transaction still needs to be committed once the interval
+	// has elapsed.
+
+	if opts.Interval > 0 {
+
+		b.wg.Add(1)
+
+		go func() {
+
+			defer b.wg.Done()
+
+			ticker := time.NewTicker(opts.Interval)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-b.done_ch:
+					return
+				case <-ticker.C:
+
+					db.Lock(ctx)
+					err := b.commitIfExpired(ctx)
+					db.Unlock(ctx)
+
+					if err != nil {
+						slog.Warn("Failed to commit expired batch", "error", err)
+					}
+				}
+			}
+		}()
+	}
+
+	return b, nil
+}
+
+// Tables returns a copy of 'tables' each of which writes records in the savepoint for the current record.
+func (b *RecordBatcher) Tables(tables []sqlite.Table) []sqlite.Table {
+
+	wrapped := make([]sqlite.Table, len(tables))
+
+	for i, t := range tables {
+		wrapped[i] = &recordBatcherWrappedTable{
+			Table:   t,
+			batcher: b,
+		}
+	}
+
+	return wrapped
+}
+
+// PostIndexFunc returns a `sql_index.SQLiteIndexerPostIndexFunc` which invokes 'cb', if not nil, and then commits the
+// savepoint for the current record and commits the current transaction (and begins a new one) once it contains `Size`
+// records or `Interval` has elapsed. If 'cb' fails the writes for the current record are rolled back.
+func (b *RecordBatcher) PostIndexFunc(cb sql_index.SQLiteIndexerPostIndexFunc) sql_index.SQLiteIndexerPostIndexFunc {
+
+	fn := func(ctx context.Context, db sqlite.Database, tables []sqlite.Table, record interface{}) error {
+
+		body, _ := record.([]byte)
+		key := recordKey(body)
+
+		b.mu.Lock()
+		failed := b.failed[key]
+		delete(b.failed, key)
+		b.mu.Unlock()
+
+		if cb != nil {
+
+			err := cb(ctx, db, tables, record)
+
+			if err != nil {
+				return b.rollbackRecord(ctx, err)
+			}
+		}
+
+		if failed {
+			return nil
+		}
+
+		err := b.db.CommitRecord(ctx)
+
+		if err != nil {
+			return fmt.Errorf("Failed to commit record, %w", err)
+		}
+
+		b.mu.Lock()
+
+		b.count += 1
+
+		if b.count == 1 {
+			b.started = time.Now()
+		}
+
+		commit := b.count >= b.options.Size
+		b.mu.Unlock()
+
+		if commit {
+			return b.commit(ctx)
+		}
+
+		return b.commitIfExpired(ctx)
+	}
+
+	return fn
+}
+
+// Close commits the current transaction and stops batching records. It is safe to call `Close` (or `Rollback`) more than once.
+func (b *RecordBatcher) Close(ctx context.Context) error {
+
+	if !b.stop() {
+		return nil
+	}
+
+	b.db.Lock(ctx)
+	defer b.db.Unlock(ctx)
+
+	err := b.db.CommitBatch(ctx)
+
+	if err != nil {
+		return fmt.Errorf("Failed to commit batch, %w", err)
+	}
+
+	return nil
+}
+
+// Rollback rolls back the current transaction and stops batching records. It is safe to call `Rollback` (or `Close`) more than once.
+func (b *RecordBatcher) Rollback(ctx context.Context) error {
+
+	if !b.stop() {
+		return nil
+	}
+
+	b.db.Lock(ctx)
+	defer b.db.Unlock(ctx)
+
+	err := b.db.RollbackBatch(ctx)
+
+	if err != nil {
+		return fmt.Errorf("Failed to roll back batch, %w", err)
+	}
+
+	return nil
+}
+
+// stop stops committing expired transactions and returns false if the batcher had already been stopped.
+func (b *RecordBatcher) stop() bool {
+
+	b.mu.Lock()
+
+	if b.closed {
+		b.mu.Unlock()
+		return false
+	}
+
+	b.closed = true
+	b.mu.Unlock()
+
+	close(b.done_ch)
+	b.wg.Wait()
+
+	return true
+}
+
+// commitIfExpired commits the current transaction, and begins a new one, if it contains at least one record and
+// was started more than `Interval` ago. Callers must hold the database lock.
+func (b *RecordBatcher) commitIfExpired(ctx context.Context) error {
+
+	if b.options.Interval == 0 {
+		return nil
+	}
+
+	b.mu.Lock()
+	expired := b.count > 0 && time.Since(b.started) >= b.options.Interval
+	b.mu.Unlock()
+
+	if !expired {
+		return nil
+	}
+
+	return b.commit(ctx)
+}
+
+// commit commits the current transaction and begins a new one. Callers must hold the database lock.
+func (b *RecordBatcher) commit(ctx context.Context) error {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil
+	}
+
+	err := b.db.CommitBatch(ctx)
+
+	if err != nil {
+		return fmt.Errorf("Failed to commit batch, %w", err)
+	}
+
+	b.count = 0
+
+	err = b.db.BeginBatch(ctx)
+
+	if err != nil {
+		return fmt.Errorf("Failed to begin batch, %w", err)
+	}
+
+	return nil
+}
+
+// rollbackRecord rolls back the writes for the current record and returns 'err', or an error describing why the writes
+// could not be rolled back.
+func (b *RecordBatcher) rollbackRecord(ctx context.Context, err error) error {
+
+	rollback_err := b.db.RollbackRecord(ctx)
+
+	if rollback_err != nil {
+		return fmt.Errorf("Failed to roll back record (%v), %w", err, rollback_err)
+	}
+
+	return err
+}
+
+// recordBatcherWrappedTable implements the `aaronland/go-sqlite.Table` interface wrapping another table whose writes
+// are made in the savepoint for the current record of a `RecordBatcher` instance.
+type recordBatcherWrappedTable struct {
+	sqlite.Table
+	batcher *RecordBatcher
+}
+
+// IndexRecord indexes 'i' using the underlying table in the savepoint for the current record. If the underlying table
+// fails the writes for the record, in all the tables, are rolled back and the remaining tables skip the record.
+func (t *recordBatcherWrappedTable) IndexRecord(ctx context.Context, db sqlite.Database, i interface{}) error {
+
+	b := t.batcher
+
+	body, _ := i.([]byte)
+	key := recordKey(body)
+
+	b.mu.Lock()
+	failed := b.failed[key]
+	b.mu.Unlock()
+
+	if failed {
+		return nil
+	}
+
+	err := b.db.BeginRecord(ctx)
+
+	if err != nil {
+		return fmt.Errorf("Failed to begin record, %w", err)
+	}
+
+	err = t.Table.IndexRecord(ctx, db, i)
+
+	if err != nil {
+
+		b.mu.Lock()
+		b.failed[key] = true
+		b.mu.Unlock()
+
+		return b.rollbackRecord(ctx, err)
+	}
+
+	return nil
+}
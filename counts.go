@@ -0,0 +1,85 @@
+package index
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/aaronland/go-sqlite/v2"
+)
+
+// RecordCounts is a struct for counting the number of records indexed by individual tables during a single indexing run.
+type RecordCounts struct {
+	// counts is a map of table names and pointers to the number of records they have indexed.
+	counts *sync.Map
+}
+
+// NewRecordCounts returns a new `RecordCounts` instance.
+func NewRecordCounts() *RecordCounts {
+
+	c := &RecordCounts{
+		counts: new(sync.Map),
+	}
+
+	return c
+}
+
+// Table returns a copy of 't' which increments the count for its table name each time a record is indexed successfully.
+func (c *RecordCounts) Table(t sqlite.Table) sqlite.Table {
+
+	c.counts.LoadOrStore(t.Name(), new(int64))
+
+	wrapped := &recordCountsWrappedTable{
+		Table:  t,
+		counts: c,
+	}
+
+	return wrapped
+}
+
+// Counts returns a map of the names of the tables wrapped by the `Table` method and the number of records each has indexed.
+func (c *RecordCounts) Counts() map[string]int64 {
+
+	counts := make(map[string]int64)
+
+	c.counts.Range(func(k interface{}, v interface{}) bool {
+		counts[k.(string)] = atomic.LoadInt64(v.(*int64))
+		return true
+	})
+
+	return counts
+}
+
+// increment adds one to the count for the table 'name'.
+func (c *RecordCounts) increment(name string) {
+
+	v, _ := c.counts.LoadOrStore(name, new(int64))
+	atomic.AddInt64(v.(*int64), 1)
+}
+
+// recordCountsWrappedTable implements the `aaronland/go-sqlite.Table` interface wrapping another table whose successfully
+// indexed records are counted by a `RecordCounts` instance.
+type recordCountsWrappedTable struct {
+	sqlite.Table
+	counts *RecordCounts
+}
+
+// IndexRecord indexes 'i' using the underlying table and, if successful, increments its count.
+func (t *recordCountsWrappedTable) IndexRecord(ctx context.Context, db sqlite.Database, i interface{}) error {
+
+	err := t.Table.IndexRecord(ctx, db, i)
+
+	if err != nil {
+		return err
+	}
+
+	t.counts.increment(t.Name())
+	return nil
+}
+
+// IdColumn returns the ID column of the underlying table, if it declares one.
+func (t *recordCountsWrappedTable) IdColumn() string {
+
+	col, _ := idColumn(t.Table)
+	return col
+}
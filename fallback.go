@@ -0,0 +1,87 @@
+package index
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+
+	"github.com/whosonfirst/go-reader"
+)
+
+// ReaderStats is a struct containing the number of documents a reader in a `FallbackReader` was, and was not, able to read.
+type ReaderStats struct {
+	// Hits is the number of documents the reader was able to read.
+	Hits int64
+	// Misses is the number of documents the reader was not able to read.
+	Misses int64
+}
+
+// FallbackReader implements the `whosonfirst/go-reader.Reader` interface for reading documents from an ordered list of
+// readers, each of which is tried in turn until one is able to read a document. It keeps track of the number of documents
+// each reader was, and was not, able to read.
+type FallbackReader struct {
+	readers []reader.Reader
+	hits    []int64
+	misses  []int64
+}
+
+// NewFallbackReader returns a new `FallbackReader` instance for reading documents from 'readers', in order.
+func NewFallbackReader(readers ...reader.Reader) (*FallbackReader, error) {
+
+	if len(readers) == 0 {
+		return nil, fmt.Errorf("No readers defined")
+	}
+
+	fr := &FallbackReader{
+		readers: readers,
+		hits:    make([]int64, len(readers)),
+		misses:  make([]int64, len(readers)),
+	}
+
+	return fr, nil
+}
+
+// Read returns an `io.ReadSeekCloser` instance for 'path' from the first reader that is able to read it.
+func (fr *FallbackReader) Read(ctx context.Context, path string) (io.ReadSeekCloser, error) {
+
+	errs := make([]error, 0)
+
+	for i, r := range fr.readers {
+
+		fh, err := r.Read(ctx, path)
+
+		if err != nil {
+			atomic.AddInt64(&fr.misses[i], 1)
+			errs = append(errs, fmt.Errorf("Failed to read %s with reader %d (%T), %w", path, i, r, err))
+			continue
+		}
+
+		atomic.AddInt64(&fr.hits[i], 1)
+		return fh, nil
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// ReaderURI returns the absolute URI for 'path' derived by the first reader.
+func (fr *FallbackReader) ReaderURI(ctx context.Context, path string) string {
+	return fr.readers[0].ReaderURI(ctx, path)
+}
+
+// Stats returns the `ReaderStats` for each of the readers in the order they are tried.
+func (fr *FallbackReader) Stats() []*ReaderStats {
+
+	stats := make([]*ReaderStats, len(fr.readers))
+
+	for i, _ := range fr.readers {
+
+		stats[i] = &ReaderStats{
+			Hits:   atomic.LoadInt64(&fr.hits[i]),
+			Misses: atomic.LoadInt64(&fr.misses[i]),
+		}
+	}
+
+	return stats
+}
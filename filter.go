@@ -0,0 +1,301 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/aaronland/go-json-query"
+	"github.com/whosonfirst/go-whosonfirst-feature/alt"
+	"github.com/whosonfirst/go-whosonfirst-feature/geometry"
+	"github.com/whosonfirst/go-whosonfirst-feature/properties"
+	"github.com/whosonfirst/go-whosonfirst-flags"
+)
+
+// FilterMode defines how the results of multiple `PropertyFilter` instances are combined.
+type FilterMode string
+
+const (
+	// FilterModeAnd causes records to be included only if they match all the property filters.
+	FilterModeAnd FilterMode = "AND"
+	// FilterModeOr causes records to be included if they match any of the property filters.
+	FilterModeOr FilterMode = "OR"
+)
+
+// PropertyFilter is a `aaronland/go-json-query.Query` instance that can also be negated. Queries are tidwall/gjson paths
+// whose value(s) are tested using a regular expression.
+type PropertyFilter struct {
+	*query.Query
+	// Negate is a boolean flag indicating that the filter matches records whose value(s) for `Path` do not match `Match`.
+	Negate bool
+}
+
+// NewPropertyFilter returns a new `PropertyFilter` instance derived from 'str' which is expected to take the form of
+// "{PATH}={REGULAR_EXPRESSION}" or "{PATH}!={REGULAR_EXPRESSION}", for example "properties.wof:country=^US$". The last
+// "=" character in 'str' is used to separate the path from the regular expression so that paths may contain gjson queries.
+func NewPropertyFilter(str string) (*PropertyFilter, error) {
+
+	idx := strings.LastIndex(str, query.SEP)
+
+	if idx < 1 {
+		return nil, fmt.Errorf("Invalid property filter '%s'", str)
+	}
+
+	path := str[:idx]
+	negate := false
+
+	if strings.HasSuffix(path, "!") {
+		path = strings.TrimSuffix(path, "!")
+		negate = true
+	}
+
+	if path == "" {
+		return nil, fmt.Errorf("Invalid property filter '%s', missing path", str)
+	}
+
+	re, err := regexp.Compile(str[idx+1:])
+
+	if err != nil {
+		return nil, fmt.Errorf("Invalid regular expression for property filter '%s', %w", str, err)
+	}
+
+	f := &PropertyFilter{
+		Query: &query.Query{
+			Path:  path,
+			Match: re,
+		},
+		Negate: negate,
+	}
+
+	return f, nil
+}
+
+// Matches returns a boolean value indicating whether 'body' matches the filter. A positive filter matches if any of the
+// values for its path match its regular expression. A negated filter matches if none of them do, including when the path
+// is not present.
+func (f *PropertyFilter) Matches(ctx context.Context, body []byte) (bool, error) {
+
+	qs := &query.QuerySet{
+		Queries: []*query.Query{f.Query},
+		Mode:    query.QUERYSET_MODE_ANY,
+	}
+
+	matches, err := query.Matches(ctx, qs, body)
+
+	if err != nil {
+		return false, err
+	}
+
+	if f.Negate {
+		return !matches, nil
+	}
+
+	return matches, nil
+}
+
+// matchesPropertyFilters returns a boolean value indicating whether 'body' matches all (`FilterModeAnd`) or any
+// (`FilterModeOr`) of 'filters'. Positive filters are tested together as a single `aaronland/go-json-query.QuerySet`
+// instance, in the same way that the iterator's own query filters are, and negated filters are tested individually.
+func matchesPropertyFilters(ctx context.Context, filters []*PropertyFilter, mode FilterMode, body []byte) (bool, error) {
+
+	qs := &query.QuerySet{
+		Queries: make([]*query.Query, 0),
+		Mode:    query.QUERYSET_MODE_ALL,
+	}
+
+	if mode == FilterModeOr {
+		qs.Mode = query.QUERYSET_MODE_ANY
+	}
+
+	negated := make([]*PropertyFilter, 0)
+
+	for _, f := range filters {
+
+		if f.Negate {
+			negated = append(negated, f)
+		} else {
+			qs.Queries = append(qs.Queries, f.Query)
+		}
+	}
+
+	if len(qs.Queries) > 0 {
+
+		ok, err := query.Matches(ctx, qs, body)
+
+		if err != nil {
+			return false, fmt.Errorf("Failed to match property filters, %w", err)
+		}
+
+		switch {
+		case mode == FilterModeOr && ok:
+			return true, nil
+		case mode != FilterModeOr && !ok:
+			return false, nil
+		default:
+			// pass
+		}
+	}
+
+	for _, f := range negated {
+
+		ok, err := f.Matches(ctx, body)
+
+		if err != nil {
+			return false, fmt.Errorf("Failed to match property filter, %w", err)
+		}
+
+		switch {
+		case mode == FilterModeOr && ok:
+			return true, nil
+		case mode != FilterModeOr && !ok:
+			return false, nil
+		default:
+			// pass
+		}
+	}
+
+	return mode != FilterModeOr, nil
+}
+
+// hasFilters returns a boolean value indicating whether any of the filters in 'opts' are defined.
+func hasFilters(opts *SQLiteFeaturesLoadRecordFuncOptions) bool {
+
+	switch {
+	case len(opts.IncludePlacetypes) > 0, len(opts.ExcludePlacetypes) > 0, len(opts.IncludeRepos) > 0, len(opts.Filters) > 0, opts.SpatialFilter != nil:
+		return true
+	case len(opts.IsCurrent) > 0, len(opts.IsDeprecated) > 0, len(opts.IsCeased) > 0, len(opts.IsSuperseded) > 0:
+		return true
+	default:
+		return false
+	}
+}
+
+// filterRecord returns a boolean value indicating whether the record 'body', read from 'path', should be included according
+// to the filters defined in 'opts'. The results for principal records are stored in 'principals' and alternate geometry records
+// are included, or excluded, with their principal record. If the principal record has not been filtered yet, and `PendingAlts`
+// is defined and not being replayed, the alternate geometry record is written to `PendingAlts` and the second boolean value
+// returned is true.
+func filterRecord(ctx context.Context, opts *SQLiteFeaturesLoadRecordFuncOptions, principals *sync.Map, path string, id int64, body []byte) (bool, bool, error) {
+
+	if !alt.IsAlt(body) {
+
+		include, err := includeRecord(ctx, opts, body)
+
+		if err != nil {
+			return false, false, err
+		}
+
+		principals.Store(id, include)
+		return include, false, nil
+	}
+
+	v, ok := principals.Load(id)
+
+	if ok {
+		return v.(bool), false, nil
+	}
+
+	if opts.PendingAlts != nil && !opts.PendingAlts.isReplaying() {
+
+		err := opts.PendingAlts.Write(path, body)
+
+		if err != nil {
+			return false, false, err
+		}
+
+		return false, true, nil
+	}
+
+	include, err := includeRecord(ctx, opts, body)
+	return include, false, err
+}
+
+// includeRecord returns a boolean value indicating whether 'body' matches the filters defined in 'opts'. Alternate geometry
+// records are only filtered by repo since they do not have placetype, existential or most other properties of their own.
+func includeRecord(ctx context.Context, opts *SQLiteFeaturesLoadRecordFuncOptions, body []byte) (bool, error) {
+
+	if len(opts.IncludeRepos) > 0 {
+
+		repo, err := properties.Repo(body)
+
+		if err != nil || !slices.Contains(opts.IncludeRepos, repo) {
+			return false, nil
+		}
+	}
+
+	if alt.IsAlt(body) {
+		return true, nil
+	}
+
+	if len(opts.IncludePlacetypes) > 0 || len(opts.ExcludePlacetypes) > 0 {
+
+		pt, err := properties.Placetype(body)
+
+		if len(opts.IncludePlacetypes) > 0 && (err != nil || !slices.Contains(opts.IncludePlacetypes, pt)) {
+			return false, nil
+		}
+
+		if err == nil && slices.Contains(opts.ExcludePlacetypes, pt) {
+			return false, nil
+		}
+	}
+
+	existential := []struct {
+		label  string
+		values []int64
+		fn     func([]byte) (flags.ExistentialFlag, error)
+	}{
+		{"is current", opts.IsCurrent, properties.IsCurrent},
+		{"is deprecated", opts.IsDeprecated, properties.IsDeprecated},
+		{"is ceased", opts.IsCeased, properties.IsCeased},
+		{"is superseded", opts.IsSuperseded, properties.IsSuperseded},
+	}
+
+	for _, e := range existential {
+
+		if len(e.values) == 0 {
+			continue
+		}
+
+		fl, err := e.fn(body)
+
+		if err != nil {
+			return false, fmt.Errorf("Failed to derive %s flag, %w", e.label, err)
+		}
+
+		if !slices.Contains(e.values, fl.Flag()) {
+			return false, nil
+		}
+	}
+
+	if len(opts.Filters) > 0 {
+
+		matches, err := matchesPropertyFilters(ctx, opts.Filters, opts.FilterMode, body)
+
+		if err != nil {
+			return false, err
+		}
+
+		if !matches {
+			return false, nil
+		}
+	}
+
+	if opts.SpatialFilter != nil {
+
+		geojson_geom, err := geometry.Geometry(body)
+
+		if err != nil {
+			return false, fmt.Errorf("Failed to derive geometry, %w", err)
+		}
+
+		if !opts.SpatialFilter.Intersects(geojson_geom.Geometry()) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
@@ -0,0 +1,127 @@
+package index
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+
+	"github.com/aaronland/go-sqlite/v2"
+	"github.com/whosonfirst/go-whosonfirst-feature/properties"
+	sql_tables "github.com/whosonfirst/go-whosonfirst-sql/tables"
+)
+
+// unchangedFunc is a function that reports whether a Who's On First feature record is already present,
+// and unchanged, in a database.
+type unchangedFunc func(context.Context, []byte) (bool, error)
+
+// newUnchangedFunc returns an `unchangedFunc` that compares records against the 'geojson' table in 'db', if present,
+// or the 'spr' table otherwise. Records stored in the 'geojson' table are compared by both their `wof:lastmodified`
+// property and their body. Records stored in the 'spr' table are only compared by `wof:lastmodified`.
+func newUnchangedFunc(db sqlite.Database) unchangedFunc {
+
+	var compare_table string
+	var compare_body bool
+	var compare_err error
+
+	init := new(sync.Once)
+
+	// Tables are checked lazily (and only once) so that this function can be created before
+	// tables have been initialized.
+
+	derive_table := func(ctx context.Context) {
+
+		for _, t := range []string{sql_tables.GEOJSON_TABLE_NAME, sql_tables.SPR_TABLE_NAME} {
+
+			has_table, err := sqlite.HasTable(ctx, db, t)
+
+			if err != nil {
+				compare_err = fmt.Errorf("Failed to determine whether %s table exists, %w", t, err)
+				return
+			}
+
+			if has_table {
+				compare_table = t
+				compare_body = (t == sql_tables.GEOJSON_TABLE_NAME)
+				return
+			}
+		}
+	}
+
+	fn := func(ctx context.Context, body []byte) (bool, error) {
+
+		init.Do(func() {
+			derive_table(ctx)
+		})
+
+		if compare_err != nil {
+			return false, compare_err
+		}
+
+		if compare_table == "" {
+			return false, nil
+		}
+
+		id, err := properties.Id(body)
+
+		if err != nil {
+			return false, fmt.Errorf("Failed to derive wof:id, %w", err)
+		}
+
+		alt_label, err := properties.AltLabel(body)
+
+		if err != nil {
+			return false, fmt.Errorf("Failed to derive alt label, %w", err)
+		}
+
+		lastmod := properties.LastModified(body)
+
+		conn, err := db.Conn(ctx)
+
+		if err != nil {
+			return false, fmt.Errorf("Failed to establish database connection, %w", err)
+		}
+
+		var db_lastmod int64
+		var db_body []byte
+
+		// Reads happen outside of the indexer's own lock so lock the database here
+		// to avoid "table is locked" errors with shared-cache databases.
+
+		db.Lock(ctx)
+		defer db.Unlock(ctx)
+
+		if compare_body {
+			q := fmt.Sprintf("SELECT lastmodified, body FROM %s WHERE id = ? AND alt_label = ?", compare_table)
+			err = conn.QueryRowContext(ctx, q, id, alt_label).Scan(&db_lastmod, &db_body)
+		} else {
+			q := fmt.Sprintf("SELECT lastmodified FROM %s WHERE id = ? AND alt_label = ?", compare_table)
+			err = conn.QueryRowContext(ctx, q, id, alt_label).Scan(&db_lastmod)
+		}
+
+		switch {
+		case err == sql.ErrNoRows:
+			return false, nil
+		case err != nil:
+			return false, fmt.Errorf("Failed to retrieve %d (%s) from %s table, %w", id, alt_label, compare_table, err)
+		default:
+			// pass
+		}
+
+		if db_lastmod != lastmod {
+			return false, nil
+		}
+
+		if compare_body {
+
+			if !bytes.Equal(body, db_body) {
+				return false, nil
+			}
+		}
+
+		return true, nil
+	}
+
+	return fn
+}
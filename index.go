@@ -5,15 +5,15 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"strings"
 	"sync"
+	"sync/atomic"
 
 	_ "github.com/aaronland/go-sqlite-modernc"
 	"github.com/aaronland/go-sqlite/v2"
-	"github.com/tidwall/gjson"
-	"github.com/whosonfirst/go-reader"
+	"github.com/whosonfirst/go-whosonfirst-feature/alt"
 	"github.com/whosonfirst/go-whosonfirst-feature/geometry"
 	"github.com/whosonfirst/go-whosonfirst-feature/properties"
-	wof_tables "github.com/whosonfirst/go-whosonfirst-sqlite-features/v2/tables"
 	sql_index "github.com/whosonfirst/go-whosonfirst-sqlite-index/v4"
 	"github.com/whosonfirst/go-whosonfirst-uri"
 )
@@ -22,20 +22,125 @@ import (
 type SQLiteFeaturesLoadRecordFuncOptions struct {
 	// StrictAltFiles is a boolean flag indicating whether the failure to load or parse an alternate geometry file should trigger a critical error.
 	StrictAltFiles bool
-}
-
-// SQLiteFeaturesIndexRelationsFuncOptions
-type SQLiteFeaturesIndexRelationsFuncOptions struct {
-	// Reader is a valid `whosonfirst/go-reader` instance used to load Who's On First feature data
-	Reader reader.Reader
-	// Strict is a boolean flag indicating whether the failure to load or parse feature record should trigger a critical error.
-	Strict bool
+	// Incremental is a boolean flag indicating whether records that are already present, and unchanged, in `Database`
+	// should be skipped. Records are compared against the 'geojson' table, if present, using their `wof:lastmodified`
+	// property and their body or the 'spr' table, using only their `wof:lastmodified` property.
+	Incremental bool
+	// Database is the `aaronland/go-sqlite.Database` instance used to look up existing records when `Incremental` is true and to
+	// write records to the quarantine table when `ValidationMode` is `ValidationModeQuarantine`.
+	Database sqlite.Database
+	// Skipped is an optional counter which will be (atomically) incremented each time a record is skipped because it is unchanged.
+	Skipped *int64
+	// SeenIds is an optional `sync.Map` instance which will be populated with the `wof:id` of every record that is
+	// encountered, including records that fail to load, are excluded by a filter, fail validation or are skipped because
+	// they are unchanged. If a record's ID can not be derived from its body the ID is derived from its path, if possible.
+	SeenIds *sync.Map
+	// ValidationRules is an optional list of `ValidationRule` instances used to validate each record. Alternate geometry files are not validated.
+	ValidationRules []ValidationRule
+	// ValidationMode defines what happens to records that violate one or more of `ValidationRules`. If empty `ValidationModeReject` is used.
+	ValidationMode ValidationMode
+	// ValidationSummary is an optional `ValidationSummary` instance used to count the number of violations for each of `ValidationRules`.
+	ValidationSummary *ValidationSummary
+	// IncludePlacetypes is an optional list of placetypes. If not empty only records with one of these placetypes are indexed.
+	IncludePlacetypes []string
+	// ExcludePlacetypes is an optional list of placetypes. Records with one of these placetypes are not indexed.
+	ExcludePlacetypes []string
+	// IsCurrent is an optional list of existential flag values (1, 0 or -1). If not empty only records whose "is current" flag matches one of these values are indexed.
+	IsCurrent []int64
+	// IsDeprecated is an optional list of existential flag values (1, 0 or -1). If not empty only records whose "is deprecated" flag matches one of these values are indexed.
+	IsDeprecated []int64
+	// IsCeased is an optional list of existential flag values (1, 0 or -1). If not empty only records whose "is ceased" flag matches one of these values are indexed.
+	IsCeased []int64
+	// IsSuperseded is an optional list of existential flag values (1, 0 or -1). If not empty only records whose "is superseded" flag matches one of these values are indexed.
+	IsSuperseded []int64
+	// IncludeRepos is an optional list of `wof:repo` values. If not empty only records from one of these repos are indexed.
+	IncludeRepos []string
+	// Filters is an optional list of `PropertyFilter` instances that records must match in order to be indexed.
+	Filters []*PropertyFilter
+	// FilterMode defines whether records must match all (`FilterModeAnd`) or any (`FilterModeOr`) of `Filters`. If empty `FilterModeAnd` is used.
+	FilterMode FilterMode
+	// SpatialFilter is an optional `SpatialFilter` instance. If not nil only records whose geometry intersects its region are indexed.
+	SpatialFilter *SpatialFilter
+	// PendingAlts is an optional `PendingAlts` instance. When filters are defined alternate geometry files are included, or
+	// excluded, with their principal record. Alternate geometry files encountered before their principal record are written
+	// to `PendingAlts` and it is the caller's responsibility to load them again, while `PendingAlts.Replay` is running, once
+	// all the other records have been loaded. If nil, or if a principal record is never encountered, alternate geometry files
+	// are only filtered by `IncludeRepos`.
+	PendingAlts *PendingAlts
+	// Transformer is an optional `RecordTransformer` instance applied to each record after it has been filtered and validated.
+	// Records are compared against the database, when `Incremental` is true, using their transformed body.
+	Transformer RecordTransformer
+	// OriginalRecords is an optional `OriginalRecords` instance used to make the untransformed body of records changed by
+	// `Transformer` available to the tables wrapped by its `Table` method. Its `PostIndexFunc` method must also be used so that
+	// records are removed once they have been indexed.
+	OriginalRecords *OriginalRecords
+	// Relations is an optional `RelationsIndexer` instance whose `Collect` method is invoked for each record that is skipped
+	// because it is unchanged. This ensures that the relations of those records are still marked as seen when `SeenIds` is set.
+	Relations *RelationsIndexer
+	// Filtered is an optional counter which will be (atomically) incremented each time a record is excluded by one of the filters above.
+	Filtered *int64
 }
 
 // SQLiteFeaturesLoadRecordFunc returns a `go-whosonfirst-sqlite-index/v3.SQLiteIndexerLoadRecordFunc` callback
 // function that will ensure the the record being processed is a valid Who's On First GeoJSON Feature record.
 func SQLiteFeaturesLoadRecordFunc(opts *SQLiteFeaturesLoadRecordFuncOptions) sql_index.SQLiteIndexerLoadRecordFunc {
 
+	var is_unchanged unchangedFunc
+
+	if opts.Incremental && opts.Database != nil {
+		is_unchanged = newUnchangedFunc(opts.Database)
+	}
+
+	has_filters := hasFilters(opts)
+
+	// The filter results for principal records, used to include or exclude their alternate geometry files
+	principals := new(sync.Map)
+
+	switch opts.FilterMode {
+	case "", FilterModeAnd, FilterModeOr:
+		// pass
+	default:
+
+		cb := func(ctx context.Context, path string, r io.ReadSeeker, args ...interface{}) (interface{}, error) {
+			return nil, fmt.Errorf("Invalid filter mode '%s'", opts.FilterMode)
+		}
+
+		return cb
+	}
+
+	validation_mode := opts.ValidationMode
+
+	if validation_mode == "" {
+		validation_mode = ValidationModeReject
+	}
+
+	var quarantine quarantineFunc
+
+	switch validation_mode {
+	case ValidationModeReject, ValidationModeWarn:
+		// pass
+	case ValidationModeQuarantine:
+
+		if opts.Database == nil {
+
+			cb := func(ctx context.Context, path string, r io.ReadSeeker, args ...interface{}) (interface{}, error) {
+				return nil, fmt.Errorf("Quarantine validation mode requires a database")
+			}
+
+			return cb
+		}
+
+		quarantine = newQuarantineFunc(opts.Database)
+
+	default:
+
+		cb := func(ctx context.Context, path string, r io.ReadSeeker, args ...interface{}) (interface{}, error) {
+			return nil, fmt.Errorf("Invalid validation mode '%s'", validation_mode)
+		}
+
+		return cb
+	}
+
 	cb := func(ctx context.Context, path string, r io.ReadSeeker, args ...interface{}) (interface{}, error) {
 
 		select {
@@ -49,156 +154,148 @@ func SQLiteFeaturesLoadRecordFunc(opts *SQLiteFeaturesLoadRecordFuncOptions) sql
 		body, err := io.ReadAll(r)
 
 		if err != nil {
+			seenPath(opts.SeenIds, path)
 			return nil, fmt.Errorf("Failed read %s, %w", path, err)
 		}
 
-		_, err = properties.Id(body)
+		id, err := properties.Id(body)
 
 		if err != nil {
+			seenPath(opts.SeenIds, path)
 			return nil, fmt.Errorf("Failed to derive wof:id for %s, %w", path, err)
 		}
 
+		// Records are marked as seen before they are filtered or validated so that sync mode never
+		// removes a record because it failed to load or was excluded during this run.
+
+		if opts.SeenIds != nil {
+			opts.SeenIds.Store(id, true)
+		}
+
 		_, err = geometry.Geometry(body)
 
 		if err != nil {
 			return nil, fmt.Errorf("Failed to derive geometry for %s, %w", path, err)
 		}
 
-		return body, nil
-	}
-
-	return cb
-}
+		if has_filters {
 
-// SQLiteFeaturesIndexRelationsFunc returns a `go-whosonfirst-sqlite-index/v3.SQLiteIndexerPostIndexFunc` callback
-// function used to index relations for a WOF record after that record has been successfully indexed.
-func SQLiteFeaturesIndexRelationsFunc(r reader.Reader) sql_index.SQLiteIndexerPostIndexFunc {
+			include, pending, err := filterRecord(ctx, opts, principals, path, id, body)
 
-	opts := &SQLiteFeaturesIndexRelationsFuncOptions{}
-	opts.Reader = r
+			if err != nil {
+				return nil, fmt.Errorf("Failed to filter %s, %w", path, err)
+			}
 
-	return SQLiteFeaturesIndexRelationsFuncWithOptions(opts)
-}
+			if pending {
+				return nil, nil
+			}
 
-// SQLiteFeaturesIndexRelationsFuncWithOptions returns a `go-whosonfirst-sqlite-index/v3.SQLiteIndexerPostIndexFunc` callback
-// function used to index relations for a WOF record after that record has been successfully indexed, but with custom
-// `SQLiteFeaturesIndexRelationsFuncOptions` options defined in 'opts'.
-func SQLiteFeaturesIndexRelationsFuncWithOptions(opts *SQLiteFeaturesIndexRelationsFuncOptions) sql_index.SQLiteIndexerPostIndexFunc {
+			if !include {
 
-	seen := new(sync.Map)
+				if opts.Filtered != nil {
+					atomic.AddInt64(opts.Filtered, 1)
+				}
 
-	cb := func(ctx context.Context, db sqlite.Database, tables []sqlite.Table, record interface{}) error {
+				return nil, nil
+			}
+		}
 
-		geojson_t, err := wof_tables.NewGeoJSONTable(ctx)
+		// Alternate geometry files only have a subset of the properties of their principal record (they have no
+		// wof:placetype or wof:parent_id properties, for example) so they are not validated.
 
-		if err != nil {
-			return fmt.Errorf("Failed to create new GeoJSON table, %w", err)
-		}
+		if len(opts.ValidationRules) > 0 && !alt.IsAlt(body) {
 
-		conn, err := db.Conn(ctx)
+			violations := validateRecord(ctx, opts.ValidationRules, body)
 
-		if err != nil {
-			return fmt.Errorf("Failed to establish database connection, %v", err)
-		}
+			for _, v := range violations {
+				opts.ValidationSummary.Add(v.Rule)
+			}
 
-		body := record.([]byte)
+			if len(violations) > 0 {
 
-		relations := make(map[int64]bool)
+				switch validation_mode {
+				case ValidationModeWarn:
 
-		candidates := []string{
-			"properties.wof:belongsto",
-			"properties.wof:involves",
-			"properties.wof:depicts",
-		}
+					for _, v := range violations {
+						slog.Warn("Record failed validation", "path", path, "rule", v.Rule, "error", v.Error)
+					}
 
-		for _, path := range candidates {
+				case ValidationModeQuarantine:
 
-			// log.Println("RELATIONS", path)
+					err := quarantine(ctx, path, id, violations, body)
 
-			rsp := gjson.GetBytes(body, path)
+					if err != nil {
+						return nil, fmt.Errorf("Failed to quarantine %s, %w", path, err)
+					}
 
-			if !rsp.Exists() {
-				// log.Println("MISSING", path)
-				continue
-			}
+					return nil, nil
 
-			for _, r := range rsp.Array() {
+				default:
 
-				id := r.Int()
+					errs := make([]string, len(violations))
 
-				// skip -1, -4, etc.
-				// (20201224/thisisaaronland)
+					for i, v := range violations {
+						errs[i] = fmt.Sprintf("%s (%s)", v.Error, v.Rule)
+					}
 
-				if id <= 0 {
-					continue
+					return nil, fmt.Errorf("%s failed validation, %s", path, strings.Join(errs, "; "))
 				}
-
-				relations[id] = true
 			}
 		}
 
-		for id, _ := range relations {
-
-			_, ok := seen.Load(id)
-
-			if ok {
-				continue
-			}
+		original := body
 
-			seen.Store(id, true)
+		if opts.Transformer != nil {
 
-			sql := fmt.Sprintf("SELECT COUNT(id) FROM %s WHERE id=?", geojson_t.Name())
-			row := conn.QueryRow(sql, id)
-
-			var count int
-			err = row.Scan(&count)
+			body, err = opts.Transformer.Transform(ctx, path, body)
 
 			if err != nil {
-				return fmt.Errorf("Failed to count records for ID %d, %v", id, err)
+				return nil, fmt.Errorf("Failed to transform %s, %w", path, err)
 			}
+		}
 
-			if count != 0 {
-				continue
-			}
+		if is_unchanged != nil {
 
-			rel_path, err := uri.Id2RelPath(id)
+			unchanged, err := is_unchanged(ctx, body)
 
 			if err != nil {
-				return fmt.Errorf("Failed to determine relative path for %d, %v", id, err)
+				return nil, fmt.Errorf("Failed to determine whether %s has changed, %w", path, err)
 			}
 
-			fh, err := opts.Reader.Read(ctx, rel_path)
+			if unchanged {
 
-			if err != nil {
+				if opts.Skipped != nil {
+					atomic.AddInt64(opts.Skipped, 1)
+				}
 
-				if opts.Strict {
-					return fmt.Errorf("Failed to open %s, %v", rel_path, err)
+				if opts.Relations != nil {
+					opts.Relations.Collect(body)
 				}
 
-				slog.Debug("Failed to read '%s' because '%v'. Strict mode is disabled so skipping\n", rel_path, err)
-				continue
+				return nil, nil
 			}
+		}
 
-			defer fh.Close()
+		opts.OriginalRecords.Store(body, original)
 
-			ancestor, err := io.ReadAll(fh)
+		return body, nil
+	}
 
-			if err != nil {
-				return fmt.Errorf("Failed to read data for %s, %v", rel_path, err)
-			}
+	return cb
+}
 
-			for _, t := range tables {
+// seenPath stores the Who's On First ID derived from 'path' in 'seen', if not nil and the ID can be derived.
+func seenPath(seen *sync.Map, path string) {
 
-				err = t.IndexRecord(ctx, db, ancestor)
+	if seen == nil {
+		return
+	}
 
-				if err != nil {
-					return fmt.Errorf("Failed to index ancestor (%s), %v", rel_path, err)
-				}
-			}
-		}
+	id, err := uri.IdFromPath(path)
 
-		return nil
+	if err != nil {
+		return
 	}
 
-	return cb
+	seen.Store(id, true)
 }
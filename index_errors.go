@@ -0,0 +1,319 @@
+package index
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aaronland/go-sqlite/v2"
+	"github.com/whosonfirst/go-whosonfirst-feature/alt"
+	"github.com/whosonfirst/go-whosonfirst-feature/properties"
+	sql_index "github.com/whosonfirst/go-whosonfirst-sqlite-index/v4"
+)
+
+// INDEX_ERRORS_TABLE_NAME is the name of the table where the records that failed to be loaded or indexed are written.
+const INDEX_ERRORS_TABLE_NAME string = "index_errors"
+
+const (
+	// IndexErrorStageLoad is the stage for records that failed to be loaded (by a `SQLiteIndexerLoadRecordFunc` function).
+	IndexErrorStageLoad string = "load"
+	// IndexErrorStageIndex is the stage for records that failed to be indexed by a table.
+	IndexErrorStageIndex string = "index"
+	// IndexErrorStagePostIndex is the stage for records that failed to be processed by a `SQLiteIndexerPostIndexFunc` function.
+	IndexErrorStagePostIndex string = "post-index"
+)
+
+// IndexError is a struct describing a record that failed to be loaded or indexed.
+type IndexError struct {
+	// Path is the path of the record.
+	Path string
+	// Id is the Who's On First ID of the record, or 0 if it could not be derived.
+	Id int64
+	// Stage is the stage at which the record failed.
+	Stage string
+	// Table is the name of the table that failed to index the record, if applicable.
+	Table string
+	// Error is the error message.
+	Error string
+	// Body is the raw body of the record.
+	Body []byte
+}
+
+// IndexErrorsTable implements the `aaronland/go-sqlite.Table` interface for storing `IndexError` records.
+type IndexErrorsTable struct {
+	name string
+}
+
+// NewIndexErrorsTableWithDatabase returns a new `IndexErrorsTable` instance, creating the table in 'db' if necessary.
+func NewIndexErrorsTableWithDatabase(ctx context.Context, db sqlite.Database) (sqlite.Table, error) {
+
+	t := &IndexErrorsTable{
+		name: INDEX_ERRORS_TABLE_NAME,
+	}
+
+	err := t.InitializeTable(ctx, db)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to initialize %s table, %w", t.name, err)
+	}
+
+	return t, nil
+}
+
+// Name returns the name of the table.
+func (t *IndexErrorsTable) Name() string {
+	return t.name
+}
+
+// Schema returns the schema for the table.
+func (t *IndexErrorsTable) Schema() string {
+
+	return fmt.Sprintf(`CREATE TABLE %s (
+		path TEXT,
+		wof_id INTEGER,
+		stage TEXT,
+		table_name TEXT,
+		error TEXT,
+		body TEXT,
+		created INTEGER
+	);
+
+	CREATE INDEX %s_by_id ON %s (wof_id);
+	CREATE INDEX %s_by_stage ON %s (stage, table_name);`, t.name, t.name, t.name, t.name, t.name)
+}
+
+// InitializeTable creates the table in 'db' if necessary.
+func (t *IndexErrorsTable) InitializeTable(ctx context.Context, db sqlite.Database) error {
+	return sqlite.CreateTableIfNecessary(ctx, db, t)
+}
+
+// IndexRecord writes 'i', which is expected to be an `IndexError` instance, to the table.
+func (t *IndexErrorsTable) IndexRecord(ctx context.Context, db sqlite.Database, i interface{}) error {
+
+	e, ok := i.(*IndexError)
+
+	if !ok {
+		return fmt.Errorf("Invalid record, expected *IndexError")
+	}
+
+	conn, err := db.Conn(ctx)
+
+	if err != nil {
+		return fmt.Errorf("Failed to establish database connection, %w", err)
+	}
+
+	q := fmt.Sprintf("INSERT INTO %s (path, wof_id, stage, table_name, error, body, created) VALUES (?, ?, ?, ?, ?, ?, ?)", t.name)
+
+	_, err = conn.ExecContext(ctx, q, e.Path, e.Id, e.Stage, e.Table, e.Error, string(e.Body), time.Now().Unix())
+
+	if err != nil {
+		return fmt.Errorf("Failed to write index error, %w", err)
+	}
+
+	return nil
+}
+
+// IndexErrors provides methods for wrapping the callback functions and tables used by a `SQLiteIndexer` so that records which fail
+// to be loaded or indexed are written to an `IndexErrorsTable` table, and counted, rather than triggering a critical error.
+type IndexErrors struct {
+	db    sqlite.Database
+	table sqlite.Table
+	count int64
+	// failed is a map of the paths (or, if empty, the keys derived by `recordKey`) of the records that have failed.
+	failed *sync.Map
+	// paths is a map of the keys derived by `recordKey` and the path of the record they were loaded from.
+	paths *sync.Map
+}
+
+// NewIndexErrors returns a new `IndexErrors` instance which writes errors to an `IndexErrorsTable` table in 'db'.
+func NewIndexErrors(ctx context.Context, db sqlite.Database) (*IndexErrors, error) {
+
+	t, err := NewIndexErrorsTableWithDatabase(ctx, db)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create %s table, %w", INDEX_ERRORS_TABLE_NAME, err)
+	}
+
+	e := &IndexErrors{
+		db:     db,
+		table:  t,
+		failed: new(sync.Map),
+		paths:  new(sync.Map),
+	}
+
+	return e, nil
+}
+
+// Count returns the number of distinct records that have failed to be loaded or indexed. A record that fails to be
+// indexed by more than one table is only counted once although each error is written to the errors table.
+func (e *IndexErrors) Count() int64 {
+	return atomic.LoadInt64(&e.count)
+}
+
+// LoadRecordFunc returns a `SQLiteIndexerLoadRecordFunc` function which invokes 'cb' and records, rather than returns, its errors.
+func (e *IndexErrors) LoadRecordFunc(cb sql_index.SQLiteIndexerLoadRecordFunc) sql_index.SQLiteIndexerLoadRecordFunc {
+
+	load_cb := func(ctx context.Context, path string, r io.ReadSeeker, args ...interface{}) (interface{}, error) {
+
+		body, err := io.ReadAll(r)
+
+		if err != nil {
+			return nil, e.recordLocked(ctx, path, body, IndexErrorStageLoad, "", fmt.Errorf("Failed read %s, %w", path, err))
+		}
+
+		record, err := cb(ctx, path, bytes.NewReader(body), args...)
+
+		if err != nil {
+			return nil, e.recordLocked(ctx, path, body, IndexErrorStageLoad, "", err)
+		}
+
+		if record == nil {
+			return nil, nil
+		}
+
+		record_body, ok := record.([]byte)
+
+		if ok {
+			e.paths.Store(recordKey(record_body), path)
+		}
+
+		return record, nil
+	}
+
+	return load_cb
+}
+
+// Tables returns a copy of 'tables' where each table records, rather than returns, the errors triggered when indexing a record.
+func (e *IndexErrors) Tables(tables []sqlite.Table) []sqlite.Table {
+
+	wrapped := make([]sqlite.Table, len(tables))
+
+	for i, t := range tables {
+		wrapped[i] = &indexErrorsWrappedTable{
+			Table:  t,
+			errors: e,
+		}
+	}
+
+	return wrapped
+}
+
+// PostIndexFunc returns a `SQLiteIndexerPostIndexFunc` function which invokes 'cb', if not nil, and records, rather than returns,
+// its errors. It is expected to be used in conjunction with the function returned by the `LoadRecordFunc` method.
+func (e *IndexErrors) PostIndexFunc(cb sql_index.SQLiteIndexerPostIndexFunc) sql_index.SQLiteIndexerPostIndexFunc {
+
+	post_cb := func(ctx context.Context, db sqlite.Database, tables []sqlite.Table, record interface{}) error {
+
+		body, _ := record.([]byte)
+		key := recordKey(body)
+
+		defer e.paths.Delete(key)
+
+		if cb == nil {
+			return nil
+		}
+
+		err := cb(ctx, db, tables, record)
+
+		if err != nil {
+			return e.record(ctx, e.path(key), body, IndexErrorStagePostIndex, "", err)
+		}
+
+		return nil
+	}
+
+	return post_cb
+}
+
+// path returns the path for the record associated with 'key' or an empty string.
+func (e *IndexErrors) path(key string) string {
+
+	v, ok := e.paths.Load(key)
+
+	if !ok {
+		return ""
+	}
+
+	return v.(string)
+}
+
+// recordLocked locks the database and then records the error 'err' for the record 'body' read from 'path'.
+func (e *IndexErrors) recordLocked(ctx context.Context, path string, body []byte, stage string, table string, err error) error {
+
+	e.db.Lock(ctx)
+	defer e.db.Unlock(ctx)
+
+	return e.record(ctx, path, body, stage, table, err)
+}
+
+// record writes the error 'err' for the record 'body' read from 'path' to the errors table. Callers must hold the database lock.
+func (e *IndexErrors) record(ctx context.Context, path string, body []byte, stage string, table string, err error) error {
+
+	key := path
+
+	if key == "" {
+		key = recordKey(body)
+	}
+
+	_, seen := e.failed.LoadOrStore(key, true)
+
+	if !seen {
+		atomic.AddInt64(&e.count, 1)
+	}
+
+	id, _ := properties.Id(body)
+
+	index_err := &IndexError{
+		Path:  path,
+		Id:    id,
+		Stage: stage,
+		Table: table,
+		Error: err.Error(),
+		Body:  body,
+	}
+
+	write_err := e.table.IndexRecord(ctx, e.db, index_err)
+
+	if write_err != nil {
+		return fmt.Errorf("Failed to record error (%v), %w", err, write_err)
+	}
+
+	return nil
+}
+
+// indexErrorsWrappedTable implements the `aaronland/go-sqlite.Table` interface wrapping another table whose indexing
+// errors are recorded by an `IndexErrors` instance.
+type indexErrorsWrappedTable struct {
+	sqlite.Table
+	errors *IndexErrors
+}
+
+// IndexRecord indexes 'i' using the underlying table and records, rather than returns, any errors.
+func (t *indexErrorsWrappedTable) IndexRecord(ctx context.Context, db sqlite.Database, i interface{}) error {
+
+	err := t.Table.IndexRecord(ctx, db, i)
+
+	if err != nil {
+		body, _ := i.([]byte)
+		return t.errors.record(ctx, t.errors.path(recordKey(body)), body, IndexErrorStageIndex, t.Table.Name(), err)
+	}
+
+	return nil
+}
+
+// recordKey returns a key used to associate the record 'body' with the path it was loaded from.
+func recordKey(body []byte) string {
+
+	id, _ := properties.Id(body)
+
+	if !alt.IsAlt(body) {
+		return fmt.Sprintf("%d", id)
+	}
+
+	label, _ := properties.AltLabel(body)
+	return fmt.Sprintf("%d-%s", id, label)
+}
@@ -1,15 +1,29 @@
 package index
 
 import (
+	"bytes"
+	"compress/bzip2"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/aaronland/go-sqlite/v2"
+	"github.com/paulmach/orb"
+	"github.com/tidwall/gjson"
 	"github.com/whosonfirst/go-reader"
+	"github.com/whosonfirst/go-whosonfirst-feature/properties"
 	"github.com/whosonfirst/go-whosonfirst-sqlite-features/v2/tables"
 	sql_index "github.com/whosonfirst/go-whosonfirst-sqlite-index/v4"
+	"github.com/whosonfirst/go-whosonfirst-uri"
 )
 
 func TestIndexFeatures(t *testing.T) {
@@ -88,3 +102,2399 @@ func TestIndexFeatures(t *testing.T) {
 	}
 
 }
+
+func TestIndexFeaturesIncremental(t *testing.T) {
+
+	ctx := context.Background()
+
+	path_fixtures, err := filepath.Abs("fixtures")
+
+	if err != nil {
+		t.Fatalf("Failed to determine path for fixtures, %v", err)
+	}
+
+	path_data := filepath.Join(path_fixtures, "data")
+
+	exclude_edtf, err := NewPropertiesTransformFunc(&PropertiesTransformOptions{Exclude: []string{"edtf:*"}})
+
+	if err != nil {
+		t.Fatalf("Failed to create properties transform, %v", err)
+	}
+
+	// Records that are transformed before being indexed should still be considered unchanged
+
+	for _, transformer := range []RecordTransformer{nil, exclude_edtf} {
+
+		db_uri := fmt.Sprintf("modernc://%s", filepath.Join(t.TempDir(), "incremental.db"))
+
+		db, err := sqlite.NewDatabase(ctx, db_uri)
+
+		if err != nil {
+			t.Fatalf("Unable to create database (%s) because %v", db_uri, err)
+		}
+
+		defer db.Close(ctx)
+
+		gt, err := tables.NewGeoJSONTableWithDatabase(ctx, db)
+
+		if err != nil {
+			t.Fatalf("failed to create 'geojson' table because %v", err)
+		}
+
+		for i, expected := range []int64{0, 1} {
+
+			var skipped int64
+
+			record_opts := &SQLiteFeaturesLoadRecordFuncOptions{
+				Incremental: true,
+				Database:    db,
+				Skipped:     &skipped,
+				Transformer: transformer,
+			}
+
+			idx_opts := &sql_index.SQLiteIndexerOptions{
+				DB:             db,
+				Tables:         []sqlite.Table{gt},
+				LoadRecordFunc: SQLiteFeaturesLoadRecordFunc(record_opts),
+			}
+
+			idx, err := sql_index.NewSQLiteIndexer(idx_opts)
+
+			if err != nil {
+				t.Fatalf("Failed to create sqlite indexer because %v", err)
+			}
+
+			err = idx.IndexURIs(ctx, "directory://", path_data)
+
+			if err != nil {
+				t.Fatalf("Failed to index paths (pass %d), %v", i, err)
+			}
+
+			if skipped != expected {
+				t.Fatalf("Expected %d skipped records (pass %d, transformer %T), got %d", expected, i, transformer, skipped)
+			}
+		}
+	}
+}
+
+// relationsFixtures decompresses the (bzip2-compressed) relations fixtures in to a temporary directory,
+// using standard Who's On First relative paths, and returns the path to that directory.
+func relationsFixtures(t *testing.T) string {
+
+	path_relations, err := filepath.Abs("fixtures/relations")
+
+	if err != nil {
+		t.Fatalf("Failed to determine path for relations fixtures, %v", err)
+	}
+
+	root := t.TempDir()
+
+	err = filepath.WalkDir(path_relations, func(path string, d fs.DirEntry, err error) error {
+
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() || filepath.Ext(path) != ".bz2" {
+			return nil
+		}
+
+		fh, err := os.Open(path)
+
+		if err != nil {
+			return err
+		}
+
+		defer fh.Close()
+
+		body, err := io.ReadAll(bzip2.NewReader(fh))
+
+		if err != nil {
+			return err
+		}
+
+		id, err := properties.Id(body)
+
+		if err != nil {
+			return err
+		}
+
+		rel_path, err := uri.Id2RelPath(id)
+
+		if err != nil {
+			return err
+		}
+
+		abs_path := filepath.Join(root, rel_path)
+
+		err = os.MkdirAll(filepath.Dir(abs_path), 0755)
+
+		if err != nil {
+			return err
+		}
+
+		return os.WriteFile(abs_path, body, 0644)
+	})
+
+	if err != nil {
+		t.Fatalf("Failed to prepare relations fixtures, %v", err)
+	}
+
+	return root
+}
+
+// indexWithRelations indexes the data fixtures in to the 'geojson' table of a new database using relations options
+// derived from 'relations_opts' and returns the number of records in that table. If 'index_alt' is true the 'geojson'
+// table will index alternate geometries.
+func indexWithRelations(t *testing.T, relations_opts *SQLiteFeaturesIndexRelationsFuncOptions, index_alt bool) int {
+	return indexWithRelationsMode(t, relations_opts, index_alt, false)
+}
+
+// indexWithRelationsMode is the same as indexWithRelations but if 'phased' is true relations are indexed using a
+// `RelationsIndexer` (and a `BatchDatabase`) rather than in the post-index callback.
+func indexWithRelationsMode(t *testing.T, relations_opts *SQLiteFeaturesIndexRelationsFuncOptions, index_alt bool, phased bool) int {
+
+	ctx := context.Background()
+
+	path_data, err := filepath.Abs("fixtures/data")
+
+	if err != nil {
+		t.Fatalf("Failed to determine path for fixtures, %v", err)
+	}
+
+	db_uri := fmt.Sprintf("modernc://%s", filepath.Join(t.TempDir(), "relations.db"))
+
+	db, err := sqlite.NewDatabase(ctx, db_uri)
+
+	if err != nil {
+		t.Fatalf("Unable to create database (%s) because %v", db_uri, err)
+	}
+
+	if phased {
+
+		bdb, err := NewBatchDatabase(ctx, db)
+
+		if err != nil {
+			t.Fatalf("Failed to create batch database, %v", err)
+		}
+
+		db = bdb
+	}
+
+	defer db.Close(ctx)
+
+	geojson_opts, err := tables.DefaultGeoJSONTableOptions()
+
+	if err != nil {
+		t.Fatalf("failed to create 'geojson' table options because %v", err)
+	}
+
+	geojson_opts.IndexAltFiles = index_alt
+
+	gt, err := tables.NewGeoJSONTableWithDatabaseAndOptions(ctx, db, geojson_opts)
+
+	if err != nil {
+		t.Fatalf("failed to create 'geojson' table because %v", err)
+	}
+
+	idx_opts := &sql_index.SQLiteIndexerOptions{
+		DB:             db,
+		Tables:         []sqlite.Table{gt},
+		LoadRecordFunc: SQLiteFeaturesLoadRecordFunc(&SQLiteFeaturesLoadRecordFuncOptions{}),
+	}
+
+	var ri *RelationsIndexer
+
+	if phased {
+
+		ri, err = NewRelationsIndexer(relations_opts)
+
+		if err != nil {
+			t.Fatalf("Failed to create relations indexer, %v", err)
+		}
+
+		idx_opts.PostIndexFunc = ri.PostIndexFunc()
+
+	} else {
+		idx_opts.PostIndexFunc = SQLiteFeaturesIndexRelationsFuncWithOptions(relations_opts)
+	}
+
+	idx, err := sql_index.NewSQLiteIndexer(idx_opts)
+
+	if err != nil {
+		t.Fatalf("Failed to create sqlite indexer because %v", err)
+	}
+
+	err = idx.IndexURIs(ctx, "directory://", path_data)
+
+	if err != nil {
+		t.Fatalf("Failed to index paths, %v", err)
+	}
+
+	if phased {
+
+		err = ri.IndexRelations(ctx, db, []sqlite.Table{gt})
+
+		if err != nil {
+			t.Fatalf("Failed to index relations, %v", err)
+		}
+	}
+
+	conn, err := db.Conn(ctx)
+
+	if err != nil {
+		t.Fatalf("Failed to connect to database, %v", err)
+	}
+
+	var count int
+
+	err = conn.QueryRow("SELECT COUNT(id) FROM geojson").Scan(&count)
+
+	if err != nil {
+		t.Fatalf("Failed to count records, %v", err)
+	}
+
+	return count
+}
+
+func TestIndexRelationsProperties(t *testing.T) {
+
+	ctx := context.Background()
+
+	reader_uri := fmt.Sprintf("fs://%s", relationsFixtures(t))
+
+	r, err := reader.NewReader(ctx, reader_uri)
+
+	if err != nil {
+		t.Fatalf("Failed to load reader (%s), %v", reader_uri, err)
+	}
+
+	tests := map[string]int{
+		"":                         5,
+		"properties.wof:parent_id": 2,
+		"properties.wof:hierarchy": 5,
+	}
+
+	for path, expected := range tests {
+
+		relations_opts := &SQLiteFeaturesIndexRelationsFuncOptions{
+			Reader: r,
+			Strict: true,
+		}
+
+		if path != "" {
+			relations_opts.Properties = []string{path}
+		}
+
+		count := indexWithRelations(t, relations_opts, false)
+
+		if count != expected {
+			t.Fatalf("Expected %d records indexing relations for '%s', got %d", expected, path, count)
+		}
+	}
+}
+
+func TestIndexRelationsMaxDepth(t *testing.T) {
+
+	ctx := context.Background()
+
+	reader_uri := fmt.Sprintf("fs://%s", relationsFixtures(t))
+
+	r, err := reader.NewReader(ctx, reader_uri)
+
+	if err != nil {
+		t.Fatalf("Failed to load reader (%s), %v", reader_uri, err)
+	}
+
+	// 101736545 -> 890458661 -> 136251273 -> 85633041 -> 102191575
+
+	tests := map[int]int{
+		0:  2,
+		1:  2,
+		2:  3,
+		4:  5,
+		10: 5,
+	}
+
+	for depth, expected := range tests {
+
+		relations_opts := &SQLiteFeaturesIndexRelationsFuncOptions{
+			Reader:     r,
+			Strict:     true,
+			Properties: []string{"properties.wof:parent_id"},
+			MaxDepth:   depth,
+		}
+
+		count := indexWithRelations(t, relations_opts, false)
+
+		if count != expected {
+			t.Fatalf("Expected %d records indexing relations with max depth %d, got %d", expected, depth, count)
+		}
+	}
+}
+
+func TestIndexRelationsAltFiles(t *testing.T) {
+
+	ctx := context.Background()
+
+	root := relationsFixtures(t)
+
+	// Create an alternate geometry for 890458661 (county)
+
+	var county_id int64 = 890458661
+	alt_label := "naturalearth"
+
+	rel_path, err := uri.Id2RelPath(county_id)
+
+	if err != nil {
+		t.Fatalf("Failed to derive path for %d, %v", county_id, err)
+	}
+
+	body, err := os.ReadFile(filepath.Join(root, rel_path))
+
+	if err != nil {
+		t.Fatalf("Failed to read %s, %v", rel_path, err)
+	}
+
+	alt_body := bytes.Replace(body, []byte(`"properties": {`), []byte(fmt.Sprintf(`"properties": {"src:alt_label":"%s",`, alt_label)), 1)
+
+	uri_args, err := uri.NewAlternateURIArgsFromAltLabel(alt_label)
+
+	if err != nil {
+		t.Fatalf("Failed to derive URI args for %s, %v", alt_label, err)
+	}
+
+	alt_path, err := uri.Id2RelPath(county_id, uri_args)
+
+	if err != nil {
+		t.Fatalf("Failed to derive alt path for %d, %v", county_id, err)
+	}
+
+	err = os.WriteFile(filepath.Join(root, alt_path), alt_body, 0644)
+
+	if err != nil {
+		t.Fatalf("Failed to write %s, %v", alt_path, err)
+	}
+
+	reader_uri := fmt.Sprintf("fs://%s", root)
+
+	r, err := reader.NewReader(ctx, reader_uri)
+
+	if err != nil {
+		t.Fatalf("Failed to load reader (%s), %v", reader_uri, err)
+	}
+
+	tests := []struct {
+		index_alt_relations bool
+		index_alt_table     bool
+		expected            int
+	}{
+		{false, true, 5},
+		{true, false, 5},
+		{true, true, 6},
+	}
+
+	for _, test := range tests {
+
+		relations_opts := &SQLiteFeaturesIndexRelationsFuncOptions{
+			Reader:        r,
+			IndexAltFiles: test.index_alt_relations,
+			AltLabels:     []string{alt_label, "quattroshapes"},
+		}
+
+		count := indexWithRelations(t, relations_opts, test.index_alt_table)
+
+		if count != test.expected {
+			t.Fatalf("Expected %d records indexing relations (alt relations: %t, alt table: %t), got %d", test.expected, test.index_alt_relations, test.index_alt_table, count)
+		}
+	}
+}
+
+func TestRelationsIndexer(t *testing.T) {
+
+	ctx := context.Background()
+
+	reader_uri := fmt.Sprintf("fs://%s", relationsFixtures(t))
+
+	r, err := reader.NewReader(ctx, reader_uri)
+
+	if err != nil {
+		t.Fatalf("Failed to load reader (%s), %v", reader_uri, err)
+	}
+
+	// 101736545 -> 890458661 -> 136251273 -> 85633041 -> 102191575
+
+	depths := map[int]int{
+		1: 2,
+		2: 3,
+		4: 5,
+	}
+
+	for _, workers := range []int{1, 4} {
+
+		for _, batch_size := range []int{1, 100} {
+
+			for depth, expected := range depths {
+
+				relations_opts := &SQLiteFeaturesIndexRelationsFuncOptions{
+					Reader:     r,
+					Strict:     true,
+					Properties: []string{"properties.wof:parent_id"},
+					MaxDepth:   depth,
+					Workers:    workers,
+					BatchSize:  batch_size,
+				}
+
+				count := indexWithRelationsMode(t, relations_opts, false, true)
+
+				if count != expected {
+					t.Fatalf("Expected %d records indexing relations with max depth %d (%d workers, batch size %d), got %d", expected, depth, workers, batch_size, count)
+				}
+			}
+		}
+	}
+
+	// Missing relations are skipped unless strict mode is enabled
+
+	missing_r, err := reader.NewReader(ctx, fmt.Sprintf("fs://%s", t.TempDir()))
+
+	if err != nil {
+		t.Fatalf("Failed to load empty reader, %v", err)
+	}
+
+	relations_opts := &SQLiteFeaturesIndexRelationsFuncOptions{
+		Reader: missing_r,
+	}
+
+	count := indexWithRelationsMode(t, relations_opts, false, true)
+
+	if count != 1 {
+		t.Fatalf("Expected 1 record indexing relations with an empty reader, got %d", count)
+	}
+}
+
+func TestIndexRelationsReaders(t *testing.T) {
+
+	ctx := context.Background()
+
+	empty_r, err := reader.NewReader(ctx, fmt.Sprintf("fs://%s", t.TempDir()))
+
+	if err != nil {
+		t.Fatalf("Failed to load empty reader, %v", err)
+	}
+
+	reader_uri := fmt.Sprintf("fs://%s", relationsFixtures(t))
+
+	r, err := reader.NewReader(ctx, reader_uri)
+
+	if err != nil {
+		t.Fatalf("Failed to load reader (%s), %v", reader_uri, err)
+	}
+
+	fr, err := NewFallbackReader(empty_r, r)
+
+	if err != nil {
+		t.Fatalf("Failed to create fallback reader, %v", err)
+	}
+
+	relations_opts := &SQLiteFeaturesIndexRelationsFuncOptions{
+		Reader:     fr,
+		Strict:     true,
+		Properties: []string{"properties.wof:parent_id"},
+		MaxDepth:   2,
+	}
+
+	count := indexWithRelationsMode(t, relations_opts, false, true)
+
+	if count != 3 {
+		t.Fatalf("Expected 3 records indexing relations with fallback readers, got %d", count)
+	}
+
+	stats := fr.Stats()
+
+	if len(stats) != 2 {
+		t.Fatalf("Expected stats for 2 readers, got %d", len(stats))
+	}
+
+	if stats[0].Hits != 0 || stats[0].Misses != 2 {
+		t.Fatalf("Unexpected stats for first reader: %d hits, %d misses", stats[0].Hits, stats[0].Misses)
+	}
+
+	if stats[1].Hits != 2 || stats[1].Misses != 0 {
+		t.Fatalf("Unexpected stats for second reader: %d hits, %d misses", stats[1].Hits, stats[1].Misses)
+	}
+}
+
+func TestIndexRelationsUnresolved(t *testing.T) {
+
+	ctx := context.Background()
+
+	r, err := reader.NewReader(ctx, fmt.Sprintf("fs://%s", t.TempDir()))
+
+	if err != nil {
+		t.Fatalf("Failed to load empty reader, %v", err)
+	}
+
+	for _, phased := range []bool{false, true} {
+
+		unresolved := NewUnresolvedRelations()
+
+		relations_opts := &SQLiteFeaturesIndexRelationsFuncOptions{
+			Reader:     r,
+			Unresolved: unresolved,
+		}
+
+		count := indexWithRelationsMode(t, relations_opts, false, phased)
+
+		if count != 1 {
+			t.Fatalf("Expected 1 record indexing relations with an empty reader, got %d", count)
+		}
+
+		relations := unresolved.Relations()
+
+		if len(relations) != 4 {
+			t.Fatalf("Expected 4 unresolved relations (phased: %t), got %d", phased, len(relations))
+		}
+
+		for _, rel := range relations {
+
+			if len(rel.ReferencedBy) != 1 || rel.ReferencedBy[0] != 101736545 {
+				t.Fatalf("Unexpected referrers for unresolved relation %d: %v", rel.Id, rel.ReferencedBy)
+			}
+
+			if rel.Error == "" {
+				t.Fatalf("Missing error for unresolved relation %d", rel.Id)
+			}
+		}
+	}
+}
+
+// validationFixture returns the body of the fixture record after 'update' has been applied to its decoded properties
+// and geometry.
+func validationFixture(t *testing.T, update func(props map[string]interface{}, geom map[string]interface{})) []byte {
+
+	body, err := os.ReadFile("fixtures/data/101/736/545/101736545.geojson")
+
+	if err != nil {
+		t.Fatalf("Failed to read fixture, %v", err)
+	}
+
+	var f map[string]interface{}
+
+	err = json.Unmarshal(body, &f)
+
+	if err != nil {
+		t.Fatalf("Failed to unmarshal fixture, %v", err)
+	}
+
+	update(f["properties"].(map[string]interface{}), f["geometry"].(map[string]interface{}))
+
+	body, err = json.Marshal(f)
+
+	if err != nil {
+		t.Fatalf("Failed to marshal fixture, %v", err)
+	}
+
+	return body
+}
+
+func TestValidationRules(t *testing.T) {
+
+	ctx := context.Background()
+
+	tests := map[string]func(props map[string]interface{}, geom map[string]interface{}){
+		"": func(props map[string]interface{}, geom map[string]interface{}) {},
+		VALIDATE_PLACETYPE: func(props map[string]interface{}, geom map[string]interface{}) {
+			delete(props, "wof:placetype")
+		},
+		VALIDATE_REPO: func(props map[string]interface{}, geom map[string]interface{}) {
+			props["wof:repo"] = "Not a repo!"
+		},
+		VALIDATE_PARENT: func(props map[string]interface{}, geom map[string]interface{}) {
+			props["wof:parent_id"] = 1234
+		},
+		VALIDATE_EDTF: func(props map[string]interface{}, geom map[string]interface{}) {
+			props["edtf:inception"] = "last tuesday"
+		},
+		VALIDATE_RINGS: func(props map[string]interface{}, geom map[string]interface{}) {
+			geom["type"] = "Polygon"
+			geom["coordinates"] = [][][]float64{{{0, 0}, {0, 1}, {1, 1}, {1, 0}}}
+		},
+	}
+
+	for expected, update := range tests {
+
+		body := validationFixture(t, update)
+		violations := validateRecord(ctx, DefaultValidationRules(), body)
+
+		if expected == "" {
+
+			if len(violations) != 0 {
+				t.Fatalf("Expected no violations, got %s: %s", violations[0].Rule, violations[0].Error)
+			}
+
+			continue
+		}
+
+		if len(violations) != 1 || violations[0].Rule != expected {
+			t.Fatalf("Expected a single violation of the %s rule, got %d", expected, len(violations))
+		}
+	}
+}
+
+func TestIndexFeaturesValidation(t *testing.T) {
+
+	ctx := context.Background()
+
+	path_data := t.TempDir()
+
+	body := validationFixture(t, func(props map[string]interface{}, geom map[string]interface{}) {
+		delete(props, "wof:placetype")
+	})
+
+	err := os.WriteFile(filepath.Join(path_data, "101736545.geojson"), body, 0644)
+
+	if err != nil {
+		t.Fatalf("Failed to write fixture, %v", err)
+	}
+
+	// Alternate geometry files, which lack most properties, are never validated
+
+	alt_body := validationFixture(t, func(props map[string]interface{}, geom map[string]interface{}) {
+
+		for k, _ := range props {
+
+			switch k {
+			case "wof:id", "wof:repo":
+				// pass
+			default:
+				delete(props, k)
+			}
+		}
+
+		props["src:alt_label"] = "quattroshapes"
+	})
+
+	err = os.WriteFile(filepath.Join(path_data, "101736545-alt-quattroshapes.geojson"), alt_body, 0644)
+
+	if err != nil {
+		t.Fatalf("Failed to write alt fixture, %v", err)
+	}
+
+	path_alt := t.TempDir()
+
+	err = os.WriteFile(filepath.Join(path_alt, "101736545-alt-quattroshapes.geojson"), alt_body, 0644)
+
+	if err != nil {
+		t.Fatalf("Failed to write alt fixture, %v", err)
+	}
+
+	tests := []struct {
+		mode       ValidationMode
+		path       string
+		expected   int
+		violations int64
+	}{
+		{ValidationModeWarn, path_data, 2, 1},
+		{ValidationModeQuarantine, path_data, 1, 1},
+		{ValidationModeReject, path_data, -1, 1},
+		{ValidationModeReject, path_alt, 1, 0},
+	}
+
+	for _, test := range tests {
+
+		mode := test.mode
+		expected := test.expected
+
+		db_uri := fmt.Sprintf("modernc://%s", filepath.Join(t.TempDir(), "validation.db"))
+
+		db, err := sqlite.NewDatabase(ctx, db_uri)
+
+		if err != nil {
+			t.Fatalf("Unable to create database (%s) because %v", db_uri, err)
+		}
+
+		defer db.Close(ctx)
+
+		geojson_opts, err := tables.DefaultGeoJSONTableOptions()
+
+		if err != nil {
+			t.Fatalf("failed to create 'geojson' table options because %v", err)
+		}
+
+		geojson_opts.IndexAltFiles = true
+
+		gt, err := tables.NewGeoJSONTableWithDatabaseAndOptions(ctx, db, geojson_opts)
+
+		if err != nil {
+			t.Fatalf("failed to create 'geojson' table because %v", err)
+		}
+
+		summary := NewValidationSummary()
+
+		record_opts := &SQLiteFeaturesLoadRecordFuncOptions{
+			Database:          db,
+			ValidationRules:   DefaultValidationRules(),
+			ValidationMode:    mode,
+			ValidationSummary: summary,
+		}
+
+		idx_opts := &sql_index.SQLiteIndexerOptions{
+			DB:             db,
+			Tables:         []sqlite.Table{gt},
+			LoadRecordFunc: SQLiteFeaturesLoadRecordFunc(record_opts),
+		}
+
+		idx, err := sql_index.NewSQLiteIndexer(idx_opts)
+
+		if err != nil {
+			t.Fatalf("Failed to create sqlite indexer because %v", err)
+		}
+
+		err = idx.IndexURIs(ctx, "directory://", test.path)
+
+		if expected == -1 {
+
+			if err == nil {
+				t.Fatalf("Expected %s mode to fail", mode)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("Failed to index paths in %s mode, %v", mode, err)
+		}
+
+		if summary.Violations()[VALIDATE_PLACETYPE] != test.violations {
+			t.Fatalf("Expected %d placetype violations in %s mode, got %d", test.violations, mode, summary.Violations()[VALIDATE_PLACETYPE])
+		}
+
+		conn, err := db.Conn(ctx)
+
+		if err != nil {
+			t.Fatalf("Failed to connect to database, %v", err)
+		}
+
+		var count int
+
+		err = conn.QueryRow("SELECT COUNT(id) FROM geojson").Scan(&count)
+
+		if err != nil {
+			t.Fatalf("Failed to count records, %v", err)
+		}
+
+		if count != expected {
+			t.Fatalf("Expected %d records in %s mode, got %d", expected, mode, count)
+		}
+
+		if mode == ValidationModeQuarantine {
+
+			err = conn.QueryRow(fmt.Sprintf("SELECT COUNT(id) FROM %s", QUARANTINE_TABLE_NAME)).Scan(&count)
+
+			if err != nil {
+				t.Fatalf("Failed to count quarantined records, %v", err)
+			}
+
+			if count != 1 {
+				t.Fatalf("Expected 1 quarantined record, got %d", count)
+			}
+		}
+	}
+}
+
+// failingTable implements the `aaronland/go-sqlite.Table` interface for a table which fails to index every record.
+type failingTable struct {
+}
+
+func (t *failingTable) Name() string {
+	return "failing"
+}
+
+func (t *failingTable) Schema() string {
+	return ""
+}
+
+func (t *failingTable) InitializeTable(ctx context.Context, db sqlite.Database) error {
+	return nil
+}
+
+func (t *failingTable) IndexRecord(ctx context.Context, db sqlite.Database, i interface{}) error {
+	return fmt.Errorf("Failed to index record")
+}
+
+func TestIndexErrors(t *testing.T) {
+
+	ctx := context.Background()
+
+	path_data := t.TempDir()
+
+	body, err := os.ReadFile("fixtures/data/101/736/545/101736545.geojson")
+
+	if err != nil {
+		t.Fatalf("Failed to read fixture, %v", err)
+	}
+
+	err = os.WriteFile(filepath.Join(path_data, "101736545.geojson"), body, 0644)
+
+	if err != nil {
+		t.Fatalf("Failed to write fixture, %v", err)
+	}
+
+	err = os.WriteFile(filepath.Join(path_data, "broken.geojson"), []byte(`{"type":"Feature"`), 0644)
+
+	if err != nil {
+		t.Fatalf("Failed to write broken fixture, %v", err)
+	}
+
+	db_uri := fmt.Sprintf("modernc://%s", filepath.Join(t.TempDir(), "errors.db"))
+
+	db, err := sqlite.NewDatabase(ctx, db_uri)
+
+	if err != nil {
+		t.Fatalf("Unable to create database (%s) because %v", db_uri, err)
+	}
+
+	defer db.Close(ctx)
+
+	gt, err := tables.NewGeoJSONTableWithDatabase(ctx, db)
+
+	if err != nil {
+		t.Fatalf("failed to create 'geojson' table because %v", err)
+	}
+
+	index_errors, err := NewIndexErrors(ctx, db)
+
+	if err != nil {
+		t.Fatalf("Failed to create index errors, %v", err)
+	}
+
+	idx_opts := &sql_index.SQLiteIndexerOptions{
+		DB:             db,
+		Tables:         index_errors.Tables([]sqlite.Table{gt, &failingTable{}, &failingTable{}}),
+		LoadRecordFunc: index_errors.LoadRecordFunc(SQLiteFeaturesLoadRecordFunc(&SQLiteFeaturesLoadRecordFuncOptions{})),
+		PostIndexFunc:  index_errors.PostIndexFunc(nil),
+	}
+
+	idx, err := sql_index.NewSQLiteIndexer(idx_opts)
+
+	if err != nil {
+		t.Fatalf("Failed to create sqlite indexer because %v", err)
+	}
+
+	err = idx.IndexURIs(ctx, "directory://", path_data)
+
+	if err != nil {
+		t.Fatalf("Failed to index paths, %v", err)
+	}
+
+	// The record that fails to be indexed by both failing tables is only counted once
+
+	if index_errors.Count() != 2 {
+		t.Fatalf("Expected 2 failed records, got %d", index_errors.Count())
+	}
+
+	conn, err := db.Conn(ctx)
+
+	if err != nil {
+		t.Fatalf("Failed to connect to database, %v", err)
+	}
+
+	expected := map[string]string{
+		IndexErrorStageLoad:  filepath.Join(path_data, "broken.geojson"),
+		IndexErrorStageIndex: filepath.Join(path_data, "101736545.geojson"),
+	}
+
+	expected_rows := map[string]int{
+		IndexErrorStageLoad:  1,
+		IndexErrorStageIndex: 2,
+	}
+
+	for stage, path := range expected {
+
+		var count int
+
+		q := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE stage = ? AND path = ?", INDEX_ERRORS_TABLE_NAME)
+		err = conn.QueryRow(q, stage, path).Scan(&count)
+
+		if err != nil {
+			t.Fatalf("Failed to count errors, %v", err)
+		}
+
+		if count != expected_rows[stage] {
+			t.Fatalf("Expected %d errors for %s stage (%s), got %d", expected_rows[stage], stage, path, count)
+		}
+	}
+
+	var count int
+
+	err = conn.QueryRow("SELECT COUNT(id) FROM geojson").Scan(&count)
+
+	if err != nil {
+		t.Fatalf("Failed to count records, %v", err)
+	}
+
+	if count != 1 {
+		t.Fatalf("Expected 1 record, got %d", count)
+	}
+}
+
+func TestIncludeRecord(t *testing.T) {
+
+	ctx := context.Background()
+
+	body, err := os.ReadFile("fixtures/data/101/736/545/101736545.geojson")
+
+	if err != nil {
+		t.Fatalf("Failed to read fixture, %v", err)
+	}
+
+	tests := map[bool][]*SQLiteFeaturesLoadRecordFuncOptions{
+		true: {
+			{},
+			{IncludePlacetypes: []string{"locality", "region"}},
+			{ExcludePlacetypes: []string{"region"}},
+			{IsCurrent: []int64{1}},
+			{IncludeRepos: []string{"whosonfirst-data-admin-ca"}},
+			{Filters: propertyFilters(t, "properties.wof:country=^CA$", "properties.mz:is_funky!=^1$")},
+			{Filters: propertyFilters(t, "properties.wof:country=^US$", "properties.wof:placetype=locality"), FilterMode: FilterModeOr},
+			{Filters: propertyFilters(t, "properties.wof:country=^US$", "properties.wof:placetype!=region"), FilterMode: FilterModeOr},
+		},
+		false: {
+			{IncludePlacetypes: []string{"region"}},
+			{ExcludePlacetypes: []string{"locality"}},
+			{IsCurrent: []int64{0, -1}},
+			{IsCeased: []int64{1}},
+			{IncludeRepos: []string{"whosonfirst-data-admin-us"}},
+			{Filters: propertyFilters(t, "properties.wof:country=^US$", "properties.wof:placetype=locality")},
+			{Filters: propertyFilters(t, "properties.wof:placetype!=locality")},
+			{Filters: propertyFilters(t, "properties.wof:country=^US$", "properties.wof:placetype!=locality"), FilterMode: FilterModeOr},
+		},
+	}
+
+	for expected, candidates := range tests {
+
+		for i, opts := range candidates {
+
+			include, err := includeRecord(ctx, opts, body)
+
+			if err != nil {
+				t.Fatalf("Failed to filter record (%t, %d), %v", expected, i, err)
+			}
+
+			if include != expected {
+				t.Fatalf("Expected record to be included: %t (%d), got %t", expected, i, include)
+			}
+		}
+	}
+}
+
+func TestFilterAltFiles(t *testing.T) {
+
+	ctx := context.Background()
+
+	body, err := os.ReadFile("fixtures/data/101/736/545/101736545.geojson")
+
+	if err != nil {
+		t.Fatalf("Failed to read fixture, %v", err)
+	}
+
+	alt_body := validationFixture(t, func(props map[string]interface{}, geom map[string]interface{}) {
+		props["src:alt_label"] = "quattroshapes"
+	})
+
+	path := "101/736/545/101736545.geojson"
+	alt_path := "101/736/545/101736545-alt-quattroshapes.geojson"
+
+	for _, expected := range []bool{true, false} {
+
+		for _, alt_first := range []bool{true, false} {
+
+			pending := NewPendingAlts()
+			defer pending.Close()
+
+			var filtered int64
+
+			opts := &SQLiteFeaturesLoadRecordFuncOptions{
+				PendingAlts: pending,
+				Filtered:    &filtered,
+			}
+
+			if expected {
+				opts.IncludePlacetypes = []string{"locality"}
+			} else {
+				opts.ExcludePlacetypes = []string{"locality"}
+			}
+
+			load_record := SQLiteFeaturesLoadRecordFunc(opts)
+
+			load := func(path string, body []byte) bool {
+
+				record, err := load_record(ctx, path, bytes.NewReader(body))
+
+				if err != nil {
+					t.Fatalf("Failed to load %s, %v", path, err)
+				}
+
+				return record != nil
+			}
+
+			alt_included := false
+
+			if alt_first {
+
+				if load(alt_path, alt_body) {
+					t.Fatalf("Expected alt file to be pending when it is encountered before its principal record")
+				}
+			}
+
+			if load(path, body) != expected {
+				t.Fatalf("Expected principal record to be included: %t", expected)
+			}
+
+			if alt_first {
+
+				err = pending.Replay(func(path string, body []byte) error {
+					alt_included = load(path, body)
+					return nil
+				})
+
+				if err != nil {
+					t.Fatalf("Failed to replay pending alts, %v", err)
+				}
+
+			} else {
+				alt_included = load(alt_path, alt_body)
+			}
+
+			if alt_included != expected {
+				t.Fatalf("Expected alt file to be included (alt first: %t): %t", alt_first, expected)
+			}
+
+			expected_filtered := int64(0)
+
+			if !expected {
+				expected_filtered = 2
+			}
+
+			if filtered != expected_filtered {
+				t.Fatalf("Expected %d filtered records (alt first: %t), got %d", expected_filtered, alt_first, filtered)
+			}
+		}
+	}
+}
+
+// propertyFilters returns the list of `PropertyFilter` instances derived from 'filters'.
+func propertyFilters(t *testing.T, filters ...string) []*PropertyFilter {
+
+	property_filters := make([]*PropertyFilter, len(filters))
+
+	for i, str := range filters {
+
+		f, err := NewPropertyFilter(str)
+
+		if err != nil {
+			t.Fatalf("Failed to create property filter '%s', %v", str, err)
+		}
+
+		property_filters[i] = f
+	}
+
+	return property_filters
+}
+
+func TestNewPropertyFilter(t *testing.T) {
+
+	tests := map[string]bool{
+		"properties.wof:country=^US$":                                  false,
+		"properties.mz:is_funky!=1":                                    true,
+		"properties.wof:hierarchy.#(country_id==85633041).region_id=.": false,
+	}
+
+	for str, negate := range tests {
+
+		f, err := NewPropertyFilter(str)
+
+		if err != nil {
+			t.Fatalf("Failed to parse property filter '%s', %v", str, err)
+		}
+
+		if f.Negate != negate {
+			t.Fatalf("Expected '%s' negate to be %t", str, negate)
+		}
+	}
+
+	for _, str := range []string{"properties.wof:country", "=^US$", "!=1", "properties.wof:country=[US"} {
+
+		_, err := NewPropertyFilter(str)
+
+		if err == nil {
+			t.Fatalf("Expected property filter '%s' to fail", str)
+		}
+	}
+}
+
+func TestSpatialFilter(t *testing.T) {
+
+	ctx := context.Background()
+
+	body, err := os.ReadFile("fixtures/data/101/736/545/101736545.geojson")
+
+	if err != nil {
+		t.Fatalf("Failed to read fixture, %v", err)
+	}
+
+	tests := map[string]bool{
+		// Contains the record
+		"-74,45,-73,46": true,
+		// Contained by the record
+		"-73.59,45.57,-73.58,45.58": true,
+		// Overlaps the record
+		"-73.6,45.5,-73.0,45.6": true,
+		// Disjoint from the record
+		"-122.5,37.7,-122.3,37.8": false,
+		// Intersects the record's bounding box but not its geometry
+		"-73.49,45.415,-73.48,45.425": false,
+	}
+
+	for bbox, expected := range tests {
+
+		f, err := NewSpatialFilterFromBbox(bbox)
+
+		if err != nil {
+			t.Fatalf("Failed to create spatial filter for %s, %v", bbox, err)
+		}
+
+		opts := &SQLiteFeaturesLoadRecordFuncOptions{
+			SpatialFilter: f,
+		}
+
+		include, err := includeRecord(ctx, opts, body)
+
+		if err != nil {
+			t.Fatalf("Failed to filter record for %s, %v", bbox, err)
+		}
+
+		if include != expected {
+			t.Fatalf("Expected record to be included by %s: %t, got %t", bbox, expected, include)
+		}
+	}
+
+	f, err := NewSpatialFilterFromGeoJSON([]byte(`{"type":"Feature","properties":{},"geometry":{"type":"Polygon","coordinates":[[[0,0],[0,2],[2,2],[2,0],[0,0]]]}}`))
+
+	if err != nil {
+		t.Fatalf("Failed to create spatial filter from GeoJSON, %v", err)
+	}
+
+	crossing := orb.LineString{{-1, 1}, {3, 1}}
+
+	if !f.Intersects(crossing) {
+		t.Fatalf("Expected line string to intersect spatial filter")
+	}
+
+	outside := orb.Point{3, 3}
+
+	if f.Intersects(outside) {
+		t.Fatalf("Expected point to not intersect spatial filter")
+	}
+
+	for _, bbox := range []string{"1,2,3", "1,2,0,0", "a,b,c,d"} {
+
+		_, err := NewSpatialFilterFromBbox(bbox)
+
+		if err == nil {
+			t.Fatalf("Expected bounding box '%s' to fail", bbox)
+		}
+	}
+}
+
+func TestPropertiesTransform(t *testing.T) {
+
+	ctx := context.Background()
+
+	body, err := os.ReadFile("fixtures/data/101/736/545/101736545.geojson")
+
+	if err != nil {
+		t.Fatalf("Failed to read fixture, %v", err)
+	}
+
+	transform_opts := &PropertiesTransformOptions{
+		Include: []string{"properties.name:*", "wof:concordances"},
+		Exclude: []string{"name:*_x_variant", "wof:concordances.gn:id", "edtf:*"},
+	}
+
+	fn, err := NewPropertiesTransformFunc(transform_opts)
+
+	if err != nil {
+		t.Fatalf("Failed to create properties transform, %v", err)
+	}
+
+	new_body, err := fn(ctx, "101736545.geojson", body)
+
+	if err != nil {
+		t.Fatalf("Failed to transform record, %v", err)
+	}
+
+	tests := map[string]bool{
+		"properties.wof:id":                 true,
+		"properties.wof:placetype":          true,
+		"properties.name:fra_x_preferred":   true,
+		"properties.name:afr_x_variant":     false,
+		"properties.wof:concordances.gp:id": true,
+		"properties.wof:concordances.gn:id": false,
+		"properties.edtf:inception":         false,
+		"properties.wof:geomhash":           false,
+		"properties.geom:area":              false,
+		"geometry.type":                     true,
+	}
+
+	for path, expected := range tests {
+
+		if gjson.GetBytes(new_body, path).Exists() != expected {
+			t.Fatalf("Expected %s to exist: %t", path, expected)
+		}
+	}
+
+	for _, p := range []string{"[", "wof:concordances..gn:id"} {
+
+		_, err := NewPropertiesTransformFunc(&PropertiesTransformOptions{Exclude: []string{p}})
+
+		if err == nil {
+			t.Fatalf("Expected property path '%s' to fail", p)
+		}
+	}
+}
+
+func TestGeometryTransform(t *testing.T) {
+
+	ctx := context.Background()
+
+	path_data, err := filepath.Abs("fixtures/data")
+
+	if err != nil {
+		t.Fatalf("Failed to determine path for fixtures, %v", err)
+	}
+
+	body, err := os.ReadFile(filepath.Join(path_data, "101/736/545/101736545.geojson"))
+
+	if err != nil {
+		t.Fatalf("Failed to read fixture, %v", err)
+	}
+
+	geometry_size := func(body []byte) int {
+		return len(gjson.GetBytes(body, "geometry").Raw)
+	}
+
+	tolerances := map[SimplifyAlgorithm]float64{
+		"":                              0.001,
+		SimplifyAlgorithmDouglasPeucker: 0.001,
+		SimplifyAlgorithmVisvalingam:    0.000001,
+	}
+
+	simplified := make(map[SimplifyAlgorithm]string)
+
+	for algorithm, tolerance := range tolerances {
+
+		fn, err := NewGeometryTransformFunc(&GeometryTransformOptions{Algorithm: algorithm, Tolerance: tolerance, Precision: 4})
+
+		if err != nil {
+			t.Fatalf("Failed to create geometry transform (%s), %v", algorithm, err)
+		}
+
+		new_body, err := fn(ctx, "101736545.geojson", body)
+
+		if err != nil {
+			t.Fatalf("Failed to transform record (%s), %v", algorithm, err)
+		}
+
+		if geometry_size(new_body) >= geometry_size(body) {
+			t.Fatalf("Expected simplified geometry (%s) to be smaller than the original", algorithm)
+		}
+
+		violations := validateRecord(ctx, []ValidationRule{NewValidationRule(VALIDATE_RINGS, validateRings)}, new_body)
+
+		if len(violations) > 0 {
+			t.Fatalf("Simplified geometry (%s) is invalid, %s", algorithm, violations[0].Error)
+		}
+
+		for _, c := range gjson.GetBytes(new_body, "geometry.coordinates.0.0").Array() {
+
+			for _, v := range c.Array() {
+
+				parts := strings.SplitN(v.Raw, ".", 2)
+
+				if len(parts) == 2 && len(parts[1]) > 4 {
+					t.Fatalf("Coordinate %s was not rounded (%s)", v.Raw, algorithm)
+				}
+			}
+		}
+
+		simplified[algorithm] = gjson.GetBytes(new_body, "geometry").Raw
+	}
+
+	if simplified[""] != simplified[SimplifyAlgorithmDouglasPeucker] {
+		t.Fatalf("Expected the default algorithm to be %s", SimplifyAlgorithmDouglasPeucker)
+	}
+
+	if simplified[SimplifyAlgorithmVisvalingam] == simplified[SimplifyAlgorithmDouglasPeucker] {
+		t.Fatalf("Expected %s and %s algorithms to produce different geometries", SimplifyAlgorithmVisvalingam, SimplifyAlgorithmDouglasPeucker)
+	}
+
+	_, err = NewGeometryTransformFunc(&GeometryTransformOptions{Algorithm: "radial", Tolerance: 0.001})
+
+	if err == nil {
+		t.Fatalf("Expected invalid algorithm to fail")
+	}
+
+	tr, err := NewRecordTransformer(ctx, "geometry://?tolerance=0.000001&precision=4&algorithm=visvalingam")
+
+	if err != nil {
+		t.Fatalf("Failed to create geometry transformer, %v", err)
+	}
+
+	tr_body, err := tr.Transform(ctx, "101736545.geojson", body)
+
+	if err != nil {
+		t.Fatalf("Failed to transform record with transformer, %v", err)
+	}
+
+	if gjson.GetBytes(tr_body, "geometry").Raw != simplified[SimplifyAlgorithmVisvalingam] {
+		t.Fatalf("Expected geometry transformer to use the %s algorithm", SimplifyAlgorithmVisvalingam)
+	}
+
+	fn, err := NewGeometryTransformFunc(&GeometryTransformOptions{Tolerance: 0.001, Precision: 4})
+
+	if err != nil {
+		t.Fatalf("Failed to create geometry transform, %v", err)
+	}
+
+	new_body, err := fn(ctx, "101736545.geojson", body)
+
+	if err != nil {
+		t.Fatalf("Failed to transform record, %v", err)
+	}
+
+	// Rings which would be simplified to fewer than four positions are left unchanged
+
+	small_body := []byte(`{"type":"Feature","properties":{},"geometry":{"type":"Polygon","coordinates":[[[0,0],[0.0001,0],[0.0001,0.0001],[0,0.0001],[0,0]]]}}`)
+
+	small_fn, err := NewGeometryTransformFunc(&GeometryTransformOptions{Tolerance: 1})
+
+	if err != nil {
+		t.Fatalf("Failed to create geometry transform, %v", err)
+	}
+
+	new_small_body, err := small_fn(ctx, "small.geojson", small_body)
+
+	if err != nil {
+		t.Fatalf("Failed to transform small record, %v", err)
+	}
+
+	if len(gjson.GetBytes(new_small_body, "geometry.coordinates.0").Array()) != 5 {
+		t.Fatalf("Expected small ring to be left unchanged, got %s", gjson.GetBytes(new_small_body, "geometry").Raw)
+	}
+
+	// Ensure that the 'rtree' table indexes the original geometry
+
+	db_uri := "modernc://mem"
+
+	db, err := sqlite.NewDatabase(ctx, db_uri)
+
+	if err != nil {
+		t.Fatalf("Unable to create database (%s) because %v", db_uri, err)
+	}
+
+	defer db.Close(ctx)
+
+	gt, err := tables.NewGeoJSONTableWithDatabase(ctx, db)
+
+	if err != nil {
+		t.Fatalf("failed to create 'geojson' table because %v", err)
+	}
+
+	rt, err := tables.NewRTreeTableWithDatabase(ctx, db)
+
+	if err != nil {
+		t.Fatalf("failed to create 'rtree' table because %v", err)
+	}
+
+	originals := NewOriginalRecords()
+
+	record_opts := &SQLiteFeaturesLoadRecordFuncOptions{
+		Transformer:     fn,
+		OriginalRecords: originals,
+	}
+
+	idx_opts := &sql_index.SQLiteIndexerOptions{
+		DB:             db,
+		Tables:         []sqlite.Table{gt, originals.Table(rt)},
+		LoadRecordFunc: SQLiteFeaturesLoadRecordFunc(record_opts),
+		PostIndexFunc:  originals.PostIndexFunc(nil),
+	}
+
+	idx, err := sql_index.NewSQLiteIndexer(idx_opts)
+
+	if err != nil {
+		t.Fatalf("Failed to create sqlite indexer because %v", err)
+	}
+
+	err = idx.IndexURIs(ctx, "directory://", path_data)
+
+	if err != nil {
+		t.Fatalf("Failed to index paths, %v", err)
+	}
+
+	conn, err := db.Conn(ctx)
+
+	if err != nil {
+		t.Fatalf("Failed to connect to database, %v", err)
+	}
+
+	var indexed_body string
+
+	err = conn.QueryRow("SELECT body FROM geojson").Scan(&indexed_body)
+
+	if err != nil {
+		t.Fatalf("Failed to query geojson table, %v", err)
+	}
+
+	if indexed_body != string(new_body) {
+		t.Fatalf("Expected geojson table to index the transformed record")
+	}
+
+	var min_x float64
+
+	err = conn.QueryRow("SELECT MIN(min_x) FROM rtree").Scan(&min_x)
+
+	if err != nil {
+		t.Fatalf("Failed to query rtree table, %v", err)
+	}
+
+	// geom:bbox is -73.947552,45.414591,-73.476198,45.703798 and the rtree table stores 32-bit floats
+
+	if math.Abs(min_x-(-73.947552)) > 0.00001 {
+		t.Fatalf("Expected rtree table to index the original geometry, got min_x of %f", min_x)
+	}
+
+	count := 0
+
+	originals.records.Range(func(k interface{}, v interface{}) bool {
+		count += 1
+		return true
+	})
+
+	if count != 0 {
+		t.Fatalf("Expected original records to be removed once indexed, got %d", count)
+	}
+}
+
+func TestRecordTransformer(t *testing.T) {
+
+	ctx := context.Background()
+
+	body, err := os.ReadFile("fixtures/data/101/736/545/101736545.geojson")
+
+	if err != nil {
+		t.Fatalf("Failed to read fixture, %v", err)
+	}
+
+	err = RegisterRecordTransformer(ctx, "testpath", func(ctx context.Context, uri string) (RecordTransformer, error) {
+
+		fn := func(ctx context.Context, path string, body []byte) ([]byte, error) {
+
+			var f map[string]interface{}
+
+			err := json.Unmarshal(body, &f)
+
+			if err != nil {
+				return nil, err
+			}
+
+			f["properties"].(map[string]interface{})["test:path"] = path
+			return json.Marshal(f)
+		}
+
+		return RecordTransformFunc(fn), nil
+	})
+
+	if err != nil {
+		t.Fatalf("Failed to register transformer, %v", err)
+	}
+
+	transformers := make([]RecordTransformer, 0)
+
+	for _, transformer_uri := range []string{"null://", "testpath://", "properties://?exclude=edtf:*&exclude=test:*", "geometry://?precision=2"} {
+
+		tr, err := NewRecordTransformer(ctx, transformer_uri)
+
+		if err != nil {
+			t.Fatalf("Failed to create transformer (%s), %v", transformer_uri, err)
+		}
+
+		transformers = append(transformers, tr)
+	}
+
+	// The properties:// transformer should remove the property added by testpath://
+
+	new_body, err := NewChainedRecordTransformer(transformers...).Transform(ctx, "101736545.geojson", body)
+
+	if err != nil {
+		t.Fatalf("Failed to transform record, %v", err)
+	}
+
+	if gjson.GetBytes(new_body, "properties.test:path").Exists() {
+		t.Fatalf("Expected test:path property to be removed")
+	}
+
+	if gjson.GetBytes(new_body, "properties.edtf:inception").Exists() {
+		t.Fatalf("Expected edtf:inception property to be removed")
+	}
+
+	new_body, err = NewChainedRecordTransformer(transformers[1]).Transform(ctx, "101736545.geojson", body)
+
+	if err != nil {
+		t.Fatalf("Failed to transform record, %v", err)
+	}
+
+	if gjson.GetBytes(new_body, "properties.test:path").String() != "101736545.geojson" {
+		t.Fatalf("Expected test:path property to be the path of the record")
+	}
+
+	if !slices.Contains(RecordTransformerSchemes(), "testpath://") {
+		t.Fatalf("Expected testpath:// to be a registered scheme")
+	}
+
+	for _, transformer_uri := range []string{"missing://", "geometry://?precision=-1", "properties://?exclude=["} {
+
+		_, err := NewRecordTransformer(ctx, transformer_uri)
+
+		if err == nil {
+			t.Fatalf("Expected transformer (%s) to fail", transformer_uri)
+		}
+	}
+}
+
+func TestFeatureTables(t *testing.T) {
+
+	ctx := context.Background()
+
+	body, err := os.ReadFile("fixtures/data/101/736/545/101736545.geojson")
+
+	if err != nil {
+		t.Fatalf("Failed to read fixture, %v", err)
+	}
+
+	db_uri := fmt.Sprintf("modernc://%s", filepath.Join(t.TempDir(), "features.db"))
+
+	db, err := sqlite.NewDatabase(ctx, db_uri)
+
+	if err != nil {
+		t.Fatalf("Unable to create database (%s) because %v", db_uri, err)
+	}
+
+	defer db.Close(ctx)
+
+	gt, err := NewTable(ctx, "geojson", db, nil)
+
+	if err != nil {
+		t.Fatalf("Failed to create geojson table, %v", err)
+	}
+
+	rt, err := NewTable(ctx, "rtree", db, nil)
+
+	if err != nil {
+		t.Fatalf("Failed to create rtree table, %v", err)
+	}
+
+	for _, tbl := range []sqlite.Table{gt, rt} {
+
+		_, ok := tbl.(FeatureTable)
+
+		if !ok {
+			t.Fatalf("Expected %s table to implement FeatureTable", tbl.Name())
+		}
+
+		err := tbl.IndexRecord(ctx, db, body)
+
+		if err != nil {
+			t.Fatalf("Failed to index record in %s table, %v", tbl.Name(), err)
+		}
+	}
+
+	// Tables which do not declare their ID column are skipped
+
+	undeclared, err := tables.NewGeoJSONTableWithDatabase(ctx, db)
+
+	if err != nil {
+		t.Fatalf("Failed to create undeclared geojson table, %v", err)
+	}
+
+	ids, err := FeatureIds(ctx, db, []sqlite.Table{undeclared})
+
+	if err != nil {
+		t.Fatalf("Failed to derive feature IDs from undeclared table, %v", err)
+	}
+
+	if len(ids) != 0 {
+		t.Fatalf("Expected no IDs from undeclared table, got %v", ids)
+	}
+
+	ids, err = FeatureIds(ctx, db, []sqlite.Table{gt, rt})
+
+	if err != nil {
+		t.Fatalf("Failed to derive feature IDs, %v", err)
+	}
+
+	if !slices.Equal(ids, []int64{101736545}) {
+		t.Fatalf("Unexpected feature IDs, %v", ids)
+	}
+
+	err = RemoveFeatures(ctx, db, []sqlite.Table{undeclared}, ids)
+
+	if err != nil {
+		t.Fatalf("Failed to remove features from undeclared table, %v", err)
+	}
+
+	remaining, err := FeatureIds(ctx, db, []sqlite.Table{gt})
+
+	if err != nil {
+		t.Fatalf("Failed to derive feature IDs, %v", err)
+	}
+
+	if len(remaining) != 1 {
+		t.Fatalf("Expected undeclared table to be left untouched, got %v", remaining)
+	}
+
+	err = RemoveFeatures(ctx, db, []sqlite.Table{gt, rt}, ids)
+
+	if err != nil {
+		t.Fatalf("Failed to remove features, %v", err)
+	}
+
+	remaining, err = FeatureIds(ctx, db, []sqlite.Table{gt, rt})
+
+	if err != nil {
+		t.Fatalf("Failed to derive feature IDs, %v", err)
+	}
+
+	if len(remaining) != 0 {
+		t.Fatalf("Expected all features to be removed, got %v", remaining)
+	}
+}
+
+func TestRecordCounts(t *testing.T) {
+
+	ctx := context.Background()
+
+	body, err := os.ReadFile("fixtures/data/101/736/545/101736545.geojson")
+
+	if err != nil {
+		t.Fatalf("Failed to read fixture, %v", err)
+	}
+
+	db_uri := fmt.Sprintf("modernc://%s", filepath.Join(t.TempDir(), "counts.db"))
+
+	db, err := sqlite.NewDatabase(ctx, db_uri)
+
+	if err != nil {
+		t.Fatalf("Unable to create database (%s) because %v", db_uri, err)
+	}
+
+	defer db.Close(ctx)
+
+	gt, err := NewTable(ctx, "geojson", db, nil)
+
+	if err != nil {
+		t.Fatalf("Failed to create geojson table, %v", err)
+	}
+
+	counts := NewRecordCounts()
+
+	wrapped_gt := counts.Table(gt)
+	wrapped_ft := counts.Table(&failingTable{})
+
+	if _, ok := wrapped_gt.(FeatureTable); !ok {
+		t.Fatalf("Expected wrapped geojson table to implement FeatureTable")
+	}
+
+	for i := 0; i < 2; i++ {
+
+		err := wrapped_gt.IndexRecord(ctx, db, body)
+
+		if err != nil {
+			t.Fatalf("Failed to index record, %v", err)
+		}
+
+		err = wrapped_ft.IndexRecord(ctx, db, body)
+
+		if err == nil {
+			t.Fatalf("Expected failing table to return an error")
+		}
+	}
+
+	c := counts.Counts()
+
+	if c["geojson"] != 2 {
+		t.Fatalf("Expected 2 records indexed by geojson table, got %d", c["geojson"])
+	}
+
+	v, ok := c["failing"]
+
+	if !ok || v != 0 {
+		t.Fatalf("Expected failing table to be counted as zero, got %v", c)
+	}
+}
+
+func TestIndexMeta(t *testing.T) {
+
+	ctx := context.Background()
+
+	db_uri := fmt.Sprintf("modernc://%s", filepath.Join(t.TempDir(), "meta.db"))
+
+	db, err := sqlite.NewDatabase(ctx, db_uri)
+
+	if err != nil {
+		t.Fatalf("Unable to create database (%s) because %v", db_uri, err)
+	}
+
+	defer db.Close(ctx)
+
+	runs, err := ReadIndexMeta(ctx, db)
+
+	if err != nil {
+		t.Fatalf("Failed to read index meta, %v", err)
+	}
+
+	if len(runs) != 0 {
+		t.Fatalf("Expected no runs, got %d", len(runs))
+	}
+
+	_, err = LatestIndexMeta(ctx, db)
+
+	if err == nil {
+		t.Fatalf("Expected latest index meta to fail when no runs have been recorded")
+	}
+
+	now := time.Now()
+
+	for i, count := range []int64{1, 2} {
+
+		meta := &IndexMeta{
+			Started:     now.Add(time.Duration(i) * time.Minute),
+			Finished:    now.Add(time.Duration(i+1) * time.Minute),
+			IteratorURI: "repo://",
+			URIs:        []string{"/usr/local/data/whosonfirst-data-admin-ca"},
+			Tables:      []string{"geojson"},
+			Counts:      map[string]int64{"geojson": count},
+			Modules:     ModuleVersions(),
+		}
+
+		err = WriteIndexMeta(ctx, db, meta)
+
+		if err != nil {
+			t.Fatalf("Failed to write index meta, %v", err)
+		}
+	}
+
+	runs, err = ReadIndexMeta(ctx, db)
+
+	if err != nil {
+		t.Fatalf("Failed to read index meta, %v", err)
+	}
+
+	if len(runs) != 2 {
+		t.Fatalf("Expected 2 runs, got %d", len(runs))
+	}
+
+	latest, err := LatestIndexMeta(ctx, db)
+
+	if err != nil {
+		t.Fatalf("Failed to read latest index meta, %v", err)
+	}
+
+	if latest.Id != runs[1].Id || latest.Id <= runs[0].Id {
+		t.Fatalf("Unexpected latest run ID %d", latest.Id)
+	}
+
+	if latest.Counts["geojson"] != 2 {
+		t.Fatalf("Unexpected geojson count for latest run, %d", latest.Counts["geojson"])
+	}
+
+	if !latest.Started.Equal(now.Add(time.Minute)) {
+		t.Fatalf("Unexpected start time for latest run, %v", latest.Started)
+	}
+
+	if latest.Modules["go"] == "" {
+		t.Fatalf("Expected Go version to be recorded")
+	}
+}
+
+func TestBatchDatabaseRollback(t *testing.T) {
+
+	ctx := context.Background()
+
+	body, err := os.ReadFile("fixtures/data/101/736/545/101736545.geojson")
+
+	if err != nil {
+		t.Fatalf("Failed to read fixture, %v", err)
+	}
+
+	db_uri := fmt.Sprintf("modernc://%s", filepath.Join(t.TempDir(), "rollback.db"))
+
+	db, err := sqlite.NewDatabase(ctx, db_uri)
+
+	if err != nil {
+		t.Fatalf("Unable to create database (%s) because %v", db_uri, err)
+	}
+
+	bdb, err := NewBatchDatabase(ctx, db)
+
+	if err != nil {
+		t.Fatalf("Failed to create batch database, %v", err)
+	}
+
+	defer bdb.Close(ctx)
+
+	gt, err := tables.NewGeoJSONTableWithDatabase(ctx, bdb)
+
+	if err != nil {
+		t.Fatalf("Failed to create geojson table, %v", err)
+	}
+
+	count_records := func() int {
+
+		conn, err := bdb.Conn(ctx)
+
+		if err != nil {
+			t.Fatalf("Failed to establish database connection, %v", err)
+		}
+
+		var count int
+
+		err = conn.QueryRowContext(ctx, "SELECT COUNT(id) FROM geojson").Scan(&count)
+
+		if err != nil {
+			t.Fatalf("Failed to count records, %v", err)
+		}
+
+		return count
+	}
+
+	err = bdb.BeginBatch(ctx)
+
+	if err != nil {
+		t.Fatalf("Failed to begin batch, %v", err)
+	}
+
+	err = gt.IndexRecord(ctx, bdb, body)
+
+	if err != nil {
+		t.Fatalf("Failed to index record, %v", err)
+	}
+
+	if count_records() != 1 {
+		t.Fatalf("Expected record to be visible inside batch")
+	}
+
+	err = bdb.RollbackBatch(ctx)
+
+	if err != nil {
+		t.Fatalf("Failed to roll back batch, %v", err)
+	}
+
+	if count_records() != 0 {
+		t.Fatalf("Expected record to be rolled back, got %d records", count_records())
+	}
+
+	err = bdb.RollbackBatch(ctx)
+
+	if err != nil {
+		t.Fatalf("Expected rolling back a closed batch to be a no-op, %v", err)
+	}
+
+	// Transactions started inside a batch are savepoints which can be rolled back individually
+
+	conn, err := bdb.Conn(ctx)
+
+	if err != nil {
+		t.Fatalf("Failed to establish database connection, %v", err)
+	}
+
+	_, err = conn.ExecContext(ctx, "CREATE TABLE savepoints (id INTEGER)")
+
+	if err != nil {
+		t.Fatalf("Failed to create savepoints table, %v", err)
+	}
+
+	err = bdb.BeginBatch(ctx)
+
+	if err != nil {
+		t.Fatalf("Failed to begin batch, %v", err)
+	}
+
+	for _, id := range []int{1, 2} {
+
+		tx, err := conn.Begin()
+
+		if err != nil {
+			t.Fatalf("Failed to begin transaction, %v", err)
+		}
+
+		_, err = tx.Exec("INSERT INTO savepoints (id) VALUES (?)", id)
+
+		if err != nil {
+			t.Fatalf("Failed to insert %d, %v", id, err)
+		}
+
+		switch id {
+		case 1:
+			err = tx.Commit()
+		default:
+			err = tx.Rollback()
+		}
+
+		if err != nil {
+			t.Fatalf("Failed to end transaction for %d, %v", id, err)
+		}
+	}
+
+	err = bdb.CommitBatch(ctx)
+
+	if err != nil {
+		t.Fatalf("Failed to commit batch, %v", err)
+	}
+
+	var ids string
+
+	err = conn.QueryRowContext(ctx, "SELECT GROUP_CONCAT(id) FROM savepoints").Scan(&ids)
+
+	if err != nil {
+		t.Fatalf("Failed to query savepoints table, %v", err)
+	}
+
+	if ids != "1" {
+		t.Fatalf("Expected only the committed savepoint to be written, got '%s'", ids)
+	}
+
+	// Closing the database rolls back, rather than commits, the current batch
+
+	err = bdb.BeginBatch(ctx)
+
+	if err != nil {
+		t.Fatalf("Failed to begin batch, %v", err)
+	}
+
+	tx, err := conn.Begin()
+
+	if err != nil {
+		t.Fatalf("Failed to begin transaction, %v", err)
+	}
+
+	_, err = tx.Exec("INSERT INTO savepoints (id) VALUES (?)", 3)
+
+	if err != nil {
+		t.Fatalf("Failed to insert 3, %v", err)
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		t.Fatalf("Failed to end transaction for 3, %v", err)
+	}
+
+	err = bdb.Close(ctx)
+
+	if err != nil {
+		t.Fatalf("Failed to close batch database, %v", err)
+	}
+
+	db, err = sqlite.NewDatabase(ctx, db_uri)
+
+	if err != nil {
+		t.Fatalf("Unable to reopen database (%s) because %v", db_uri, err)
+	}
+
+	defer db.Close(ctx)
+
+	reopened, err := db.Conn(ctx)
+
+	if err != nil {
+		t.Fatalf("Failed to establish database connection, %v", err)
+	}
+
+	err = reopened.QueryRowContext(ctx, "SELECT GROUP_CONCAT(id) FROM savepoints").Scan(&ids)
+
+	if err != nil {
+		t.Fatalf("Failed to query savepoints table, %v", err)
+	}
+
+	if ids != "1" {
+		t.Fatalf("Expected the open batch to be rolled back when closing the database, got '%s'", ids)
+	}
+}
+
+func TestRecordBatcher(t *testing.T) {
+
+	ctx := context.Background()
+
+	body, err := os.ReadFile("fixtures/data/101/736/545/101736545.geojson")
+
+	if err != nil {
+		t.Fatalf("Failed to read fixture, %v", err)
+	}
+
+	db_uri := fmt.Sprintf("modernc://%s", filepath.Join(t.TempDir(), "batch.db"))
+
+	db, err := sqlite.NewDatabase(ctx, db_uri)
+
+	if err != nil {
+		t.Fatalf("Unable to create database (%s) because %v", db_uri, err)
+	}
+
+	bdb, err := NewBatchDatabase(ctx, db)
+
+	if err != nil {
+		t.Fatalf("Failed to create batch database, %v", err)
+	}
+
+	defer bdb.Close(ctx)
+
+	gt, err := tables.NewGeoJSONTableWithDatabase(ctx, bdb)
+
+	if err != nil {
+		t.Fatalf("Failed to create geojson table, %v", err)
+	}
+
+	to_index := []sqlite.Table{gt}
+
+	in_tx := func() bool {
+		bdb.mu.Lock()
+		defer bdb.mu.Unlock()
+		return bdb.in_tx
+	}
+
+	index_record := func(post_func sql_index.SQLiteIndexerPostIndexFunc, id int64) {
+
+		record := bytes.Replace(body, []byte(`"wof:id":101736545`), []byte(fmt.Sprintf(`"wof:id":%d`, id)), 1)
+
+		bdb.Lock(ctx)
+		defer bdb.Unlock(ctx)
+
+		err := gt.IndexRecord(ctx, bdb, record)
+
+		if err != nil {
+			t.Fatalf("Failed to index %d, %v", id, err)
+		}
+
+		err = post_func(ctx, bdb, to_index, record)
+
+		if err != nil {
+			t.Fatalf("Failed to post-index %d, %v", id, err)
+		}
+	}
+
+	_, err = NewRecordBatcher(ctx, bdb, &RecordBatcherOptions{Size: 0})
+
+	if err == nil {
+		t.Fatalf("Expected zero batch size to fail")
+	}
+
+	// Commit every two records
+
+	batcher, err := NewRecordBatcher(ctx, bdb, &RecordBatcherOptions{Size: 2})
+
+	if err != nil {
+		t.Fatalf("Failed to create record batcher, %v", err)
+	}
+
+	post_func := batcher.PostIndexFunc(nil)
+
+	index_record(post_func, 1)
+
+	if !in_tx() {
+		t.Fatalf("Expected transaction to be open after first record")
+	}
+
+	index_record(post_func, 2)
+
+	if in_tx() {
+		t.Fatalf("Expected transaction to be committed after second record")
+	}
+
+	index_record(post_func, 3)
+
+	err = batcher.Close(ctx)
+
+	if err != nil {
+		t.Fatalf("Failed to close record batcher, %v", err)
+	}
+
+	if in_tx() {
+		t.Fatalf("Expected transaction to be committed after closing batcher")
+	}
+
+	// Commit after an interval, regardless of the number of records
+
+	batcher, err = NewRecordBatcher(ctx, bdb, &RecordBatcherOptions{Size: 100, Interval: 50 * time.Millisecond})
+
+	if err != nil {
+		t.Fatalf("Failed to create record batcher, %v", err)
+	}
+
+	index_record(batcher.PostIndexFunc(nil), 4)
+
+	if !in_tx() {
+		t.Fatalf("Expected transaction to be open after first record")
+	}
+
+	time.Sleep(250 * time.Millisecond)
+
+	if in_tx() {
+		t.Fatalf("Expected transaction to be committed after interval")
+	}
+
+	err = batcher.Close(ctx)
+
+	if err != nil {
+		t.Fatalf("Failed to close record batcher, %v", err)
+	}
+
+	conn, err := bdb.Conn(ctx)
+
+	if err != nil {
+		t.Fatalf("Failed to establish database connection, %v", err)
+	}
+
+	var count int
+
+	err = conn.QueryRow("SELECT COUNT(id) FROM geojson").Scan(&count)
+
+	if err != nil {
+		t.Fatalf("Failed to count geojson records, %v", err)
+	}
+
+	if count != 4 {
+		t.Fatalf("Expected 4 geojson records, got %d", count)
+	}
+
+	// Rolling back discards the current transaction
+
+	batcher, err = NewRecordBatcher(ctx, bdb, &RecordBatcherOptions{Size: 100})
+
+	if err != nil {
+		t.Fatalf("Failed to create record batcher, %v", err)
+	}
+
+	index_record(batcher.PostIndexFunc(nil), 5)
+
+	err = batcher.Rollback(ctx)
+
+	if err != nil {
+		t.Fatalf("Failed to roll back record batcher, %v", err)
+	}
+
+	err = batcher.Close(ctx)
+
+	if err != nil {
+		t.Fatalf("Expected closing a rolled back batcher to be a no-op, %v", err)
+	}
+
+	err = conn.QueryRow("SELECT COUNT(id) FROM geojson").Scan(&count)
+
+	if err != nil {
+		t.Fatalf("Failed to count geojson records, %v", err)
+	}
+
+	if count != 4 {
+		t.Fatalf("Expected 4 geojson records after rolling back, got %d", count)
+	}
+}
+
+func TestRecordBatcherRollback(t *testing.T) {
+
+	ctx := context.Background()
+
+	body, err := os.ReadFile("fixtures/data/101/736/545/101736545.geojson")
+
+	if err != nil {
+		t.Fatalf("Failed to read fixture, %v", err)
+	}
+
+	db_uri := fmt.Sprintf("modernc://%s", filepath.Join(t.TempDir(), "batch.db"))
+
+	db, err := sqlite.NewDatabase(ctx, db_uri)
+
+	if err != nil {
+		t.Fatalf("Unable to create database (%s) because %v", db_uri, err)
+	}
+
+	bdb, err := NewBatchDatabase(ctx, db)
+
+	if err != nil {
+		t.Fatalf("Failed to create batch database, %v", err)
+	}
+
+	defer bdb.Close(ctx)
+
+	gt, err := tables.NewGeoJSONTableWithDatabase(ctx, bdb)
+
+	if err != nil {
+		t.Fatalf("Failed to create geojson table, %v", err)
+	}
+
+	batcher, err := NewRecordBatcher(ctx, bdb, &RecordBatcherOptions{Size: 10})
+
+	if err != nil {
+		t.Fatalf("Failed to create record batcher, %v", err)
+	}
+
+	post_func := batcher.PostIndexFunc(nil)
+
+	// index_record indexes the record 'id' in 'to_index', in the same way as a `sql_index.SQLiteIndexer`
+	// instance wrapped by an `IndexErrors` instance, returning the first error encountered.
+
+	index_record := func(to_index []sqlite.Table, id int64) error {
+
+		record := bytes.Replace(body, []byte(`"wof:id":101736545`), []byte(fmt.Sprintf(`"wof:id":%d`, id)), 1)
+
+		bdb.Lock(ctx)
+		defer bdb.Unlock(ctx)
+
+		var index_err error
+
+		for _, t := range batcher.Tables(to_index) {
+
+			err := t.IndexRecord(ctx, bdb, record)
+
+			if err != nil && index_err == nil {
+				index_err = err
+			}
+		}
+
+		err := post_func(ctx, bdb, to_index, record)
+
+		if err != nil {
+			return err
+		}
+
+		return index_err
+	}
+
+	err = index_record([]sqlite.Table{gt}, 1)
+
+	if err != nil {
+		t.Fatalf("Failed to index record, %v", err)
+	}
+
+	err = index_record([]sqlite.Table{gt, &failingTable{}, gt}, 2)
+
+	if err == nil {
+		t.Fatalf("Expected failing table to return an error")
+	}
+
+	err = index_record([]sqlite.Table{gt}, 3)
+
+	if err != nil {
+		t.Fatalf("Failed to index record, %v", err)
+	}
+
+	err = batcher.Close(ctx)
+
+	if err != nil {
+		t.Fatalf("Failed to close record batcher, %v", err)
+	}
+
+	conn, err := bdb.Conn(ctx)
+
+	if err != nil {
+		t.Fatalf("Failed to establish database connection, %v", err)
+	}
+
+	var ids string
+
+	err = conn.QueryRow("SELECT GROUP_CONCAT(id) FROM (SELECT id FROM geojson ORDER BY id)").Scan(&ids)
+
+	if err != nil {
+		t.Fatalf("Failed to query geojson table, %v", err)
+	}
+
+	if ids != "1,3" {
+		t.Fatalf("Expected the failed record to be rolled back, got '%s'", ids)
+	}
+}
+
+func TestPendingAlts(t *testing.T) {
+
+	pending := NewPendingAlts()
+	defer pending.Close()
+
+	err := pending.Replay(func(path string, body []byte) error {
+		return fmt.Errorf("Unexpected record %s", path)
+	})
+
+	if err != nil {
+		t.Fatalf("Failed to replay empty pending alts, %v", err)
+	}
+
+	expected := []struct {
+		path string
+		body []byte
+	}{
+		{"101/736/545/101736545-alt-quattroshapes.geojson", []byte(`{"type":"Feature"}`)},
+		{"", []byte{}},
+		{"100/1/1001-alt-naturalearth.geojson", bytes.Repeat([]byte("x"), 100000)},
+	}
+
+	for _, rec := range expected {
+
+		err := pending.Write(rec.path, rec.body)
+
+		if err != nil {
+			t.Fatalf("Failed to write %s, %v", rec.path, err)
+		}
+	}
+
+	path_pending := pending.fh.Name()
+
+	replayed := 0
+
+	err = pending.Replay(func(path string, body []byte) error {
+
+		if !pending.isReplaying() {
+			return fmt.Errorf("Expected pending alts to be replaying")
+		}
+
+		rec := expected[replayed]
+
+		if path != rec.path || !bytes.Equal(body, rec.body) {
+			return fmt.Errorf("Unexpected record at offset %d, %s", replayed, path)
+		}
+
+		replayed += 1
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("Failed to replay pending alts, %v", err)
+	}
+
+	if replayed != len(expected) {
+		t.Fatalf("Expected %d records, got %d", len(expected), replayed)
+	}
+
+	if pending.isReplaying() {
+		t.Fatalf("Expected pending alts to have finished replaying")
+	}
+
+	err = pending.Close()
+
+	if err != nil {
+		t.Fatalf("Failed to close pending alts, %v", err)
+	}
+
+	_, err = os.Stat(path_pending)
+
+	if !os.IsNotExist(err) {
+		t.Fatalf("Expected pending alts file to be removed, %v", err)
+	}
+}
@@ -0,0 +1,237 @@
+package index
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/aaronland/go-sqlite/v2"
+)
+
+// INDEX_META_TABLE_NAME is the name of the table where details about each indexing run are written.
+const INDEX_META_TABLE_NAME string = "wof_index_meta"
+
+// MODULE_PATH is the module path of this package.
+const MODULE_PATH string = "github.com/whosonfirst/go-whosonfirst-sqlite-features-index/v2"
+
+// meta_modules is the list of modules whose versions are recorded by `ModuleVersions`, in addition to this module.
+var meta_modules = []string{
+	"github.com/whosonfirst/go-whosonfirst-sqlite-features/v2",
+	"github.com/whosonfirst/go-whosonfirst-sqlite-index/v4",
+	"github.com/whosonfirst/go-whosonfirst-iterate/v2",
+	"github.com/whosonfirst/go-whosonfirst-iterate-git/v2",
+	"github.com/aaronland/go-sqlite/v2",
+	"github.com/aaronland/go-sqlite-modernc",
+	"github.com/aaronland/go-sqlite-mattn",
+}
+
+// IndexMeta is a struct describing an indexing run, as recorded in the `INDEX_META_TABLE_NAME` table.
+type IndexMeta struct {
+	// Id is the unique (and incrementing) identifier assigned to the run when it was recorded.
+	Id int64 `json:"-"`
+	// Started is the time indexing started.
+	Started time.Time `json:"started"`
+	// Finished is the time indexing finished.
+	Finished time.Time `json:"finished"`
+	// IteratorURI is the whosonfirst/go-whosonfirst-iterate/v2 URI used to iterate over sources.
+	IteratorURI string `json:"iterator_uri"`
+	// URIs is the list of sources that were indexed.
+	URIs []string `json:"uris"`
+	// Commits is a map of sources, which are Git repositories, and the commit hash of the revision that was indexed.
+	Commits map[string]string `json:"commits,omitempty"`
+	// Flags is a map of the command line flags, and their values, that were explicitly set.
+	Flags map[string]string `json:"flags,omitempty"`
+	// Tables is the list of tables that were indexed.
+	Tables []string `json:"tables"`
+	// IndexAlt is the list of tables where alternate geometry files were indexed.
+	IndexAlt []string `json:"index_alt,omitempty"`
+	// StrictAltFiles is a boolean flag indicating whether alternate geometry files were indexed strictly.
+	StrictAltFiles bool `json:"strict_alt_files"`
+	// IndexRelations is a boolean flag indicating whether the records related to each feature were indexed.
+	IndexRelations bool `json:"index_relations"`
+	// Counts is a map of table names and the number of rows in each table once indexing finished.
+	Counts map[string]int64 `json:"counts"`
+	// Indexed is a map of table names and the number of records indexed by each table during this run.
+	Indexed map[string]int64 `json:"indexed"`
+	// IndexErrors is the number of records that failed to be loaded or indexed.
+	IndexErrors int64 `json:"index_errors,omitempty"`
+	// Modules is a map of module paths, and "go", and their versions.
+	Modules map[string]string `json:"modules,omitempty"`
+	// Shard is the shard value of the records that were indexed, when records are sharded across databases.
+	Shard string `json:"shard,omitempty"`
+}
+
+// indexMetaSchema returns the schema for the index meta table.
+func indexMetaSchema() string {
+
+	return fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		started INTEGER,
+		finished INTEGER,
+		body TEXT
+	);`, INDEX_META_TABLE_NAME)
+}
+
+// ModuleVersions returns a map of the paths and versions of this module, and the other modules used to index records,
+// as well as the version of Go, as reported by the build information embedded in the running binary.
+func ModuleVersions() map[string]string {
+
+	versions := make(map[string]string)
+
+	bi, ok := debug.ReadBuildInfo()
+
+	if !ok {
+		return versions
+	}
+
+	versions["go"] = bi.GoVersion
+
+	if bi.Main.Path == MODULE_PATH {
+		versions[MODULE_PATH] = bi.Main.Version
+	}
+
+	for _, dep := range bi.Deps {
+
+		if dep.Replace != nil {
+			dep = dep.Replace
+		}
+
+		if dep.Path == MODULE_PATH {
+			versions[MODULE_PATH] = dep.Version
+			continue
+		}
+
+		for _, path := range meta_modules {
+
+			if dep.Path == path {
+				versions[path] = dep.Version
+				break
+			}
+		}
+	}
+
+	return versions
+}
+
+// WriteIndexMeta records 'meta' in the index meta table in 'db', creating the table if necessary.
+func WriteIndexMeta(ctx context.Context, db sqlite.Database, meta *IndexMeta) error {
+
+	enc_meta, err := json.Marshal(meta)
+
+	if err != nil {
+		return fmt.Errorf("Failed to marshal index meta, %w", err)
+	}
+
+	db.Lock(ctx)
+	defer db.Unlock(ctx)
+
+	conn, err := db.Conn(ctx)
+
+	if err != nil {
+		return fmt.Errorf("Failed to establish database connection, %w", err)
+	}
+
+	_, err = conn.ExecContext(ctx, indexMetaSchema())
+
+	if err != nil {
+		return fmt.Errorf("Failed to create %s table, %w", INDEX_META_TABLE_NAME, err)
+	}
+
+	q := fmt.Sprintf("INSERT INTO %s (started, finished, body) VALUES (?, ?, ?)", INDEX_META_TABLE_NAME)
+
+	_, err = conn.ExecContext(ctx, q, meta.Started.Unix(), meta.Finished.Unix(), string(enc_meta))
+
+	if err != nil {
+		return fmt.Errorf("Failed to write index meta, %w", err)
+	}
+
+	return nil
+}
+
+// ReadIndexMeta returns the list of indexing runs recorded in the index meta table in 'db', oldest first. If the
+// table does not exist an empty list is returned.
+func ReadIndexMeta(ctx context.Context, db sqlite.Database) ([]*IndexMeta, error) {
+
+	conn, err := db.Conn(ctx)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to establish database connection, %w", err)
+	}
+
+	runs := make([]*IndexMeta, 0)
+
+	var name string
+
+	err = conn.QueryRowContext(ctx, "SELECT name FROM sqlite_master WHERE type = 'table' AND name = ?", INDEX_META_TABLE_NAME).Scan(&name)
+
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return runs, nil
+	case err != nil:
+		return nil, fmt.Errorf("Failed to determine whether %s table exists, %w", INDEX_META_TABLE_NAME, err)
+	default:
+		// pass
+	}
+
+	q := fmt.Sprintf("SELECT id, body FROM %s ORDER BY id ASC", INDEX_META_TABLE_NAME)
+
+	rows, err := conn.QueryContext(ctx, q)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to query %s table, %w", INDEX_META_TABLE_NAME, err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var id int64
+		var body string
+
+		err := rows.Scan(&id, &body)
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to scan row, %w", err)
+		}
+
+		var meta *IndexMeta
+
+		err = json.Unmarshal([]byte(body), &meta)
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to unmarshal index meta %d, %w", id, err)
+		}
+
+		meta.Id = id
+		runs = append(runs, meta)
+	}
+
+	err = rows.Err()
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to iterate over %s table, %w", INDEX_META_TABLE_NAME, err)
+	}
+
+	return runs, nil
+}
+
+// LatestIndexMeta returns the most recent indexing run recorded in the index meta table in 'db'. It returns an error
+// if no runs have been recorded.
+func LatestIndexMeta(ctx context.Context, db sqlite.Database) (*IndexMeta, error) {
+
+	runs, err := ReadIndexMeta(ctx, db)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(runs) == 0 {
+		return nil, fmt.Errorf("No indexing runs have been recorded")
+	}
+
+	return runs[len(runs)-1], nil
+}
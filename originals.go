@@ -0,0 +1,112 @@
+package index
+
+import (
+	"bytes"
+	"context"
+	"sync"
+
+	"github.com/aaronland/go-sqlite/v2"
+	sql_index "github.com/whosonfirst/go-whosonfirst-sqlite-index/v4"
+)
+
+// OriginalRecords is a struct for making the untransformed body of a record available to specific tables, for example
+// the 'rtree' table whose bounding boxes should be derived from a record's original geometry rather than a simplified one.
+type OriginalRecords struct {
+	// records is a map of the keys derived by `recordKey` and the untransformed body of the record they were derived from.
+	records *sync.Map
+}
+
+// NewOriginalRecords returns a new `OriginalRecords` instance.
+func NewOriginalRecords() *OriginalRecords {
+
+	o := &OriginalRecords{
+		records: new(sync.Map),
+	}
+
+	return o
+}
+
+// Store stores 'original' as the untransformed body of the (transformed) record 'body' if they differ and 'o' is not nil.
+func (o *OriginalRecords) Store(body []byte, original []byte) {
+
+	if o == nil || bytes.Equal(body, original) {
+		return
+	}
+
+	o.records.Store(recordKey(body), original)
+}
+
+// Delete removes the untransformed body of the (transformed) record 'body', if 'o' is not nil.
+func (o *OriginalRecords) Delete(body []byte) {
+
+	if o == nil {
+		return
+	}
+
+	o.records.Delete(recordKey(body))
+}
+
+// Table returns a copy of 't' which indexes the untransformed body of each record, if present, rather than the record itself.
+func (o *OriginalRecords) Table(t sqlite.Table) sqlite.Table {
+
+	wrapped := &originalRecordsWrappedTable{
+		Table:     t,
+		originals: o,
+	}
+
+	return wrapped
+}
+
+// PostIndexFunc returns a `SQLiteIndexerPostIndexFunc` function which removes the untransformed body of each record, once it
+// has been indexed by all the tables, and then invokes 'cb' if it is not nil.
+func (o *OriginalRecords) PostIndexFunc(cb sql_index.SQLiteIndexerPostIndexFunc) sql_index.SQLiteIndexerPostIndexFunc {
+
+	post_cb := func(ctx context.Context, db sqlite.Database, tables []sqlite.Table, record interface{}) error {
+
+		body, ok := record.([]byte)
+
+		if ok {
+			o.Delete(body)
+		}
+
+		if cb == nil {
+			return nil
+		}
+
+		return cb(ctx, db, tables, record)
+	}
+
+	return post_cb
+}
+
+// originalRecordsWrappedTable implements the `aaronland/go-sqlite.Table` interface wrapping another table which indexes
+// the untransformed body of records stored in an `OriginalRecords` instance.
+type originalRecordsWrappedTable struct {
+	sqlite.Table
+	originals *OriginalRecords
+}
+
+// IndexRecord indexes the untransformed body of 'i', if present, or 'i' using the underlying table.
+func (t *originalRecordsWrappedTable) IndexRecord(ctx context.Context, db sqlite.Database, i interface{}) error {
+
+	body, ok := i.([]byte)
+
+	if ok {
+
+		v, exists := t.originals.records.Load(recordKey(body))
+
+		if exists {
+			i = v.([]byte)
+		}
+	}
+
+	return t.Table.IndexRecord(ctx, db, i)
+}
+
+// IdColumn returns the name of the column used to store Who's On First IDs by the underlying table, if it implements
+// the `FeatureTable` interface, or an empty string.
+func (t *originalRecordsWrappedTable) IdColumn() string {
+
+	col, _ := idColumn(t.Table)
+	return col
+}
@@ -0,0 +1,172 @@
+package index
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// PendingAlts is a struct for holding alternate geometry files which are encountered before their principal record, and
+// so can not be dealt with yet, until iterating over sources has finished. Files are written to a temporary file, rather
+// than being held in memory, which is created the first time a file is written.
+type PendingAlts struct {
+	mu     *sync.Mutex
+	fh     *os.File
+	writer *bufio.Writer
+	// replaying is set (to 1) while the `Replay` method is running.
+	replaying int32
+}
+
+// NewPendingAlts returns a new `PendingAlts` instance.
+func NewPendingAlts() *PendingAlts {
+
+	p := &PendingAlts{
+		mu: new(sync.Mutex),
+	}
+
+	return p
+}
+
+// Write appends the alternate geometry file 'body', read from 'path', to the temporary file as its length-prefixed path and body.
+func (p *PendingAlts) Write(path string, body []byte) error {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.fh == nil {
+
+		fh, err := os.CreateTemp("", "wof-sqlite-index-alts-*")
+
+		if err != nil {
+			return fmt.Errorf("Failed to create pending alts file, %w", err)
+		}
+
+		p.fh = fh
+		p.writer = bufio.NewWriter(fh)
+	}
+
+	for _, b := range [][]byte{[]byte(path), body} {
+
+		_, err := p.writer.Write(binary.AppendUvarint(nil, uint64(len(b))))
+
+		if err != nil {
+			return fmt.Errorf("Failed to write %s to pending alts file, %w", path, err)
+		}
+
+		_, err = p.writer.Write(b)
+
+		if err != nil {
+			return fmt.Errorf("Failed to write %s to pending alts file, %w", path, err)
+		}
+	}
+
+	return nil
+}
+
+// Replay invokes 'cb' for each of the files written to the temporary file, in the order they were written.
+func (p *PendingAlts) Replay(cb func(path string, body []byte) error) error {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.fh == nil {
+		return nil
+	}
+
+	atomic.StoreInt32(&p.replaying, 1)
+	defer atomic.StoreInt32(&p.replaying, 0)
+
+	err := p.writer.Flush()
+
+	if err != nil {
+		return fmt.Errorf("Failed to flush pending alts file, %w", err)
+	}
+
+	_, err = p.fh.Seek(0, io.SeekStart)
+
+	if err != nil {
+		return fmt.Errorf("Failed to rewind pending alts file, %w", err)
+	}
+
+	reader := bufio.NewReader(p.fh)
+
+	read_bytes := func() ([]byte, error) {
+
+		sz, err := binary.ReadUvarint(reader)
+
+		if err != nil {
+			return nil, err
+		}
+
+		b := make([]byte, sz)
+
+		_, err = io.ReadFull(reader, b)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return b, nil
+	}
+
+	for {
+
+		path, err := read_bytes()
+
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return fmt.Errorf("Failed to read pending alts file, %w", err)
+		}
+
+		body, err := read_bytes()
+
+		if err != nil {
+			return fmt.Errorf("Failed to read pending alts file, %w", err)
+		}
+
+		err = cb(string(path), body)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close closes and removes the temporary file, if it was created.
+func (p *PendingAlts) Close() error {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.fh == nil {
+		return nil
+	}
+
+	p.fh.Close()
+
+	err := os.Remove(p.fh.Name())
+
+	p.fh = nil
+	p.writer = nil
+
+	if err != nil {
+		return fmt.Errorf("Failed to remove pending alts file, %w", err)
+	}
+
+	return nil
+}
+
+// isReplaying returns a boolean value indicating whether the `Replay` method is running.
+func (p *PendingAlts) isReplaying() bool {
+	return atomic.LoadInt32(&p.replaying) == 1
+}
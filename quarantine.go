@@ -0,0 +1,83 @@
+package index
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/aaronland/go-sqlite/v2"
+	"github.com/whosonfirst/go-whosonfirst-feature/properties"
+)
+
+// QUARANTINE_TABLE_NAME is the name of the table where records that fail validation are written when using `ValidationModeQuarantine`.
+const QUARANTINE_TABLE_NAME string = "quarantine"
+
+// quarantineSchema returns the schema for the quarantine table.
+func quarantineSchema() string {
+
+	return fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		id INTEGER NOT NULL,
+		path TEXT NOT NULL,
+		violations TEXT,
+		body TEXT,
+		lastmodified INTEGER,
+		PRIMARY KEY (id, path)
+	);`, QUARANTINE_TABLE_NAME)
+}
+
+// quarantineFunc is a function that writes a record, read from a path, and its violations to the quarantine table.
+type quarantineFunc func(ctx context.Context, path string, id int64, violations []*ValidationViolation, body []byte) error
+
+// newQuarantineFunc returns a `quarantineFunc` that writes records to the quarantine table in 'db'. The table is created,
+// if necessary, the first time a record is quarantined. Records are keyed by their ID and path so quarantining a record
+// again replaces the previous row.
+func newQuarantineFunc(db sqlite.Database) quarantineFunc {
+
+	var create_err error
+
+	init := new(sync.Once)
+
+	fn := func(ctx context.Context, path string, id int64, violations []*ValidationViolation, body []byte) error {
+
+		enc_violations, err := json.Marshal(violations)
+
+		if err != nil {
+			return fmt.Errorf("Failed to marshal violations, %w", err)
+		}
+
+		db.Lock(ctx)
+		defer db.Unlock(ctx)
+
+		conn, err := db.Conn(ctx)
+
+		if err != nil {
+			return fmt.Errorf("Failed to establish database connection, %w", err)
+		}
+
+		init.Do(func() {
+
+			_, err := conn.ExecContext(ctx, quarantineSchema())
+
+			if err != nil {
+				create_err = fmt.Errorf("Failed to create %s table, %w", QUARANTINE_TABLE_NAME, err)
+			}
+		})
+
+		if create_err != nil {
+			return create_err
+		}
+
+		q := fmt.Sprintf("INSERT OR REPLACE INTO %s (id, path, violations, body, lastmodified) VALUES (?, ?, ?, ?, ?)", QUARANTINE_TABLE_NAME)
+
+		_, err = conn.ExecContext(ctx, q, id, path, string(enc_violations), string(body), properties.LastModified(body))
+
+		if err != nil {
+			return fmt.Errorf("Failed to quarantine %s, %w", path, err)
+		}
+
+		return nil
+	}
+
+	return fn
+}
@@ -0,0 +1,1085 @@
+package index
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log/slog"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aaronland/go-sqlite/v2"
+	"github.com/tidwall/gjson"
+	"github.com/whosonfirst/go-reader"
+	"github.com/whosonfirst/go-whosonfirst-feature/geometry"
+	"github.com/whosonfirst/go-whosonfirst-feature/properties"
+	sql_tables "github.com/whosonfirst/go-whosonfirst-sql/tables"
+	sql_index "github.com/whosonfirst/go-whosonfirst-sqlite-index/v4"
+	"github.com/whosonfirst/go-whosonfirst-uri"
+)
+
+// The default number of relations written together by `RelationsIndexer` when no batch size is specified.
+const DefaultRelationsBatchSize int = 100
+
+// The maximum number of IDs to include in a single "WHERE id IN (...)" query.
+const relations_query_size int = 500
+
+// SQLiteFeaturesIndexRelationsFuncOptions
+type SQLiteFeaturesIndexRelationsFuncOptions struct {
+	// Reader is a valid `whosonfirst/go-reader` instance used to load Who's On First feature data. If `Readers` is also defined
+	// this reader is tried first.
+	Reader reader.Reader
+	// Readers is an optional ordered list of `whosonfirst/go-reader` instances used to load Who's On First feature data. Each
+	// reader is tried in turn until one is able to read a relation.
+	Readers []reader.Reader
+	// Strict is a boolean flag indicating whether the failure to load or parse feature record should trigger a critical error.
+	Strict bool
+	// Properties is the list of gjson paths used to derive the IDs of a record's relations. Values may be numbers or (nested)
+	// arrays or objects of numbers; for example "properties.wof:hierarchy" will yield every ID in every hierarchy. If empty the
+	// paths returned by `DefaultRelationsProperties` are used.
+	Properties []string
+	// MaxDepth is the maximum number of levels of relations to index. For example a value of 2 will index a record's relations
+	// and the relations of those relations. Relations are walked breadth-first. Values less than or equal to 1 will only index
+	// a record's direct relations.
+	MaxDepth int
+	// IndexAltFiles is a boolean flag indicating whether the alternate geometry files for each relation should also be read
+	// and indexed. Alternate geometries are discovered using the relation's `src:geom_alt` property and `AltLabels`. Individual
+	// tables still decide whether or not to index alternate geometries according to their own options.
+	IndexAltFiles bool
+	// AltLabels is an optional list of alternate geometry labels to look for, in addition to those listed in a relation's
+	// `src:geom_alt` property, when `IndexAltFiles` is true. Failures to read these files are never considered critical errors.
+	AltLabels []string
+	// SeenIds is an optional `sync.Map` instance which will be populated with the ID of every relation encountered,
+	// whether or not it was (re)indexed. If set the relations of relations that have already been indexed are also walked,
+	// up to `MaxDepth`, using the 'geojson' table or otherwise the relations reader.
+	SeenIds *sync.Map
+	// Unresolved is an optional `UnresolvedRelations` instance which will be populated with the relations that could not be
+	// read or parsed, and the records that reference them, when `Strict` is false.
+	Unresolved *UnresolvedRelations
+	// Workers is the number of relations to read concurrently when using a `RelationsIndexer`. If zero the number of CPUs is used.
+	Workers int
+	// BatchSize is the number of relations to write in a single transaction when using a `RelationsIndexer`. Batches are only
+	// written in a single transaction if the database is a `BatchDatabase`. If zero relations are written in groups of
+	// `DefaultRelationsBatchSize` and each table commits each relation in its own transaction.
+	BatchSize int
+	// Transformer is an optional `RecordTransformer` instance applied to each relation (and alternate geometry) record
+	// before it is indexed. The relations of a relation are derived from its untransformed record.
+	Transformer RecordTransformer
+	// OriginalRecords is an optional `OriginalRecords` instance used to make the untransformed record for each relation
+	// available to the tables wrapped by its `Table` method.
+	OriginalRecords *OriginalRecords
+}
+
+// DefaultRelationsProperties returns the default list of gjson paths used to derive the IDs of a record's relations.
+func DefaultRelationsProperties() []string {
+
+	return []string{
+		"properties.wof:belongsto",
+		"properties.wof:involves",
+		"properties.wof:depicts",
+	}
+}
+
+// SQLiteFeaturesIndexRelationsFunc returns a `go-whosonfirst-sqlite-index/v3.SQLiteIndexerPostIndexFunc` callback
+// function used to index relations for a WOF record after that record has been successfully indexed.
+func SQLiteFeaturesIndexRelationsFunc(r reader.Reader) sql_index.SQLiteIndexerPostIndexFunc {
+
+	opts := &SQLiteFeaturesIndexRelationsFuncOptions{}
+	opts.Reader = r
+
+	return SQLiteFeaturesIndexRelationsFuncWithOptions(opts)
+}
+
+// SQLiteFeaturesIndexRelationsFuncWithOptions returns a `go-whosonfirst-sqlite-index/v3.SQLiteIndexerPostIndexFunc` callback
+// function used to index relations for a WOF record after that record has been successfully indexed, but with custom
+// `SQLiteFeaturesIndexRelationsFuncOptions` options defined in 'opts'.
+//
+// Relations are read, one at a time, while the database is locked by the indexer. For large imports, or slow readers, consider
+// using a `RelationsIndexer` instead.
+func SQLiteFeaturesIndexRelationsFuncWithOptions(opts *SQLiteFeaturesIndexRelationsFuncOptions) sql_index.SQLiteIndexerPostIndexFunc {
+
+	seen := new(sync.Map)
+
+	candidates := relationsCandidates(opts)
+
+	r, r_err := relationsReader(opts)
+
+	cb := func(ctx context.Context, db sqlite.Database, tables []sqlite.Table, record interface{}) error {
+
+		if r_err != nil {
+			return fmt.Errorf("Failed to create relations reader, %w", r_err)
+		}
+
+		conn, err := db.Conn(ctx)
+
+		if err != nil {
+			return fmt.Errorf("Failed to establish database connection, %v", err)
+		}
+
+		t := relationsTable(tables)
+
+		body := record.([]byte)
+
+		// Relations are walked breadth-first, with each item in the queue being the
+		// ID of a relation and its depth relative to 'record'
+
+		type relation struct {
+			id       int64
+			depth    int
+			referrer int64
+		}
+
+		record_id, _ := properties.Id(body)
+
+		queue := make([]*relation, 0)
+
+		for _, id := range deriveRelations(body, candidates) {
+			queue = append(queue, &relation{id: id, depth: 1, referrer: record_id})
+		}
+
+		for len(queue) > 0 {
+
+			rel := queue[0]
+			queue = queue[1:]
+
+			id := rel.id
+
+			if opts.SeenIds != nil {
+				opts.SeenIds.Store(id, true)
+			}
+
+			_, ok := seen.Load(id)
+
+			if ok {
+				opts.Unresolved.Reference(id, []int64{rel.referrer})
+				continue
+			}
+
+			seen.Store(id, true)
+
+			indexed, err := indexedIds(ctx, conn, t, []int64{id})
+
+			if err != nil {
+				return fmt.Errorf("Failed to determine whether %d has been indexed, %w", id, err)
+			}
+
+			if indexed[id] {
+
+				// Keep walking so that its own relations are marked as seen (see IndexRelations)
+
+				if opts.SeenIds != nil && rel.depth < opts.MaxDepth {
+
+					stored, err := storedRelations(ctx, conn, t, r, candidates, []int64{id})
+
+					if err != nil {
+						return err
+					}
+
+					for _, ancestor_id := range stored[id] {
+						queue = append(queue, &relation{id: ancestor_id, depth: rel.depth + 1, referrer: id})
+					}
+				}
+
+				continue
+			}
+
+			f, err := readRelation(ctx, r, opts, id)
+
+			if err != nil {
+
+				err = unresolvedRelation(opts, id, []int64{rel.referrer}, err)
+
+				if err != nil {
+					return err
+				}
+
+				continue
+			}
+
+			err = indexRelation(ctx, db, tables, f, opts.OriginalRecords)
+
+			if err != nil {
+				return err
+			}
+
+			if rel.depth < opts.MaxDepth {
+
+				for _, ancestor_id := range deriveRelations(f.Body, candidates) {
+					queue = append(queue, &relation{id: ancestor_id, depth: rel.depth + 1, referrer: id})
+				}
+			}
+		}
+
+		return nil
+	}
+
+	return cb
+}
+
+// RelationsIndexer indexes the relations of Who's On First records in a separate phase, after the records themselves have
+// been indexed. Candidate relation IDs are collected during the main pass by the callback returned by the `PostIndexFunc`
+// method and then the `IndexRelations` method reads the relations that are missing from the database concurrently and
+// writes them in batches.
+type RelationsIndexer struct {
+	options    *SQLiteFeaturesIndexRelationsFuncOptions
+	candidates []string
+	reader     *FallbackReader
+	// pending is a map of the relation IDs collected during the main pass and the IDs of the records that reference them.
+	pending map[int64]map[int64]bool
+	// mu is used to guard 'pending'.
+	mu *sync.Mutex
+}
+
+// NewRelationsIndexer returns a new `RelationsIndexer` instance configured by 'opts'.
+func NewRelationsIndexer(opts *SQLiteFeaturesIndexRelationsFuncOptions) (*RelationsIndexer, error) {
+
+	r, err := relationsReader(opts)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create relations reader, %w", err)
+	}
+
+	ri := &RelationsIndexer{
+		options:    opts,
+		candidates: relationsCandidates(opts),
+		reader:     r,
+		pending:    make(map[int64]map[int64]bool),
+		mu:         new(sync.Mutex),
+	}
+
+	return ri, nil
+}
+
+// ReaderStats returns the `ReaderStats` for each of the readers used to read relations, in the order they are tried.
+func (ri *RelationsIndexer) ReaderStats() []*ReaderStats {
+	return ri.reader.Stats()
+}
+
+// PostIndexFunc returns a `go-whosonfirst-sqlite-index/v4.SQLiteIndexerPostIndexFunc` callback function which collects the
+// relations of each record that is indexed. It does not read or index anything itself.
+func (ri *RelationsIndexer) PostIndexFunc() sql_index.SQLiteIndexerPostIndexFunc {
+
+	cb := func(ctx context.Context, db sqlite.Database, tables []sqlite.Table, record interface{}) error {
+
+		ri.Collect(record.([]byte))
+		return nil
+	}
+
+	return cb
+}
+
+// Collect adds the relations of the record 'body' to the list of relations to be indexed by the `IndexRelations` method. This
+// is done automatically for records that are indexed by the callback returned by the `PostIndexFunc` method.
+func (ri *RelationsIndexer) Collect(body []byte) {
+
+	record_id, _ := properties.Id(body)
+
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+
+	for _, id := range deriveRelations(body, ri.candidates) {
+
+		_, exists := ri.pending[id]
+
+		if !exists {
+			ri.pending[id] = make(map[int64]bool)
+		}
+
+		ri.pending[id][record_id] = true
+	}
+}
+
+// IndexRelations indexes the relations collected by the callback returned by the `PostIndexFunc` method, that are not already
+// present in the database, in to 'tables'. Relations are read concurrently and then written in batches of `BatchSize` records,
+// each in a single transaction if 'db' is a `BatchDatabase` instance. Relations are indexed breadth-first, up to `MaxDepth` levels.
+func (ri *RelationsIndexer) IndexRelations(ctx context.Context, db sqlite.Database, tables []sqlite.Table) error {
+
+	conn, err := db.Conn(ctx)
+
+	if err != nil {
+		return fmt.Errorf("Failed to establish database connection, %w", err)
+	}
+
+	t := relationsTable(tables)
+
+	seen := make(map[int64]bool)
+
+	// refs is a map of the relation IDs, for the current level, and the IDs of the records that reference them.
+
+	ri.mu.Lock()
+	refs := ri.pending
+	ri.pending = make(map[int64]map[int64]bool)
+	ri.mu.Unlock()
+
+	for depth := 1; len(refs) > 0; depth++ {
+
+		level := make([]int64, 0)
+
+		for id, referrers := range refs {
+
+			if ri.options.SeenIds != nil {
+				ri.options.SeenIds.Store(id, true)
+			}
+
+			if seen[id] {
+				ri.options.Unresolved.Reference(id, mapKeys(referrers))
+				continue
+			}
+
+			seen[id] = true
+			level = append(level, id)
+		}
+
+		slices.Sort(level)
+
+		db.Lock(ctx)
+		indexed, err := indexedIds(ctx, conn, t, level)
+		db.Unlock(ctx)
+
+		if err != nil {
+			return fmt.Errorf("Failed to determine which relations have been indexed, %w", err)
+		}
+
+		missing := make([]int64, 0)
+		present := make([]int64, 0)
+
+		for _, id := range level {
+
+			if indexed[id] {
+				present = append(present, id)
+			} else {
+				missing = append(missing, id)
+			}
+		}
+
+		next := make(map[int64]map[int64]bool)
+
+		add_next := func(referrer int64, ids []int64) {
+
+			for _, id := range ids {
+
+				_, exists := next[id]
+
+				if !exists {
+					next[id] = make(map[int64]bool)
+				}
+
+				next[id][referrer] = true
+			}
+		}
+
+		err = ri.indexMissing(ctx, db, tables, missing, refs, func(f *fetchedRelation) {
+
+			if depth >= ri.options.MaxDepth {
+				return
+			}
+
+			add_next(f.Id, deriveRelations(f.Body, ri.candidates))
+		})
+
+		if err != nil {
+			return err
+		}
+
+		// When syncing, the relations of relations indexed by a previous run are walked too
+		// so that they are marked as seen, rather than deleted.
+
+		if ri.options.SeenIds != nil && depth < ri.options.MaxDepth && len(present) > 0 {
+
+			db.Lock(ctx)
+			stored, err := storedRelations(ctx, conn, t, nil, ri.candidates, present)
+			db.Unlock(ctx)
+
+			if err != nil {
+				return err
+			}
+
+			unstored := make([]int64, 0)
+
+			for _, id := range present {
+
+				rels, ok := stored[id]
+
+				if !ok {
+					unstored = append(unstored, id)
+					continue
+				}
+
+				add_next(id, rels)
+			}
+
+			stored, err = storedRelations(ctx, conn, t, ri.reader, ri.candidates, unstored)
+
+			if err != nil {
+				return err
+			}
+
+			for id, rels := range stored {
+				add_next(id, rels)
+			}
+		}
+
+		refs = next
+	}
+
+	return nil
+}
+
+// indexMissing reads each of the relations in 'ids' using a pool of workers and indexes them, in batches, in to 'tables'.
+// 'refs' is a map of relation IDs and the IDs of the records that reference them. 'on_indexed' is invoked (by a single
+// goroutine) for each relation after it has been indexed.
+func (ri *RelationsIndexer) indexMissing(ctx context.Context, db sqlite.Database, tables []sqlite.Table, ids []int64, refs map[int64]map[int64]bool, on_indexed func(*fetchedRelation)) error {
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	workers := ri.options.Workers
+
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	batch_size := ri.options.BatchSize
+
+	if batch_size <= 0 {
+		batch_size = DefaultRelationsBatchSize
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	id_ch := make(chan int64)
+	rel_ch := make(chan *fetchedRelation)
+	err_ch := make(chan error, workers)
+
+	go func() {
+
+		defer close(id_ch)
+
+		for _, id := range ids {
+
+			select {
+			case <-ctx.Done():
+				return
+			case id_ch <- id:
+				// pass
+			}
+		}
+	}()
+
+	wg := new(sync.WaitGroup)
+
+	for i := 0; i < workers; i++ {
+
+		wg.Add(1)
+
+		go func() {
+
+			defer wg.Done()
+
+			for id := range id_ch {
+
+				f, err := readRelation(ctx, ri.reader, ri.options, id)
+
+				if err != nil {
+
+					err = unresolvedRelation(ri.options, id, mapKeys(refs[id]), err)
+
+					if err != nil {
+						err_ch <- err
+						cancel()
+						return
+					}
+
+					continue
+				}
+
+				select {
+				case <-ctx.Done():
+					return
+				case rel_ch <- f:
+					// pass
+				}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(rel_ch)
+	}()
+
+	batch := make([]*fetchedRelation, 0, batch_size)
+
+	var write_err error
+
+	for f := range rel_ch {
+
+		if write_err != nil {
+			continue
+		}
+
+		batch = append(batch, f)
+
+		if len(batch) < batch_size {
+			continue
+		}
+
+		write_err = ri.writeBatch(ctx, db, tables, batch, on_indexed)
+
+		if write_err != nil {
+			cancel()
+		}
+
+		batch = batch[:0]
+	}
+
+	if write_err != nil {
+		return write_err
+	}
+
+	select {
+	case err := <-err_ch:
+		return err
+	default:
+		// pass
+	}
+
+	return ri.writeBatch(ctx, db, tables, batch, on_indexed)
+}
+
+// writeBatch indexes each of the relations in 'batch' in to 'tables' while 'db' is locked. If 'db' is a `BatchDatabase`
+// instance, and a batch size has been specified, all the relations are written in a single transaction which is rolled
+// back if any of them fail to be indexed.
+func (ri *RelationsIndexer) writeBatch(ctx context.Context, db sqlite.Database, tables []sqlite.Table, batch []*fetchedRelation, on_indexed func(*fetchedRelation)) error {
+
+	if len(batch) == 0 {
+		return nil
+	}
+
+	db.Lock(ctx)
+	defer db.Unlock(ctx)
+
+	bdb, is_batch := db.(*BatchDatabase)
+	is_batch = is_batch && ri.options.BatchSize > 0
+
+	if is_batch {
+
+		err := bdb.BeginBatch(ctx)
+
+		if err != nil {
+			return fmt.Errorf("Failed to begin batch, %w", err)
+		}
+	}
+
+	for _, f := range batch {
+
+		err := indexRelation(ctx, db, tables, f, ri.options.OriginalRecords)
+
+		if err != nil {
+
+			if is_batch {
+
+				rollback_err := bdb.RollbackBatch(ctx)
+
+				if rollback_err != nil {
+					return fmt.Errorf("Failed to roll back batch (%v), %w", err, rollback_err)
+				}
+			}
+
+			return err
+		}
+
+		on_indexed(f)
+	}
+
+	if is_batch {
+
+		err := bdb.CommitBatch(ctx)
+
+		if err != nil {
+			return fmt.Errorf("Failed to commit batch, %w", err)
+		}
+	}
+
+	return nil
+}
+
+// fetchedRelation is a struct containing the data read for a relation.
+type fetchedRelation struct {
+	// Id is the Who's On First ID of the relation.
+	Id int64
+	// Path is the relative path of the relation's record.
+	Path string
+	// Body is the relation's record.
+	Body []byte
+	// Record is the relation's record after `Transformer` has been applied. This is what is indexed.
+	Record []byte
+	// Alt is the list of alternate geometry records for the relation.
+	Alt []*fetchedRelation
+}
+
+// readRelation reads the record, and alternate geometry records if `IndexAltFiles` is true, for the relation 'id' using 'r'.
+func readRelation(ctx context.Context, r reader.Reader, opts *SQLiteFeaturesIndexRelationsFuncOptions, id int64) (*fetchedRelation, error) {
+
+	rel_path, body, err := readRelationBody(ctx, r, id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = properties.Id(body)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to derive wof:id for %s, %w", rel_path, err)
+	}
+
+	_, err = geometry.Geometry(body)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to derive geometry for %s, %w", rel_path, err)
+	}
+
+	record, err := transformRelation(ctx, opts, rel_path, body)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to transform %s, %w", rel_path, err)
+	}
+
+	f := &fetchedRelation{
+		Id:     id,
+		Path:   rel_path,
+		Body:   body,
+		Record: record,
+		Alt:    make([]*fetchedRelation, 0),
+	}
+
+	if !opts.IndexAltFiles {
+		return f, nil
+	}
+
+	alt_labels, err := properties.AltGeometries(body)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to derive alternate geometries for %s, %w", rel_path, err)
+	}
+
+	// Alt labels listed in the record itself are expected to exist whereas
+	// those in opts.AltLabels are just candidates to look for.
+
+	candidates := make(map[string]bool)
+
+	for _, label := range alt_labels {
+		candidates[label] = true
+	}
+
+	for _, label := range opts.AltLabels {
+
+		_, exists := candidates[label]
+
+		if !exists {
+			candidates[label] = false
+		}
+	}
+
+	for label, expected := range candidates {
+
+		uri_args, err := uri.NewAlternateURIArgsFromAltLabel(label)
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to derive URI args for alt label '%s', %w", label, err)
+		}
+
+		alt_path, err := uri.Id2RelPath(id, uri_args)
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to determine relative path for %d (%s), %w", id, label, err)
+		}
+
+		alt_fh, err := r.Read(ctx, alt_path)
+
+		if err != nil {
+
+			if expected && opts.Strict {
+				return nil, fmt.Errorf("Failed to open %s, %w", alt_path, err)
+			}
+
+			continue
+		}
+
+		alt_body, err := io.ReadAll(alt_fh)
+		alt_fh.Close()
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read data for %s, %w", alt_path, err)
+		}
+
+		alt_record, err := transformRelation(ctx, opts, alt_path, alt_body)
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to transform %s, %w", alt_path, err)
+		}
+
+		alt_f := &fetchedRelation{
+			Id:     id,
+			Path:   alt_path,
+			Body:   alt_body,
+			Record: alt_record,
+		}
+
+		f.Alt = append(f.Alt, alt_f)
+	}
+
+	return f, nil
+}
+
+// readRelationBody reads the record for the relation 'id' using 'r' and returns its relative path and body.
+func readRelationBody(ctx context.Context, r reader.Reader, id int64) (string, []byte, error) {
+
+	rel_path, err := uri.Id2RelPath(id)
+
+	if err != nil {
+		return "", nil, fmt.Errorf("Failed to determine relative path for %d, %v", id, err)
+	}
+
+	fh, err := r.Read(ctx, rel_path)
+
+	if err != nil {
+		return "", nil, fmt.Errorf("Failed to open %s, %v", rel_path, err)
+	}
+
+	body, err := io.ReadAll(fh)
+	fh.Close()
+
+	if err != nil {
+		return "", nil, fmt.Errorf("Failed to read data for %s, %v", rel_path, err)
+	}
+
+	return rel_path, body, nil
+}
+
+// storedRelations returns a map of the already indexed relations in 'ids' and their own relations, derived using 'candidates'.
+// If 't' is the 'geojson' table relations are derived from the bodies stored in that table. Otherwise, or if 't' is missing a
+// relation, they are derived from the record read using 'r', if not nil. Relations that can not be read are omitted.
+func storedRelations(ctx context.Context, conn *sql.DB, t sqlite.Table, r reader.Reader, candidates []string, ids []int64) (map[int64][]int64, error) {
+
+	relations := make(map[int64][]int64)
+
+	if t.Name() == sql_tables.GEOJSON_TABLE_NAME {
+
+		for start := 0; start < len(ids); start += relations_query_size {
+
+			end := min(start+relations_query_size, len(ids))
+			chunk := ids[start:end]
+
+			placeholders := make([]string, len(chunk))
+			args := make([]interface{}, len(chunk))
+
+			for i, id := range chunk {
+				placeholders[i] = "?"
+				args[i] = id
+			}
+
+			q := fmt.Sprintf("SELECT id, body FROM %s WHERE is_alt = 0 AND id IN (%s)", t.Name(), strings.Join(placeholders, ","))
+
+			rows, err := conn.QueryContext(ctx, q, args...)
+
+			if err != nil {
+				return nil, fmt.Errorf("Failed to query records from %s table, %w", t.Name(), err)
+			}
+
+			for rows.Next() {
+
+				var id int64
+				var body []byte
+
+				err := rows.Scan(&id, &body)
+
+				if err != nil {
+					rows.Close()
+					return nil, fmt.Errorf("Failed to scan record from %s table, %w", t.Name(), err)
+				}
+
+				relations[id] = deriveRelations(body, candidates)
+			}
+
+			err = rows.Close()
+
+			if err != nil {
+				return nil, fmt.Errorf("Failed to close rows for %s table, %w", t.Name(), err)
+			}
+
+			err = rows.Err()
+
+			if err != nil {
+				return nil, fmt.Errorf("Failed to iterate rows for %s table, %w", t.Name(), err)
+			}
+		}
+	}
+
+	if r == nil {
+		return relations, nil
+	}
+
+	for _, id := range ids {
+
+		_, ok := relations[id]
+
+		if ok {
+			continue
+		}
+
+		_, body, err := readRelationBody(ctx, r, id)
+
+		if err != nil {
+			slog.Debug("Failed to read indexed relation, skipping its relations", "id", id, "error", err)
+			continue
+		}
+
+		relations[id] = deriveRelations(body, candidates)
+	}
+
+	return relations, nil
+}
+
+// transformRelation returns the result of applying `Transformer`, if defined, to the relation record 'body' read from 'path'.
+func transformRelation(ctx context.Context, opts *SQLiteFeaturesIndexRelationsFuncOptions, path string, body []byte) ([]byte, error) {
+
+	if opts.Transformer == nil {
+		return body, nil
+	}
+
+	return opts.Transformer.Transform(ctx, path, body)
+}
+
+// unresolvedRelation handles the failure, 'err', to read or parse the relation 'id' referenced by 'referenced_by'. If `Strict`
+// is true 'err' is returned, otherwise the relation is added to `Unresolved` and nil is returned.
+func unresolvedRelation(opts *SQLiteFeaturesIndexRelationsFuncOptions, id int64, referenced_by []int64, err error) error {
+
+	if opts.Strict {
+		return err
+	}
+
+	slog.Debug("Failed to read relation, strict mode is disabled so skipping", "id", id, "error", err)
+
+	opts.Unresolved.Add(id, referenced_by, err)
+	return nil
+}
+
+// indexRelation indexes the record, and alternate geometry records, for the relation 'f' in to each of 'tables'. If 'originals'
+// is not nil it is used to make the untransformed records available to the tables it wraps.
+func indexRelation(ctx context.Context, db sqlite.Database, tables []sqlite.Table, f *fetchedRelation, originals *OriginalRecords) error {
+
+	originals.Store(f.Record, f.Body)
+	defer originals.Delete(f.Record)
+
+	for _, t := range tables {
+
+		err := t.IndexRecord(ctx, db, f.Record)
+
+		if err != nil {
+			return fmt.Errorf("Failed to index ancestor (%s), %v", f.Path, err)
+		}
+	}
+
+	for _, alt_f := range f.Alt {
+
+		originals.Store(alt_f.Record, alt_f.Body)
+		defer originals.Delete(alt_f.Record)
+
+		for _, t := range tables {
+
+			err := t.IndexRecord(ctx, db, alt_f.Record)
+
+			if err != nil {
+				return fmt.Errorf("Failed to index alternate geometry (%s), %w", alt_f.Path, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// relationsCandidates returns the list of gjson paths used to derive the IDs of a record's relations defined in 'opts'.
+func relationsCandidates(opts *SQLiteFeaturesIndexRelationsFuncOptions) []string {
+
+	if len(opts.Properties) == 0 {
+		return DefaultRelationsProperties()
+	}
+
+	return opts.Properties
+}
+
+// relationsReader returns a `FallbackReader` instance for the `Reader` and `Readers` defined in 'opts'.
+func relationsReader(opts *SQLiteFeaturesIndexRelationsFuncOptions) (*FallbackReader, error) {
+
+	readers := make([]reader.Reader, 0)
+
+	if opts.Reader != nil {
+		readers = append(readers, opts.Reader)
+	}
+
+	readers = append(readers, opts.Readers...)
+
+	return NewFallbackReader(readers...)
+}
+
+// relationsTable returns the table in 'tables' used to determine whether a relation has already been indexed. This is
+// the 'geojson' table, if present, then the 'spr' table, if present, and otherwise the first table.
+func relationsTable(tables []sqlite.Table) sqlite.Table {
+
+	for _, name := range []string{sql_tables.GEOJSON_TABLE_NAME, sql_tables.SPR_TABLE_NAME} {
+
+		for _, t := range tables {
+
+			if t.Name() == name {
+				return t
+			}
+		}
+	}
+
+	return tables[0]
+}
+
+// indexedIds returns the subset of 'ids' which are present in the table 't'.
+func indexedIds(ctx context.Context, conn *sql.DB, t sqlite.Table, ids []int64) (map[int64]bool, error) {
+
+	indexed := make(map[int64]bool)
+
+	for start := 0; start < len(ids); start += relations_query_size {
+
+		end := min(start+relations_query_size, len(ids))
+		chunk := ids[start:end]
+
+		placeholders := make([]string, len(chunk))
+		args := make([]interface{}, len(chunk))
+
+		for i, id := range chunk {
+			placeholders[i] = "?"
+			args[i] = id
+		}
+
+		col, ok := idColumn(t)
+
+		if !ok {
+			// Assume the default column name for tables that do not declare one since they are only read
+			col = "id"
+		}
+
+		q := fmt.Sprintf("SELECT DISTINCT %s FROM %s WHERE %s IN (%s)", col, t.Name(), col, strings.Join(placeholders, ","))
+
+		rows, err := conn.QueryContext(ctx, q, args...)
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to query IDs from %s table, %w", t.Name(), err)
+		}
+
+		for rows.Next() {
+
+			var id int64
+			err := rows.Scan(&id)
+
+			if err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("Failed to scan ID from %s table, %w", t.Name(), err)
+			}
+
+			indexed[id] = true
+		}
+
+		err = rows.Close()
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to close rows for %s table, %w", t.Name(), err)
+		}
+
+		err = rows.Err()
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to iterate rows for %s table, %w", t.Name(), err)
+		}
+	}
+
+	return indexed, nil
+}
+
+// mapKeys returns the keys of 'm'.
+func mapKeys(m map[int64]bool) []int64 {
+
+	keys := make([]int64, 0, len(m))
+
+	for k, _ := range m {
+		keys = append(keys, k)
+	}
+
+	return keys
+}
+
+// deriveRelations returns the unique (and valid) relation IDs found in 'body' for each of the gjson paths in 'candidates'.
+func deriveRelations(body []byte, candidates []string) []int64 {
+
+	seen := make(map[int64]bool)
+	relations := make([]int64, 0)
+
+	for _, path := range candidates {
+
+		rsp := gjson.GetBytes(body, path)
+
+		if !rsp.Exists() {
+			continue
+		}
+
+		for _, id := range relationIds(rsp) {
+
+			// skip -1, -4, etc.
+			// (20201224/thisisaaronland)
+
+			if id <= 0 {
+				continue
+			}
+
+			if seen[id] {
+				continue
+			}
+
+			seen[id] = true
+			relations = append(relations, id)
+		}
+	}
+
+	return relations
+}
+
+// relationIds returns the list of IDs contained in 'rsp', recursing in to arrays and objects.
+func relationIds(rsp gjson.Result) []int64 {
+
+	ids := make([]int64, 0)
+
+	switch {
+	case rsp.IsArray(), rsp.IsObject():
+
+		rsp.ForEach(func(k gjson.Result, v gjson.Result) bool {
+			ids = append(ids, relationIds(v)...)
+			return true
+		})
+
+	case rsp.Type == gjson.Number:
+		ids = append(ids, rsp.Int())
+	case rsp.Type == gjson.String:
+
+		// Some (custom) relation properties store IDs as strings
+
+		id, err := strconv.ParseInt(rsp.String(), 10, 64)
+
+		if err == nil {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids
+}
@@ -0,0 +1,219 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/aaronland/go-sqlite/v2"
+	sql_tables "github.com/whosonfirst/go-whosonfirst-sql/tables"
+)
+
+// FeatureTable is an interface for tables which store rows associated with Who's On First IDs and declare the column
+// those IDs are stored in. Only tables which implement this interface are read by `FeatureIds` and updated by the
+// `RemoveFeatures` and `RemoveAltFeature` methods.
+type FeatureTable interface {
+	sqlite.Table
+	// IdColumn returns the name of the column used to store Who's On First IDs. If empty the table is treated as if it
+	// did not implement the `FeatureTable` interface.
+	IdColumn() string
+}
+
+// NewFeatureTable returns a `FeatureTable` instance wrapping 't' whose Who's On First IDs are stored in the 'id_column' column.
+func NewFeatureTable(t sqlite.Table, id_column string) FeatureTable {
+
+	ft := &featureTable{
+		Table:     t,
+		id_column: id_column,
+	}
+
+	return ft
+}
+
+// featureTable implements the `FeatureTable` interface for tables which do not declare their ID column themselves.
+type featureTable struct {
+	sqlite.Table
+	id_column string
+}
+
+// IdColumn returns the name of the column used to store Who's On First IDs.
+func (t *featureTable) IdColumn() string {
+	return t.id_column
+}
+
+// idColumn returns the name of the column in 't' used to store Who's On First IDs and a boolean value indicating
+// whether 't' declares that column by implementing the `FeatureTable` interface.
+func idColumn(t sqlite.Table) (string, bool) {
+
+	ft, ok := t.(FeatureTable)
+
+	if !ok {
+		return "", false
+	}
+
+	col := ft.IdColumn()
+	return col, col != ""
+}
+
+// FeatureIds returns the sorted list of unique Who's On First IDs stored in any of 'tables'. Tables which do not implement
+// the `FeatureTable` interface are skipped.
+func FeatureIds(ctx context.Context, db sqlite.Database, tables []sqlite.Table) ([]int64, error) {
+
+	conn, err := db.Conn(ctx)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to establish database connection, %w", err)
+	}
+
+	seen := make(map[int64]bool)
+
+	for _, t := range tables {
+
+		col, ok := idColumn(t)
+
+		if !ok {
+			continue
+		}
+
+		q := fmt.Sprintf("SELECT DISTINCT %s FROM %s", col, t.Name())
+
+		rows, err := conn.QueryContext(ctx, q)
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to query IDs from %s table, %w", t.Name(), err)
+		}
+
+		for rows.Next() {
+
+			var id int64
+			err := rows.Scan(&id)
+
+			if err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("Failed to scan ID from %s table, %w", t.Name(), err)
+			}
+
+			seen[id] = true
+		}
+
+		err = rows.Close()
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to close rows for %s table, %w", t.Name(), err)
+		}
+
+		err = rows.Err()
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to iterate rows for %s table, %w", t.Name(), err)
+		}
+	}
+
+	ids := make([]int64, 0, len(seen))
+
+	for id, _ := range seen {
+		ids = append(ids, id)
+	}
+
+	slices.Sort(ids)
+	return ids, nil
+}
+
+// RemoveFeatures removes all the rows (including alternate geometries) associated with each of the Who's On First IDs in 'ids'
+// from each of 'tables'. Each table is updated in a single transaction. Tables which do not implement the `FeatureTable`
+// interface are left untouched.
+func RemoveFeatures(ctx context.Context, db sqlite.Database, tables []sqlite.Table, ids []int64) error {
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	conn, err := db.Conn(ctx)
+
+	if err != nil {
+		return fmt.Errorf("Failed to establish database connection, %w", err)
+	}
+
+	for _, t := range tables {
+
+		col, ok := idColumn(t)
+
+		if !ok {
+			continue
+		}
+
+		tx, err := conn.BeginTx(ctx, nil)
+
+		if err != nil {
+			return fmt.Errorf("Failed to begin transaction for %s table, %w", t.Name(), err)
+		}
+
+		q := fmt.Sprintf("DELETE FROM %s WHERE %s = ?", t.Name(), col)
+
+		stmt, err := tx.PrepareContext(ctx, q)
+
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Failed to prepare statement for %s table, %w", t.Name(), err)
+		}
+
+		for _, id := range ids {
+
+			_, err := stmt.ExecContext(ctx, id)
+
+			if err != nil {
+				stmt.Close()
+				tx.Rollback()
+				return fmt.Errorf("Failed to remove %d from %s table, %w", id, t.Name(), err)
+			}
+		}
+
+		stmt.Close()
+
+		err = tx.Commit()
+
+		if err != nil {
+			return fmt.Errorf("Failed to commit transaction for %s table, %w", t.Name(), err)
+		}
+	}
+
+	return nil
+}
+
+// RemoveAltFeature removes the rows associated with the alternate geometry labeled 'alt_label' for the Who's On First ID 'id'
+// from each of 'tables' that stores alternate geometries. Tables that do not store alternate geometries, or do not implement
+// the `FeatureTable` interface, are left untouched.
+func RemoveAltFeature(ctx context.Context, db sqlite.Database, tables []sqlite.Table, id int64, alt_label string) error {
+
+	conn, err := db.Conn(ctx)
+
+	if err != nil {
+		return fmt.Errorf("Failed to establish database connection, %w", err)
+	}
+
+	for _, t := range tables {
+
+		switch t.Name() {
+		case sql_tables.GEOJSON_TABLE_NAME, sql_tables.GEOMETRIES_TABLE_NAME, sql_tables.PROPERTIES_TABLE_NAME, sql_tables.RTREE_TABLE_NAME, sql_tables.SPR_TABLE_NAME:
+			// pass
+		default:
+			continue
+		}
+
+		col, ok := idColumn(t)
+
+		if !ok {
+			continue
+		}
+
+		q := fmt.Sprintf("DELETE FROM %s WHERE %s = ? AND alt_label = ?", t.Name(), col)
+
+		_, err := conn.ExecContext(ctx, q, id, alt_label)
+
+		if err != nil {
+			return fmt.Errorf("Failed to remove %d (%s) from %s table, %w", id, alt_label, t.Name(), err)
+		}
+	}
+
+	return nil
+}
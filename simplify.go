@@ -0,0 +1,284 @@
+package index
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+	"github.com/paulmach/orb/simplify"
+)
+
+// SimplifyAlgorithm defines the algorithm used to simplify geometries.
+type SimplifyAlgorithm string
+
+const (
+	// SimplifyAlgorithmDouglasPeucker simplifies geometries using the Douglas-Peucker algorithm.
+	SimplifyAlgorithmDouglasPeucker SimplifyAlgorithm = "douglas-peucker"
+	// SimplifyAlgorithmVisvalingam simplifies geometries using the Visvalingam-Whyatt algorithm.
+	SimplifyAlgorithmVisvalingam SimplifyAlgorithm = "visvalingam"
+)
+
+// GeometryTransformOptions is a struct to define options when creating a geometry transform.
+type GeometryTransformOptions struct {
+	// Algorithm is the algorithm used to simplify geometries. If empty `SimplifyAlgorithmDouglasPeucker` is used.
+	Algorithm SimplifyAlgorithm
+	// Tolerance is the threshold used to simplify geometries, in the units of the geometry's coordinates (decimal degrees).
+	// For the Douglas-Peucker algorithm this is the distance a point may be from the simplified line and for the Visvalingam
+	// algorithm it is the area (in square decimal degrees) of the smallest triangle, formed by a point and its neighbours,
+	// that is kept. If zero geometries are not simplified.
+	Tolerance float64
+	// Precision is the number of decimal places to round coordinates to. If zero coordinates are not rounded.
+	Precision int
+}
+
+// NewGeometryRecordTransformer returns a `RecordTransformer` instance which simplifies, and rounds the coordinates of, a
+// record's geometry, configured by 'uri' in the form of:
+//
+//	geometry://?tolerance={TOLERANCE}&precision={PRECISION}&algorithm={ALGORITHM}
+//
+// Where 'tolerance', 'precision' and 'algorithm' are interpreted as `GeometryTransformOptions.Tolerance`,
+// `GeometryTransformOptions.Precision` and `GeometryTransformOptions.Algorithm`.
+func NewGeometryRecordTransformer(ctx context.Context, uri string) (RecordTransformer, error) {
+
+	u, err := url.Parse(uri)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse URI, %w", err)
+	}
+
+	q := u.Query()
+
+	opts := &GeometryTransformOptions{
+		Algorithm: SimplifyAlgorithm(q.Get("algorithm")),
+	}
+
+	if q.Has("tolerance") {
+
+		v, err := strconv.ParseFloat(q.Get("tolerance"), 64)
+
+		if err != nil {
+			return nil, fmt.Errorf("Invalid ?tolerance= parameter, %w", err)
+		}
+
+		opts.Tolerance = v
+	}
+
+	if q.Has("precision") {
+
+		v, err := strconv.Atoi(q.Get("precision"))
+
+		if err != nil {
+			return nil, fmt.Errorf("Invalid ?precision= parameter, %w", err)
+		}
+
+		opts.Precision = v
+	}
+
+	fn, err := NewGeometryTransformFunc(opts)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return fn, nil
+}
+
+// NewGeometryTransformFunc returns a `RecordTransformFunc` which simplifies, and rounds the coordinates of, a record's
+// geometry according to 'opts'. Rings are never simplified or rounded to fewer than four positions. Properties derived
+// from the original geometry, like `geom:bbox`, are left untouched.
+func NewGeometryTransformFunc(opts *GeometryTransformOptions) (RecordTransformFunc, error) {
+
+	if opts.Tolerance < 0 {
+		return nil, fmt.Errorf("Invalid tolerance, %f", opts.Tolerance)
+	}
+
+	if opts.Precision < 0 {
+		return nil, fmt.Errorf("Invalid precision, %d", opts.Precision)
+	}
+
+	var simplifier orb.Simplifier
+
+	switch opts.Algorithm {
+	case "", SimplifyAlgorithmDouglasPeucker:
+		simplifier = simplify.DouglasPeucker(opts.Tolerance)
+	case SimplifyAlgorithmVisvalingam:
+		simplifier = simplify.VisvalingamThreshold(opts.Tolerance)
+	default:
+		return nil, fmt.Errorf("Invalid simplify algorithm '%s'", opts.Algorithm)
+	}
+
+	fn := func(ctx context.Context, path string, body []byte) ([]byte, error) {
+
+		if opts.Tolerance == 0 && opts.Precision == 0 {
+			return body, nil
+		}
+
+		var feature map[string]json.RawMessage
+
+		err := json.Unmarshal(body, &feature)
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to unmarshal record, %w", err)
+		}
+
+		geojson_geom, err := geojson.UnmarshalGeometry(feature["geometry"])
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to unmarshal geometry, %w", err)
+		}
+
+		geom := geojson_geom.Geometry()
+
+		if opts.Tolerance > 0 {
+
+			geom = simplifyGeometry(geom, func(points []orb.Point) []orb.Point {
+				// The simplifier modifies its input in place so give it a copy in case the original is kept
+				return simplifier.LineString(orb.LineString(points).Clone())
+			})
+		}
+
+		if opts.Precision > 0 {
+
+			factor := math.Pow10(opts.Precision)
+
+			geom = simplifyGeometry(geom, func(points []orb.Point) []orb.Point {
+				return roundPoints(points, factor)
+			})
+		}
+
+		enc_geom, err := marshalJSON(geojson.NewGeometry(geom))
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to marshal geometry, %w", err)
+		}
+
+		feature["geometry"] = enc_geom
+
+		new_body, err := marshalJSON(feature)
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to marshal record, %w", err)
+		}
+
+		return new_body, nil
+	}
+
+	return fn, nil
+}
+
+// simplifyGeometry returns a copy of 'geom' where each line string and ring has been replaced by the result of 'fn'.
+// Line strings reduced to fewer than two positions, and rings reduced to fewer than four, are left unchanged.
+func simplifyGeometry(geom orb.Geometry, fn func([]orb.Point) []orb.Point) orb.Geometry {
+
+	line := func(ls orb.LineString) orb.LineString {
+
+		points := fn(ls)
+
+		if len(points) < 2 {
+			return ls
+		}
+
+		return orb.LineString(points)
+	}
+
+	ring := func(r orb.Ring) orb.Ring {
+
+		points := fn(r)
+
+		if len(points) < 4 || points[0] != points[len(points)-1] {
+			return r
+		}
+
+		return orb.Ring(points)
+	}
+
+	polygon := func(p orb.Polygon) orb.Polygon {
+
+		new_p := make(orb.Polygon, len(p))
+
+		for i, r := range p {
+			new_p[i] = ring(r)
+		}
+
+		return new_p
+	}
+
+	switch g := geom.(type) {
+	case orb.Point:
+		return orb.Point(fn([]orb.Point{g})[0])
+	case orb.MultiPoint:
+
+		new_g := make(orb.MultiPoint, len(g))
+
+		for i, pt := range g {
+			new_g[i] = fn([]orb.Point{pt})[0]
+		}
+
+		return new_g
+
+	case orb.LineString:
+		return line(g)
+	case orb.MultiLineString:
+
+		new_g := make(orb.MultiLineString, len(g))
+
+		for i, ls := range g {
+			new_g[i] = line(ls)
+		}
+
+		return new_g
+
+	case orb.Polygon:
+		return polygon(g)
+	case orb.MultiPolygon:
+
+		new_g := make(orb.MultiPolygon, len(g))
+
+		for i, p := range g {
+			new_g[i] = polygon(p)
+		}
+
+		return new_g
+
+	case orb.Collection:
+
+		new_g := make(orb.Collection, len(g))
+
+		for i, c := range g {
+			new_g[i] = simplifyGeometry(c, fn)
+		}
+
+		return new_g
+
+	default:
+		return geom
+	}
+}
+
+// roundPoints returns a copy of 'points' whose coordinates have been rounded using 'factor', removing consecutive
+// duplicate positions.
+func roundPoints(points []orb.Point, factor float64) []orb.Point {
+
+	rounded := make([]orb.Point, 0, len(points))
+
+	for _, pt := range points {
+
+		new_pt := orb.Point{
+			math.Round(pt[0]*factor) / factor,
+			math.Round(pt[1]*factor) / factor,
+		}
+
+		if len(rounded) > 0 && rounded[len(rounded)-1] == new_pt {
+			continue
+		}
+
+		rounded = append(rounded, new_pt)
+	}
+
+	return rounded
+}
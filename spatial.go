@@ -0,0 +1,355 @@
+package index
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+	"github.com/paulmach/orb/planar"
+	"github.com/tidwall/gjson"
+)
+
+// SpatialFilter is a struct for testing whether geometries intersect a (multi) polygon region.
+type SpatialFilter struct {
+	region orb.MultiPolygon
+	bound  orb.Bound
+}
+
+// NewSpatialFilter returns a new `SpatialFilter` instance for the region defined by 'geom' which is expected to be
+// an `orb.Bound`, `orb.Polygon` or `orb.MultiPolygon` instance.
+func NewSpatialFilter(geom orb.Geometry) (*SpatialFilter, error) {
+
+	var region orb.MultiPolygon
+
+	switch g := geom.(type) {
+	case orb.Bound:
+		region = orb.MultiPolygon{g.ToPolygon()}
+	case orb.Polygon:
+		region = orb.MultiPolygon{g}
+	case orb.MultiPolygon:
+		region = g
+	default:
+		return nil, fmt.Errorf("Invalid geometry type for spatial filter, %T", geom)
+	}
+
+	region = nonEmptyPolygons(region)
+
+	if len(region) == 0 {
+		return nil, fmt.Errorf("Invalid spatial filter, empty region")
+	}
+
+	f := &SpatialFilter{
+		region: region,
+		bound:  region.Bound(),
+	}
+
+	return f, nil
+}
+
+// NewSpatialFilterFromBbox returns a new `SpatialFilter` instance for the region defined by 'str' which is expected
+// to be a comma-separated "{MINX},{MINY},{MAXX},{MAXY}" string.
+func NewSpatialFilterFromBbox(str string) (*SpatialFilter, error) {
+
+	parts := strings.Split(str, ",")
+
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("Invalid bounding box '%s', expected minx,miny,maxx,maxy", str)
+	}
+
+	coords := make([]float64, 4)
+
+	for i, p := range parts {
+
+		v, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+
+		if err != nil {
+			return nil, fmt.Errorf("Invalid bounding box '%s', %w", str, err)
+		}
+
+		coords[i] = v
+	}
+
+	if coords[0] > coords[2] || coords[1] > coords[3] {
+		return nil, fmt.Errorf("Invalid bounding box '%s', minimum coordinates exceed maximum coordinates", str)
+	}
+
+	b := orb.Bound{
+		Min: orb.Point{coords[0], coords[1]},
+		Max: orb.Point{coords[2], coords[3]},
+	}
+
+	return NewSpatialFilter(b)
+}
+
+// NewSpatialFilterFromGeoJSON returns a new `SpatialFilter` instance for the region defined by 'body' which is expected
+// to be a GeoJSON Polygon or MultiPolygon geometry, or a Feature or FeatureCollection whose geometries are (multi) polygons.
+func NewSpatialFilterFromGeoJSON(body []byte) (*SpatialFilter, error) {
+
+	geoms := make([]orb.Geometry, 0)
+
+	switch gjson.GetBytes(body, "type").String() {
+	case "FeatureCollection":
+
+		fc, err := geojson.UnmarshalFeatureCollection(body)
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to unmarshal feature collection, %w", err)
+		}
+
+		for _, f := range fc.Features {
+			geoms = append(geoms, f.Geometry)
+		}
+
+	case "Feature":
+
+		f, err := geojson.UnmarshalFeature(body)
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to unmarshal feature, %w", err)
+		}
+
+		geoms = append(geoms, f.Geometry)
+
+	default:
+
+		g, err := geojson.UnmarshalGeometry(body)
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to unmarshal geometry, %w", err)
+		}
+
+		geoms = append(geoms, g.Geometry())
+	}
+
+	region := make(orb.MultiPolygon, 0)
+
+	for _, geom := range geoms {
+
+		switch g := geom.(type) {
+		case orb.Polygon:
+			region = append(region, g)
+		case orb.MultiPolygon:
+			region = append(region, g...)
+		default:
+			return nil, fmt.Errorf("Invalid geometry type for spatial filter, %T", geom)
+		}
+	}
+
+	return NewSpatialFilter(region)
+}
+
+// Intersects returns a boolean value indicating whether 'geom' intersects the filter's region.
+func (f *SpatialFilter) Intersects(geom orb.Geometry) bool {
+
+	if geom == nil || !f.bound.Intersects(geom.Bound()) {
+		return false
+	}
+
+	for _, pt := range geometryPoints(geom) {
+
+		if planar.MultiPolygonContains(f.region, pt) {
+			return true
+		}
+	}
+
+	polygons := geometryPolygons(geom)
+
+	if len(polygons) > 0 {
+
+		for _, poly := range f.region {
+
+			for _, ring := range poly {
+
+				for _, pt := range ring {
+
+					if planar.MultiPolygonContains(polygons, pt) {
+						return true
+					}
+				}
+			}
+		}
+	}
+
+	geom_segments := geometrySegments(geom, f.bound)
+	region_segments := geometrySegments(f.region, geom.Bound())
+
+	for _, a := range geom_segments {
+
+		for _, b := range region_segments {
+
+			if segmentsIntersect(a[0], a[1], b[0], b[1]) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// geometryPoints returns all the vertices in 'geom'.
+func geometryPoints(geom orb.Geometry) []orb.Point {
+
+	points := make([]orb.Point, 0)
+
+	switch g := geom.(type) {
+	case orb.Point:
+		points = append(points, g)
+	case orb.MultiPoint:
+		points = append(points, g...)
+	case orb.LineString:
+		points = append(points, g...)
+	case orb.MultiLineString:
+		for _, ls := range g {
+			points = append(points, ls...)
+		}
+	case orb.Ring:
+		points = append(points, g...)
+	case orb.Polygon:
+		for _, r := range g {
+			points = append(points, r...)
+		}
+	case orb.MultiPolygon:
+		for _, p := range g {
+			points = append(points, geometryPoints(p)...)
+		}
+	case orb.Collection:
+		for _, c := range g {
+			points = append(points, geometryPoints(c)...)
+		}
+	case orb.Bound:
+		points = append(points, g.ToRing()...)
+	default:
+		// pass
+	}
+
+	return points
+}
+
+// geometryPolygons returns all the (non-empty) polygons in 'geom'.
+func geometryPolygons(geom orb.Geometry) orb.MultiPolygon {
+
+	polygons := make(orb.MultiPolygon, 0)
+
+	switch g := geom.(type) {
+	case orb.Polygon:
+		polygons = append(polygons, g)
+	case orb.MultiPolygon:
+		polygons = append(polygons, g...)
+	case orb.Bound:
+		polygons = append(polygons, g.ToPolygon())
+	case orb.Collection:
+		for _, c := range g {
+			polygons = append(polygons, geometryPolygons(c)...)
+		}
+	default:
+		// pass
+	}
+
+	return nonEmptyPolygons(polygons)
+}
+
+// nonEmptyPolygons returns the polygons in 'mp' which have a non-empty exterior ring since `planar.PolygonContains`
+// expects every polygon to have one.
+func nonEmptyPolygons(mp orb.MultiPolygon) orb.MultiPolygon {
+
+	polygons := make(orb.MultiPolygon, 0, len(mp))
+
+	for _, poly := range mp {
+
+		if len(poly) > 0 && len(poly[0]) > 0 {
+			polygons = append(polygons, poly)
+		}
+	}
+
+	return polygons
+}
+
+// geometrySegments returns all the line segments in 'geom' whose bounds intersect 'bound'.
+func geometrySegments(geom orb.Geometry, bound orb.Bound) [][2]orb.Point {
+
+	segments := make([][2]orb.Point, 0)
+
+	add := func(line []orb.Point) {
+
+		for i := 1; i < len(line); i++ {
+
+			a := line[i-1]
+			b := line[i]
+
+			seg_bound := orb.Bound{Min: a, Max: a}.Extend(b)
+
+			if bound.Intersects(seg_bound) {
+				segments = append(segments, [2]orb.Point{a, b})
+			}
+		}
+	}
+
+	switch g := geom.(type) {
+	case orb.LineString:
+		add(g)
+	case orb.MultiLineString:
+		for _, ls := range g {
+			add(ls)
+		}
+	case orb.Ring:
+		add(g)
+	case orb.Polygon:
+		for _, r := range g {
+			add(r)
+		}
+	case orb.MultiPolygon:
+		for _, p := range g {
+			for _, r := range p {
+				add(r)
+			}
+		}
+	case orb.Collection:
+		for _, c := range g {
+			segments = append(segments, geometrySegments(c, bound)...)
+		}
+	case orb.Bound:
+		add(g.ToRing())
+	default:
+		// pass
+	}
+
+	return segments
+}
+
+// segmentsIntersect returns a boolean value indicating whether the line segments 'p1'-'p2' and 'p3'-'p4' intersect.
+func segmentsIntersect(p1 orb.Point, p2 orb.Point, p3 orb.Point, p4 orb.Point) bool {
+
+	d1 := orientation(p3, p4, p1)
+	d2 := orientation(p3, p4, p2)
+	d3 := orientation(p1, p2, p3)
+	d4 := orientation(p1, p2, p4)
+
+	if ((d1 > 0 && d2 < 0) || (d1 < 0 && d2 > 0)) && ((d3 > 0 && d4 < 0) || (d3 < 0 && d4 > 0)) {
+		return true
+	}
+
+	switch {
+	case d1 == 0 && onSegment(p3, p4, p1):
+		return true
+	case d2 == 0 && onSegment(p3, p4, p2):
+		return true
+	case d3 == 0 && onSegment(p1, p2, p3):
+		return true
+	case d4 == 0 && onSegment(p1, p2, p4):
+		return true
+	default:
+		return false
+	}
+}
+
+// orientation returns the cross product of the vectors 'a'-'b' and 'a'-'c'.
+func orientation(a orb.Point, b orb.Point, c orb.Point) float64 {
+	return (b[0]-a[0])*(c[1]-a[1]) - (b[1]-a[1])*(c[0]-a[0])
+}
+
+// onSegment returns a boolean value indicating whether 'c', which is known to be collinear with 'a' and 'b', lies on the segment 'a'-'b'.
+func onSegment(a orb.Point, b orb.Point, c orb.Point) bool {
+	return orb.Bound{Min: a, Max: a}.Extend(b).Contains(c)
+}
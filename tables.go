@@ -0,0 +1,232 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aaronland/go-roster"
+	"github.com/aaronland/go-sqlite/v2"
+	sql_tables "github.com/whosonfirst/go-whosonfirst-sql/tables"
+	"github.com/whosonfirst/go-whosonfirst-sqlite-features/v2/tables"
+)
+
+var table_roster roster.Roster
+
+// TableOptions is a struct to define options when creating a table using the `NewTable` method.
+type TableOptions struct {
+	// IndexAltFiles is a boolean flag indicating whether the table should index alternate geometry files, if it supports them.
+	IndexAltFiles bool
+}
+
+// TableInitializationFunc is a function defined by individual table packages and used to create (and initialize, if
+// necessary) an instance of that table in a database.
+type TableInitializationFunc func(ctx context.Context, db sqlite.Database, opts *TableOptions) (sqlite.Table, error)
+
+func init() {
+
+	ctx := context.Background()
+
+	// Note that the rtree table's 'id' column is an internal primary key so Who's On First IDs are stored in 'wof_id'
+
+	to_register := map[string]TableInitializationFunc{
+		sql_tables.GEOJSON_TABLE_NAME:      withIdColumn(newGeoJSONTable, "id"),
+		sql_tables.SUPERSEDES_TABLE_NAME:   withIdColumn(newSupersedesTable, "id"),
+		sql_tables.RTREE_TABLE_NAME:        withIdColumn(newRTreeTable, "wof_id"),
+		sql_tables.PROPERTIES_TABLE_NAME:   withIdColumn(newPropertiesTable, "id"),
+		sql_tables.SPR_TABLE_NAME:          withIdColumn(newSPRTable, "id"),
+		sql_tables.NAMES_TABLE_NAME:        withIdColumn(newNamesTable, "id"),
+		sql_tables.ANCESTORS_TABLE_NAME:    withIdColumn(newAncestorsTable, "id"),
+		sql_tables.CONCORDANCES_TABLE_NAME: withIdColumn(newConcordancesTable, "id"),
+		sql_tables.GEOMETRIES_TABLE_NAME:   withIdColumn(newGeometriesTable, "id"),
+		sql_tables.SEARCH_TABLE_NAME:       withIdColumn(newSearchTable, "id"),
+	}
+
+	for name, init_func := range to_register {
+
+		err := RegisterTable(ctx, name, init_func)
+
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+// RegisterTable registers 'name' as a key pointing to 'init_func' in an internal lookup table used to create
+// new `aaronland/go-sqlite.Table` instances by the `NewTable` method.
+func RegisterTable(ctx context.Context, name string, init_func TableInitializationFunc) error {
+
+	err := ensureTableRoster()
+
+	if err != nil {
+		return err
+	}
+
+	return table_roster.Register(ctx, name, init_func)
+}
+
+func ensureTableRoster() error {
+
+	if table_roster == nil {
+
+		r, err := roster.NewDefaultRoster()
+
+		if err != nil {
+			return err
+		}
+
+		table_roster = r
+	}
+
+	return nil
+}
+
+// NewTable returns a new `aaronland/go-sqlite.Table` instance for the table registered as 'name', created in 'db'
+// with 'opts'. It is assumed that the name (and initialization function) have been registered by the `RegisterTable` method.
+func NewTable(ctx context.Context, name string, db sqlite.Database, opts *TableOptions) (sqlite.Table, error) {
+
+	err := ensureTableRoster()
+
+	if err != nil {
+		return nil, err
+	}
+
+	i, err := table_roster.Driver(ctx, name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if opts == nil {
+		opts = &TableOptions{}
+	}
+
+	init_func := i.(TableInitializationFunc)
+	return init_func(ctx, db, opts)
+}
+
+// TableNames returns the list of table names that have been registered.
+func TableNames() []string {
+
+	ctx := context.Background()
+	names := []string{}
+
+	err := ensureTableRoster()
+
+	if err != nil {
+		return names
+	}
+
+	for _, dr := range table_roster.Drivers(ctx) {
+		names = append(names, strings.ToLower(dr))
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// withIdColumn returns a `TableInitializationFunc` function which invokes 'init_func' and wraps the resultant table in a
+// `FeatureTable` instance whose Who's On First IDs are stored in the 'id_column' column.
+func withIdColumn(init_func TableInitializationFunc, id_column string) TableInitializationFunc {
+
+	fn := func(ctx context.Context, db sqlite.Database, opts *TableOptions) (sqlite.Table, error) {
+
+		t, err := init_func(ctx, db, opts)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return NewFeatureTable(t, id_column), nil
+	}
+
+	return fn
+}
+
+func newGeoJSONTable(ctx context.Context, db sqlite.Database, opts *TableOptions) (sqlite.Table, error) {
+
+	geojson_opts, err := tables.DefaultGeoJSONTableOptions()
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create '%s' table options, %w", sql_tables.GEOJSON_TABLE_NAME, err)
+	}
+
+	geojson_opts.IndexAltFiles = opts.IndexAltFiles
+
+	return tables.NewGeoJSONTableWithDatabaseAndOptions(ctx, db, geojson_opts)
+}
+
+func newSupersedesTable(ctx context.Context, db sqlite.Database, opts *TableOptions) (sqlite.Table, error) {
+	return tables.NewSupersedesTableWithDatabase(ctx, db)
+}
+
+func newRTreeTable(ctx context.Context, db sqlite.Database, opts *TableOptions) (sqlite.Table, error) {
+
+	rtree_opts, err := tables.DefaultRTreeTableOptions()
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create '%s' table options, %w", sql_tables.RTREE_TABLE_NAME, err)
+	}
+
+	rtree_opts.IndexAltFiles = opts.IndexAltFiles
+
+	return tables.NewRTreeTableWithDatabaseAndOptions(ctx, db, rtree_opts)
+}
+
+func newPropertiesTable(ctx context.Context, db sqlite.Database, opts *TableOptions) (sqlite.Table, error) {
+
+	properties_opts, err := tables.DefaultPropertiesTableOptions()
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create '%s' table options, %w", sql_tables.PROPERTIES_TABLE_NAME, err)
+	}
+
+	properties_opts.IndexAltFiles = opts.IndexAltFiles
+
+	return tables.NewPropertiesTableWithDatabaseAndOptions(ctx, db, properties_opts)
+}
+
+func newSPRTable(ctx context.Context, db sqlite.Database, opts *TableOptions) (sqlite.Table, error) {
+
+	spr_opts, err := tables.DefaultSPRTableOptions()
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create '%s' table options, %w", sql_tables.SPR_TABLE_NAME, err)
+	}
+
+	spr_opts.IndexAltFiles = opts.IndexAltFiles
+
+	return tables.NewSPRTableWithDatabaseAndOptions(ctx, db, spr_opts)
+}
+
+func newNamesTable(ctx context.Context, db sqlite.Database, opts *TableOptions) (sqlite.Table, error) {
+	return tables.NewNamesTableWithDatabase(ctx, db)
+}
+
+func newAncestorsTable(ctx context.Context, db sqlite.Database, opts *TableOptions) (sqlite.Table, error) {
+	return tables.NewAncestorsTableWithDatabase(ctx, db)
+}
+
+func newConcordancesTable(ctx context.Context, db sqlite.Database, opts *TableOptions) (sqlite.Table, error) {
+	return tables.NewConcordancesTableWithDatabase(ctx, db)
+}
+
+// newGeometriesTable returns a new 'geometries' table which requires that libspatialite already be installed.
+func newGeometriesTable(ctx context.Context, db sqlite.Database, opts *TableOptions) (sqlite.Table, error) {
+
+	geometries_opts, err := tables.DefaultGeometriesTableOptions()
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create '%s' table options, %w", sql_tables.GEOMETRIES_TABLE_NAME, err)
+	}
+
+	geometries_opts.IndexAltFiles = opts.IndexAltFiles
+
+	return tables.NewGeometriesTableWithDatabaseAndOptions(ctx, db, geometries_opts)
+}
+
+// newSearchTable returns a new 'search' table. This table does not index alternate geometry files.
+func newSearchTable(ctx context.Context, db sqlite.Database, opts *TableOptions) (sqlite.Table, error) {
+	return tables.NewSearchTableWithDatabase(ctx, db)
+}
@@ -0,0 +1,255 @@
+package index
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// required_properties is the list of properties that are always retained by the transform returned by
+// `NewPropertiesTransformFunc` when its `Include` option is not empty since they are needed to index a record.
+var required_properties = []string{
+	"wof:id",
+	"wof:name",
+	"wof:placetype",
+	"wof:parent_id",
+	"wof:repo",
+	"wof:country",
+	"wof:lastmodified",
+	"wof:belongsto",
+	"wof:hierarchy",
+	"wof:supersedes",
+	"wof:superseded_by",
+	"mz:is_current",
+	"edtf:inception",
+	"edtf:cessation",
+	"edtf:deprecated",
+	"src:alt_label",
+	"src:geom",
+	"geom:latitude",
+	"geom:longitude",
+	"lbl:latitude",
+	"lbl:longitude",
+}
+
+// PropertiesTransformOptions is a struct to define options when creating a properties transform.
+type PropertiesTransformOptions struct {
+	// Include is an optional list of property names to retain. If not empty all other properties, except those needed
+	// to index a record (for example `wof:id` or `wof:placetype`), are removed. Names may contain "*" wildcards, for
+	// example "name:*", and may be prefixed with "properties.".
+	Include []string
+	// Exclude is an optional list of property paths to remove. Paths are dot-separated, may contain "*" wildcards in
+	// each segment and may be prefixed with "properties."; for example "edtf:*", "name:*_x_variant" or "wof:concordances.gn:id".
+	// Exclusions are applied after `Include` and are never overridden.
+	Exclude []string
+}
+
+// NewPropertiesRecordTransformer returns a `RecordTransformer` instance which removes properties from a record, configured
+// by 'uri' in the form of:
+//
+//	properties://?include={PROPERTY}&exclude={PATH}
+//
+// Where 'include' and 'exclude' may be repeated and are interpreted as `PropertiesTransformOptions.Include` and `PropertiesTransformOptions.Exclude`.
+func NewPropertiesRecordTransformer(ctx context.Context, uri string) (RecordTransformer, error) {
+
+	u, err := url.Parse(uri)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse URI, %w", err)
+	}
+
+	q := u.Query()
+
+	opts := &PropertiesTransformOptions{
+		Include: q["include"],
+		Exclude: q["exclude"],
+	}
+
+	fn, err := NewPropertiesTransformFunc(opts)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return fn, nil
+}
+
+// NewPropertiesTransformFunc returns a `RecordTransformFunc` which removes properties from a record according to 'opts'.
+func NewPropertiesTransformFunc(opts *PropertiesTransformOptions) (RecordTransformFunc, error) {
+
+	include := make([]string, len(opts.Include))
+
+	for i, p := range opts.Include {
+
+		p = strings.TrimPrefix(p, "properties.")
+
+		_, err := path.Match(p, "")
+
+		if err != nil || p == "" {
+			return nil, fmt.Errorf("Invalid property '%s'", opts.Include[i])
+		}
+
+		include[i] = p
+	}
+
+	exclude := make([][]string, len(opts.Exclude))
+
+	for i, p := range opts.Exclude {
+
+		segments := strings.Split(strings.TrimPrefix(p, "properties."), ".")
+
+		for _, s := range segments {
+
+			_, err := path.Match(s, "")
+
+			if err != nil || s == "" {
+				return nil, fmt.Errorf("Invalid property path '%s'", p)
+			}
+		}
+
+		exclude[i] = segments
+	}
+
+	fn := func(ctx context.Context, record_path string, body []byte) ([]byte, error) {
+
+		var feature map[string]json.RawMessage
+
+		err := json.Unmarshal(body, &feature)
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to unmarshal record, %w", err)
+		}
+
+		var props map[string]json.RawMessage
+
+		err = json.Unmarshal(feature["properties"], &props)
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to unmarshal properties, %w", err)
+		}
+
+		changed := false
+
+		if len(include) > 0 {
+
+			for k := range props {
+
+				if !matchesAnyProperty(required_properties, k) && !matchesAnyProperty(include, k) {
+					delete(props, k)
+					changed = true
+				}
+			}
+		}
+
+		for _, segments := range exclude {
+
+			if removeProperty(props, segments) {
+				changed = true
+			}
+		}
+
+		if !changed {
+			return body, nil
+		}
+
+		enc_props, err := marshalJSON(props)
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to marshal properties, %w", err)
+		}
+
+		feature["properties"] = enc_props
+
+		new_body, err := marshalJSON(feature)
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to marshal record, %w", err)
+		}
+
+		return new_body, nil
+	}
+
+	return fn, nil
+}
+
+// matchesAnyProperty returns a boolean value indicating whether the property 'name' matches any of 'patterns'.
+func matchesAnyProperty(patterns []string, name string) bool {
+
+	for _, p := range patterns {
+
+		ok, _ := path.Match(p, name)
+
+		if ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// removeProperty removes the keys matching the path 'segments' from 'obj', descending in to nested objects as necessary,
+// and returns a boolean value indicating whether 'obj' was changed.
+func removeProperty(obj map[string]json.RawMessage, segments []string) bool {
+
+	changed := false
+
+	for k, v := range obj {
+
+		ok, _ := path.Match(segments[0], k)
+
+		if !ok {
+			continue
+		}
+
+		if len(segments) == 1 {
+			delete(obj, k)
+			changed = true
+			continue
+		}
+
+		var child map[string]json.RawMessage
+
+		err := json.Unmarshal(v, &child)
+
+		if err != nil {
+			// Not an object
+			continue
+		}
+
+		if !removeProperty(child, segments[1:]) {
+			continue
+		}
+
+		enc_child, err := marshalJSON(child)
+
+		if err != nil {
+			continue
+		}
+
+		obj[k] = enc_child
+		changed = true
+	}
+
+	return changed
+}
+
+// marshalJSON returns the JSON encoding of 'v' without escaping HTML characters.
+func marshalJSON(v interface{}) ([]byte, error) {
+
+	var buf bytes.Buffer
+
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+
+	err := enc.Encode(v)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimRight(buf.Bytes(), "\n"), nil
+}
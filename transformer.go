@@ -0,0 +1,176 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/aaronland/go-roster"
+)
+
+var transformer_roster roster.Roster
+
+// RecordTransformerInitializationFunc is a function defined by individual transformer packages and used to create
+// an instance of that transformer.
+type RecordTransformerInitializationFunc func(ctx context.Context, uri string) (RecordTransformer, error)
+
+// RecordTransformer is an interface for transforming Who's On First records before they are indexed.
+type RecordTransformer interface {
+	// Transform returns a transformed copy of the record 'body' read from 'path'.
+	Transform(ctx context.Context, path string, body []byte) ([]byte, error)
+}
+
+// RecordTransformFunc is a function used to transform a Who's On First record before it is indexed. It implements
+// the `RecordTransformer` interface.
+type RecordTransformFunc func(ctx context.Context, path string, body []byte) ([]byte, error)
+
+// Transform returns the result of invoking 'fn' with 'path' and 'body'.
+func (fn RecordTransformFunc) Transform(ctx context.Context, path string, body []byte) ([]byte, error) {
+	return fn(ctx, path, body)
+}
+
+func init() {
+
+	ctx := context.Background()
+
+	to_register := map[string]RecordTransformerInitializationFunc{
+		"null":       NewNullRecordTransformer,
+		"properties": NewPropertiesRecordTransformer,
+		"geometry":   NewGeometryRecordTransformer,
+	}
+
+	for scheme, init_func := range to_register {
+
+		err := RegisterRecordTransformer(ctx, scheme, init_func)
+
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+// RegisterRecordTransformer registers 'scheme' as a key pointing to 'init_func' in an internal lookup table
+// used to create new `RecordTransformer` instances by the `NewRecordTransformer` method.
+func RegisterRecordTransformer(ctx context.Context, scheme string, init_func RecordTransformerInitializationFunc) error {
+
+	err := ensureRecordTransformerRoster()
+
+	if err != nil {
+		return err
+	}
+
+	return transformer_roster.Register(ctx, scheme, init_func)
+}
+
+func ensureRecordTransformerRoster() error {
+
+	if transformer_roster == nil {
+
+		r, err := roster.NewDefaultRoster()
+
+		if err != nil {
+			return err
+		}
+
+		transformer_roster = r
+	}
+
+	return nil
+}
+
+// NewRecordTransformer returns a new `RecordTransformer` instance configured by 'uri'. The value of 'uri' is parsed
+// as a `url.URL` and its scheme is used as the key for a corresponding `RecordTransformerInitializationFunc`
+// function used to instantiate the new `RecordTransformer`. It is assumed that the scheme (and initialization
+// function) have been registered by the `RegisterRecordTransformer` method.
+func NewRecordTransformer(ctx context.Context, uri string) (RecordTransformer, error) {
+
+	u, err := url.Parse(uri)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse URI, %w", err)
+	}
+
+	err = ensureRecordTransformerRoster()
+
+	if err != nil {
+		return nil, err
+	}
+
+	i, err := transformer_roster.Driver(ctx, u.Scheme)
+
+	if err != nil {
+		return nil, err
+	}
+
+	init_func := i.(RecordTransformerInitializationFunc)
+	return init_func(ctx, uri)
+}
+
+// RecordTransformerSchemes returns the list of schemes that have been registered.
+func RecordTransformerSchemes() []string {
+
+	ctx := context.Background()
+	schemes := []string{}
+
+	err := ensureRecordTransformerRoster()
+
+	if err != nil {
+		return schemes
+	}
+
+	for _, dr := range transformer_roster.Drivers(ctx) {
+		scheme := fmt.Sprintf("%s://", strings.ToLower(dr))
+		schemes = append(schemes, scheme)
+	}
+
+	sort.Strings(schemes)
+	return schemes
+}
+
+// ChainedRecordTransformer implements the `RecordTransformer` interface for a list of `RecordTransformer` instances
+// which are applied in order, each one transforming the output of the previous one.
+type ChainedRecordTransformer struct {
+	transformers []RecordTransformer
+}
+
+// NewChainedRecordTransformer returns a new `ChainedRecordTransformer` instance for 'transformers'.
+func NewChainedRecordTransformer(transformers ...RecordTransformer) *ChainedRecordTransformer {
+
+	t := &ChainedRecordTransformer{
+		transformers: transformers,
+	}
+
+	return t
+}
+
+// Transform returns the result of applying each of the transformers, in order, to 'body'.
+func (t *ChainedRecordTransformer) Transform(ctx context.Context, path string, body []byte) ([]byte, error) {
+
+	for i, tr := range t.transformers {
+
+		new_body, err := tr.Transform(ctx, path, body)
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to apply transformer %d (%T), %w", i, tr, err)
+		}
+
+		body = new_body
+	}
+
+	return body, nil
+}
+
+// NewNullRecordTransformer returns a `RecordTransformer` instance which returns records unchanged, configured by 'uri'
+// in the form of:
+//
+//	null://
+func NewNullRecordTransformer(ctx context.Context, uri string) (RecordTransformer, error) {
+
+	fn := func(ctx context.Context, path string, body []byte) ([]byte, error) {
+		return body, nil
+	}
+
+	return RecordTransformFunc(fn), nil
+}
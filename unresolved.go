@@ -0,0 +1,129 @@
+package index
+
+import (
+	"cmp"
+	"slices"
+	"sync"
+)
+
+// UnresolvedRelation is a struct describing a relation that could not be read or parsed.
+type UnresolvedRelation struct {
+	// Id is the Who's On First ID of the relation.
+	Id int64 `json:"id"`
+	// ReferencedBy is the sorted list of Who's On First IDs of the records that reference the relation.
+	ReferencedBy []int64 `json:"referenced_by"`
+	// Error is the (first) error encountered reading or parsing the relation.
+	Error string `json:"error"`
+}
+
+// UnresolvedRelations is a struct for collecting, concurrently, the relations that could not be read or parsed. A nil
+// instance may be used when these relations are not being collected.
+type UnresolvedRelations struct {
+	mu        *sync.Mutex
+	relations map[int64]*UnresolvedRelation
+	// referrers is a map of relation IDs and the (unique) IDs of the records that reference them.
+	referrers map[int64]map[int64]bool
+}
+
+// NewUnresolvedRelations returns a new `UnresolvedRelations` instance.
+func NewUnresolvedRelations() *UnresolvedRelations {
+
+	u := &UnresolvedRelations{
+		mu:        new(sync.Mutex),
+		relations: make(map[int64]*UnresolvedRelation),
+		referrers: make(map[int64]map[int64]bool),
+	}
+
+	return u
+}
+
+// Add records that the relation 'id', referenced by 'referenced_by', could not be read or parsed because of 'err'.
+func (u *UnresolvedRelations) Add(id int64, referenced_by []int64, err error) {
+
+	if u == nil {
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	_, exists := u.relations[id]
+
+	if !exists {
+
+		u.relations[id] = &UnresolvedRelation{
+			Id:    id,
+			Error: err.Error(),
+		}
+
+		u.referrers[id] = make(map[int64]bool)
+	}
+
+	u.addReferrers(id, referenced_by)
+}
+
+// Reference records that the relation 'id' is also referenced by 'referenced_by', if 'id' has already been added.
+func (u *UnresolvedRelations) Reference(id int64, referenced_by []int64) {
+
+	if u == nil {
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	_, exists := u.relations[id]
+
+	if !exists {
+		return
+	}
+
+	u.addReferrers(id, referenced_by)
+}
+
+// Relations returns the list of unresolved relations sorted by ID.
+func (u *UnresolvedRelations) Relations() []*UnresolvedRelation {
+
+	relations := make([]*UnresolvedRelation, 0)
+
+	if u == nil {
+		return relations
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for id, rel := range u.relations {
+
+		referenced_by := make([]int64, 0, len(u.referrers[id]))
+
+		for ref_id, _ := range u.referrers[id] {
+			referenced_by = append(referenced_by, ref_id)
+		}
+
+		slices.Sort(referenced_by)
+
+		relations = append(relations, &UnresolvedRelation{
+			Id:           rel.Id,
+			ReferencedBy: referenced_by,
+			Error:        rel.Error,
+		})
+	}
+
+	slices.SortFunc(relations, func(a *UnresolvedRelation, b *UnresolvedRelation) int {
+		return cmp.Compare(a.Id, b.Id)
+	})
+
+	return relations
+}
+
+// addReferrers adds each of the (valid) IDs in 'referenced_by' to the list of records referencing 'id'. Callers must hold 'u.mu'.
+func (u *UnresolvedRelations) addReferrers(id int64, referenced_by []int64) {
+
+	for _, ref_id := range referenced_by {
+
+		if ref_id > 0 {
+			u.referrers[id][ref_id] = true
+		}
+	}
+}
@@ -0,0 +1,320 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"sync"
+
+	"github.com/paulmach/orb"
+	"github.com/sfomuseum/go-edtf"
+	"github.com/sfomuseum/go-edtf/parser"
+	"github.com/whosonfirst/go-whosonfirst-feature/geometry"
+	"github.com/whosonfirst/go-whosonfirst-feature/properties"
+)
+
+// ValidationMode defines what happens to records that fail validation.
+type ValidationMode string
+
+const (
+	// ValidationModeReject causes records that fail validation to trigger a critical error.
+	ValidationModeReject ValidationMode = "reject"
+	// ValidationModeWarn causes records that fail validation to be logged, and indexed.
+	ValidationModeWarn ValidationMode = "warn"
+	// ValidationModeQuarantine causes records that fail validation to be written to the quarantine table, rather than indexed.
+	ValidationModeQuarantine ValidationMode = "quarantine"
+)
+
+const (
+	// VALIDATE_PLACETYPE is the name of the rule ensuring that records have a valid `wof:placetype` property.
+	VALIDATE_PLACETYPE string = "placetype"
+	// VALIDATE_REPO is the name of the rule ensuring that records have a valid `wof:repo` property.
+	VALIDATE_REPO string = "repo"
+	// VALIDATE_PARENT is the name of the rule ensuring that a record's `wof:parent_id` property is listed in its `wof:belongsto` property.
+	VALIDATE_PARENT string = "parent"
+	// VALIDATE_EDTF is the name of the rule ensuring that a record's `edtf:` date properties are valid EDTF strings.
+	VALIDATE_EDTF string = "edtf"
+	// VALIDATE_RINGS is the name of the rule ensuring that all the rings in a record's (multi) polygon geometry are closed.
+	VALIDATE_RINGS string = "rings"
+)
+
+var re_placetype = regexp.MustCompile(`^[a-z][a-z0-9_\-]*$`)
+
+var re_repo = regexp.MustCompile(`^[a-z0-9][a-z0-9_\-\.]*$`)
+
+// ValidationRule is an interface for validating Who's On First records.
+type ValidationRule interface {
+	// Name returns the name of the rule.
+	Name() string
+	// Validate returns an error if the record in 'body' violates the rule.
+	Validate(context.Context, []byte) error
+}
+
+// ValidationRuleFunc is a function used to validate a Who's On First record.
+type ValidationRuleFunc func(context.Context, []byte) error
+
+// funcValidationRule implements the `ValidationRule` interface for `ValidationRuleFunc` functions.
+type funcValidationRule struct {
+	name string
+	fn   ValidationRuleFunc
+}
+
+// NewValidationRule returns a new `ValidationRule` instance named 'name' which validates records using 'fn'.
+func NewValidationRule(name string, fn ValidationRuleFunc) ValidationRule {
+
+	r := &funcValidationRule{
+		name: name,
+		fn:   fn,
+	}
+
+	return r
+}
+
+// Name returns the name of the rule.
+func (r *funcValidationRule) Name() string {
+	return r.name
+}
+
+// Validate returns an error if the record in 'body' violates the rule.
+func (r *funcValidationRule) Validate(ctx context.Context, body []byte) error {
+	return r.fn(ctx, body)
+}
+
+// DefaultValidationRules returns the list of default `ValidationRule` instances.
+func DefaultValidationRules() []ValidationRule {
+
+	return []ValidationRule{
+		NewValidationRule(VALIDATE_PLACETYPE, validatePlacetype),
+		NewValidationRule(VALIDATE_REPO, validateRepo),
+		NewValidationRule(VALIDATE_PARENT, validateParent),
+		NewValidationRule(VALIDATE_EDTF, validateEDTF),
+		NewValidationRule(VALIDATE_RINGS, validateRings),
+	}
+}
+
+// DefaultValidationRulesByName returns the default `ValidationRule` instances matching 'names'. If 'names' is empty all the
+// default rules are returned.
+func DefaultValidationRulesByName(names ...string) ([]ValidationRule, error) {
+
+	rules := DefaultValidationRules()
+
+	if len(names) == 0 {
+		return rules, nil
+	}
+
+	selected := make([]ValidationRule, 0)
+
+	for _, name := range names {
+
+		idx := slices.IndexFunc(rules, func(r ValidationRule) bool {
+			return r.Name() == name
+		})
+
+		if idx == -1 {
+			return nil, fmt.Errorf("Unknown validation rule '%s'", name)
+		}
+
+		selected = append(selected, rules[idx])
+	}
+
+	return selected, nil
+}
+
+// ValidationViolation is a struct describing a validation rule that a record violates.
+type ValidationViolation struct {
+	// Rule is the name of the rule that was violated.
+	Rule string `json:"rule"`
+	// Error is the error returned by the rule.
+	Error string `json:"error"`
+}
+
+// validateRecord returns the list of `ValidationViolation` for each of 'rules' that 'body' violates.
+func validateRecord(ctx context.Context, rules []ValidationRule, body []byte) []*ValidationViolation {
+
+	violations := make([]*ValidationViolation, 0)
+
+	for _, r := range rules {
+
+		err := r.Validate(ctx, body)
+
+		if err != nil {
+			violations = append(violations, &ValidationViolation{Rule: r.Name(), Error: err.Error()})
+		}
+	}
+
+	return violations
+}
+
+// ValidationSummary is a struct for counting, concurrently, the number of violations for each validation rule.
+type ValidationSummary struct {
+	mu         *sync.Mutex
+	violations map[string]int64
+}
+
+// NewValidationSummary returns a new `ValidationSummary` instance.
+func NewValidationSummary() *ValidationSummary {
+
+	s := &ValidationSummary{
+		mu:         new(sync.Mutex),
+		violations: make(map[string]int64),
+	}
+
+	return s
+}
+
+// Add increments the number of violations for the rule named 'rule'. Nothing is counted if 's' is nil.
+func (s *ValidationSummary) Add(rule string) {
+
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.violations[rule] += 1
+}
+
+// Violations returns a map of rule names and the number of times each was violated.
+func (s *ValidationSummary) Violations() map[string]int64 {
+
+	violations := make(map[string]int64)
+
+	if s == nil {
+		return violations
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for rule, count := range s.violations {
+		violations[rule] = count
+	}
+
+	return violations
+}
+
+// validatePlacetype ensures that 'body' has a non-empty, well-formed `wof:placetype` property.
+func validatePlacetype(ctx context.Context, body []byte) error {
+
+	pt, err := properties.Placetype(body)
+
+	if err != nil {
+		return err
+	}
+
+	if !re_placetype.MatchString(pt) {
+		return fmt.Errorf("Invalid wof:placetype '%s'", pt)
+	}
+
+	return nil
+}
+
+// validateRepo ensures that 'body' has a non-empty, well-formed `wof:repo` property.
+func validateRepo(ctx context.Context, body []byte) error {
+
+	repo, err := properties.Repo(body)
+
+	if err != nil {
+		return err
+	}
+
+	if !re_repo.MatchString(repo) {
+		return fmt.Errorf("Invalid wof:repo '%s'", repo)
+	}
+
+	return nil
+}
+
+// validateParent ensures that the `wof:parent_id` property in 'body', if it is a valid ID, is listed in its `wof:belongsto` property.
+func validateParent(ctx context.Context, body []byte) error {
+
+	parent_id, err := properties.ParentId(body)
+
+	if err != nil {
+		return err
+	}
+
+	// -1, -4, etc.
+
+	if parent_id <= 0 {
+		return nil
+	}
+
+	if !slices.Contains(properties.BelongsTo(body), parent_id) {
+		return fmt.Errorf("wof:parent_id (%d) is not listed in wof:belongsto", parent_id)
+	}
+
+	return nil
+}
+
+// validateEDTF ensures that the `edtf:inception`, `edtf:cessation` and `edtf:deprecated` (if present) properties in 'body'
+// are valid EDTF strings.
+func validateEDTF(ctx context.Context, body []byte) error {
+
+	dates := map[string]string{
+		"edtf:inception": properties.Inception(body),
+		"edtf:cessation": properties.Cessation(body),
+	}
+
+	deprecated := properties.Deprecated(body)
+
+	if deprecated != "" {
+		dates["edtf:deprecated"] = deprecated
+	}
+
+	for prop, d := range dates {
+
+		switch d {
+		case edtf.UNSPECIFIED_2012, edtf.OPEN_2012:
+			continue
+		default:
+			// pass
+		}
+
+		if !parser.IsValid(d) {
+			return fmt.Errorf("Invalid %s '%s'", prop, d)
+		}
+	}
+
+	return nil
+}
+
+// validateRings ensures that all the rings in 'body', if it has a polygon or multipolygon geometry, have at least four
+// positions and are closed.
+func validateRings(ctx context.Context, body []byte) error {
+
+	geojson_geom, err := geometry.Geometry(body)
+
+	if err != nil {
+		return err
+	}
+
+	polygons := make([]orb.Polygon, 0)
+
+	switch geom := geojson_geom.Geometry().(type) {
+	case orb.Polygon:
+		polygons = append(polygons, geom)
+	case orb.MultiPolygon:
+		polygons = append(polygons, geom...)
+	default:
+		return nil
+	}
+
+	for i, poly := range polygons {
+
+		for j, ring := range poly {
+
+			if len(ring) < 4 {
+				return fmt.Errorf("Ring %d of polygon %d has fewer than 4 positions", j, i)
+			}
+
+			if !ring.Closed() {
+				return fmt.Errorf("Ring %d of polygon %d is not closed", j, i)
+			}
+		}
+	}
+
+	return nil
+}